@@ -1,7 +1,16 @@
 package turnpike
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	pendingChallengeTTL = 5 * time.Minute
 )
 
 // CRAuthenticator describes a type that can handle challenge/response authentication.
@@ -13,6 +22,13 @@ type CRAuthenticator interface {
 	Authenticate(challenge map[string]interface{}, signature string) (map[string]interface{}, error)
 }
 
+// CRAuthenticatorExtra may be implemented by a CRAuthenticator that needs the
+// Extra dict of the AUTHENTICATE message, e.g. for channel binding. Realms call
+// AuthenticateExtra instead of Authenticate for such authenticators.
+type CRAuthenticatorExtra interface {
+	AuthenticateExtra(challenge map[string]interface{}, signature string, extra map[string]interface{}) (map[string]interface{}, error)
+}
+
 // Authenticator describes a type that can handle authentication based solely on the HELLO message.
 //
 // Use CRAuthenticator for more complex authentication schemes.
@@ -22,6 +38,41 @@ type Authenticator interface {
 	Authenticate(details map[string]interface{}) (map[string]interface{}, error)
 }
 
+// AuthExpiresDetail is the WELCOME detail in which authenticators may return
+// the time.Time at which the credentials a session authenticated with expire.
+// The router removes it from the WELCOME message, and kills the session with
+// wamp.close.auth_expired when the time comes.
+const AuthExpiresDetail = "expires"
+
+// RevocationNotifier may be implemented by authenticators whose credentials
+// can be revoked while sessions are using them. Realms register a hook with
+// OnRevoke, which the authenticator calls with the authid whose credentials
+// were revoked; the realm then kills that authid's sessions with
+// wamp.close.auth_revoked.
+type RevocationNotifier interface {
+	OnRevoke(hook func(authid string))
+}
+
+// ErrNoCredentials is returned (possibly wrapped) by authenticators when the
+// client didn't present any credentials for their authmethod, e.g. no cookie or
+// client certificate. Realms then try the client's next authmethod instead of
+// rejecting it.
+var ErrNoCredentials = errors.New("no credentials for authmethod")
+
+// AuthFailure is an authentication error that tells the client why it was
+// rejected. Authenticators return it to control the ABORT message the router
+// sends: Reason replaces the default wamp.error.authorization_failed, and
+// Details are added to the ABORT details.
+type AuthFailure struct {
+	Reason  URI
+	Message string
+	Details map[string]interface{}
+}
+
+func (e *AuthFailure) Error() string {
+	return e.Message
+}
+
 type basicTicketAuthenticator struct {
 	tickets map[string]bool
 }
@@ -48,3 +99,91 @@ func NewBasicTicketAuthenticator(tickets ...string) CRAuthenticator {
 	}
 	return authenticator
 }
+
+// NewTicketAuthFunc returns an AuthFunc that answers a ticket challenge with
+// the given ticket.
+func NewTicketAuthFunc(ticket string) AuthFunc {
+	return func(hello map[string]interface{}, challenge map[string]interface{}) (string, map[string]interface{}, error) {
+		return ticket, map[string]interface{}{}, nil
+	}
+}
+
+// pendingChallenge is the state of a challenge that has been issued by a
+// CRAuthenticator but not answered yet.
+type pendingChallenge struct {
+	authid string
+	data   string
+	// hello holds the HELLO details, for authenticators that need more than
+	// the authid
+	hello   map[string]interface{}
+	expires time.Time
+}
+
+// pendingChallenges keeps the state of issued challenges that must not be
+// revealed to the client, keyed by a unique value of the challenge such as its
+// nonce. Each challenge can only be answered once.
+type pendingChallenges struct {
+	challenges map[string]pendingChallenge
+	lock       sync.Mutex
+}
+
+func (p *pendingChallenges) add(key, authid, data string) {
+	p.put(key, pendingChallenge{authid: authid, data: data})
+}
+
+func (p *pendingChallenges) addHello(key string, hello map[string]interface{}) {
+	authid, _ := hello["authid"].(string)
+	p.put(key, pendingChallenge{authid: authid, hello: hello})
+}
+
+func (p *pendingChallenges) put(key string, c pendingChallenge) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	if p.challenges == nil {
+		p.challenges = make(map[string]pendingChallenge)
+	}
+	for k, pending := range p.challenges {
+		if now.After(pending.expires) {
+			delete(p.challenges, k)
+		}
+	}
+	c.expires = now.Add(pendingChallengeTTL)
+	p.challenges[key] = c
+}
+
+func (p *pendingChallenges) take(key string) (pendingChallenge, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	c, ok := p.challenges[key]
+	delete(p.challenges, key)
+	if !ok || time.Now().After(c.expires) {
+		return pendingChallenge{}, false
+	}
+	return c, true
+}
+
+type anonymousAuthenticator struct {
+	authrole string
+}
+
+// NewAnonymousAuthenticator returns an Authenticator for the "anonymous"
+// authmethod, which lets any client in with the given role and a generated
+// authid. Use it as Realm.DefaultAuthenticator to give clients without
+// credentials a restricted role on a realm that also supports other methods.
+func NewAnonymousAuthenticator(authrole string) Authenticator {
+	return &anonymousAuthenticator{authrole: authrole}
+}
+
+func (a *anonymousAuthenticator) Authenticate(details map[string]interface{}) (map[string]interface{}, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"authid":       "anonymous-" + hex.EncodeToString(b),
+		"authrole":     a.authrole,
+		"authmethod":   "anonymous",
+		"authprovider": "turnpike",
+	}, nil
+}
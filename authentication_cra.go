@@ -0,0 +1,188 @@
+package turnpike
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	defaultCRAIterations = 1000
+	defaultCRAKeyLen     = 32
+)
+
+// CRACredential holds what the router needs to know about a principal that
+// authenticates with WAMP-CRA.
+type CRACredential struct {
+	// Secret is the secret shared with the client. If Salt is set, Secret is
+	// the key derived from the client's password (see DeriveCRAKey) rather than
+	// the password itself.
+	Secret string
+	// Salt, Iterations and KeyLen are the PBKDF2 parameters of a salted secret.
+	// They are sent to the client in the challenge so it can derive the same key.
+	Salt       string
+	Iterations int
+	KeyLen     int
+	// AuthRole is the role the principal is assigned once authenticated.
+	AuthRole string
+}
+
+// CRACredentialLookup looks up the WAMP-CRA credential of a principal.
+//
+// LookupCRACredential returns an error if authid is unknown or may not
+// authenticate.
+type CRACredentialLookup interface {
+	LookupCRACredential(authid string) (*CRACredential, error)
+}
+
+// CRACredentials is a static CRACredentialLookup keyed by authid.
+type CRACredentials map[string]CRACredential
+
+func (c CRACredentials) LookupCRACredential(authid string) (*CRACredential, error) {
+	cred, ok := c[authid]
+	if !ok {
+		return nil, fmt.Errorf("no such principal: %s", authid)
+	}
+	return &cred, nil
+}
+
+// DeriveCRAKey derives the key for a salted WAMP-CRA secret from a password
+// with PBKDF2-HMAC-SHA256, the same way Autobahn's auth.derive_key does.
+// Iterations and keyLen default to 1000 and 32 if they are 0.
+func DeriveCRAKey(password, salt string, iterations, keyLen int) string {
+	if iterations == 0 {
+		iterations = defaultCRAIterations
+	}
+	if keyLen == 0 {
+		keyLen = defaultCRAKeyLen
+	}
+	key := pbkdf2.Key([]byte(password), []byte(salt), iterations, keyLen, sha256.New)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// craSignature computes the WAMP-CRA signature of a challenge string.
+func craSignature(key, challenge string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(challenge))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+type craChallenge struct {
+	AuthID       string `json:"authid"`
+	AuthRole     string `json:"authrole"`
+	AuthMethod   string `json:"authmethod"`
+	AuthProvider string `json:"authprovider"`
+	Nonce        string `json:"nonce"`
+	Timestamp    string `json:"timestamp"`
+	Session      ID     `json:"session"`
+}
+
+type craAuthenticator struct {
+	credentials CRACredentialLookup
+}
+
+// NewCRAAuthenticator returns a CRAuthenticator for the "wampcra" authmethod.
+//
+// The client must send its authid in the HELLO details. Its credential is
+// looked up on every authentication attempt, so changes to the credentials take
+// effect for the next session. On success the WELCOME details carry the authid
+// and authrole of the principal.
+func NewCRAAuthenticator(credentials CRACredentialLookup) CRAuthenticator {
+	return &craAuthenticator{credentials: credentials}
+}
+
+// OnRevoke registers a revocation hook with the credential lookup, if it
+// supports them.
+func (a *craAuthenticator) OnRevoke(hook func(authid string)) {
+	if n, ok := a.credentials.(RevocationNotifier); ok {
+		n.OnRevoke(hook)
+	}
+}
+
+func (a *craAuthenticator) Challenge(details map[string]interface{}) (map[string]interface{}, error) {
+	authid, _ := details["authid"].(string)
+	if authid == "" {
+		return nil, fmt.Errorf("no authid given")
+	}
+	cred, err := a.credentials.LookupCRACredential(authid)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	session, _ := details["session"].(ID)
+	challenge, err := json.Marshal(&craChallenge{
+		AuthID:       authid,
+		AuthRole:     cred.AuthRole,
+		AuthMethod:   "wampcra",
+		AuthProvider: "turnpike",
+		Nonce:        base64.StdEncoding.EncodeToString(nonce),
+		Timestamp:    time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		Session:      session,
+	})
+	if err != nil {
+		return nil, err
+	}
+	extra := map[string]interface{}{"challenge": string(challenge)}
+	if cred.Salt != "" {
+		extra["salt"] = cred.Salt
+		extra["iterations"] = cred.Iterations
+		extra["keylen"] = cred.KeyLen
+		if cred.Iterations == 0 {
+			extra["iterations"] = defaultCRAIterations
+		}
+		if cred.KeyLen == 0 {
+			extra["keylen"] = defaultCRAKeyLen
+		}
+	}
+	return extra, nil
+}
+
+func (a *craAuthenticator) Authenticate(challenge map[string]interface{}, signature string) (map[string]interface{}, error) {
+	chalStr, _ := challenge["challenge"].(string)
+	var chal craChallenge
+	if err := json.Unmarshal([]byte(chalStr), &chal); err != nil {
+		return nil, fmt.Errorf("invalid challenge: %v", err)
+	}
+	// look the credential up again in case it changed during the handshake
+	cred, err := a.credentials.LookupCRACredential(chal.AuthID)
+	if err != nil {
+		return nil, err
+	}
+	expected := craSignature(cred.Secret, chalStr)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return map[string]interface{}{
+		"authid":       chal.AuthID,
+		"authrole":     cred.AuthRole,
+		"authprovider": chal.AuthProvider,
+	}, nil
+}
+
+// NewCRAAuthFunc returns an AuthFunc that answers a WAMP-CRA challenge with
+// the given secret (or password, for salted secrets). Clients using it must
+// send their authid in the HELLO details.
+func NewCRAAuthFunc(secret string) AuthFunc {
+	return func(hello map[string]interface{}, challenge map[string]interface{}) (string, map[string]interface{}, error) {
+		chal, ok := challenge["challenge"].(string)
+		if !ok {
+			return "", nil, fmt.Errorf("no challenge data received")
+		}
+		key := secret
+		if salt, ok := challenge["salt"].(string); ok && salt != "" {
+			iterations, _ := toInt64(challenge["iterations"])
+			keyLen, _ := toInt64(challenge["keylen"])
+			key = DeriveCRAKey(secret, salt, int(iterations), int(keyLen))
+		}
+		return craSignature(key, chal), map[string]interface{}{}, nil
+	}
+}
@@ -0,0 +1,63 @@
+package turnpike
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCRAAuthenticator(t *testing.T) {
+	Convey("Given a realm with a WAMP-CRA authenticator", t, func() {
+		realm := Realm{
+			CRAuthenticators: map[string]CRAuthenticator{
+				"wampcra": NewCRAAuthenticator(CRACredentials{
+					"alice": {Secret: "secret1", AuthRole: "installer"},
+					"bob":   {Secret: DeriveCRAKey("password", "salt123", 100, 16), Salt: "salt123", Iterations: 100, KeyLen: 16, AuthRole: "viewer"},
+				}),
+			},
+		}
+
+		Convey("An unknown authid should not be challenged", func() {
+			_, err := realm.authenticate(map[string]interface{}{"authmethods": []interface{}{"wampcra"}, "authid": "mallory"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A client with the right secret should be welcomed with its identity", func() {
+			hello := map[string]interface{}{"authmethods": []interface{}{"wampcra"}, "authid": "alice", "session": ID(42)}
+			msg, err := realm.authenticate(hello)
+			So(err, ShouldBeNil)
+			challenge := msg.(*Challenge)
+			So(challenge.Extra["challenge"], ShouldContainSubstring, `"session":42`)
+
+			signature, _, err := NewCRAAuthFunc("secret1")(hello, challenge.Extra)
+			So(err, ShouldBeNil)
+			welcome, err := realm.checkResponse(challenge, &Authenticate{Signature: signature})
+			So(err, ShouldBeNil)
+			So(welcome.Details["authid"], ShouldEqual, "alice")
+			So(welcome.Details["authrole"], ShouldEqual, "installer")
+			So(welcome.Details["authmethod"], ShouldEqual, "wampcra")
+		})
+
+		Convey("A client with the wrong secret should be rejected", func() {
+			hello := map[string]interface{}{"authmethods": []interface{}{"wampcra"}, "authid": "alice"}
+			msg, err := realm.authenticate(hello)
+			So(err, ShouldBeNil)
+			challenge := msg.(*Challenge)
+			signature, _, _ := NewCRAAuthFunc("secret2")(hello, challenge.Extra)
+			_, err = realm.checkResponse(challenge, &Authenticate{Signature: signature})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A client should derive the key of a salted secret from its password", func() {
+			hello := map[string]interface{}{"authmethods": []interface{}{"wampcra"}, "authid": "bob"}
+			msg, err := realm.authenticate(hello)
+			So(err, ShouldBeNil)
+			challenge := msg.(*Challenge)
+			So(challenge.Extra["salt"], ShouldEqual, "salt123")
+			signature, _, _ := NewCRAAuthFunc("password")(hello, challenge.Extra)
+			welcome, err := realm.checkResponse(challenge, &Authenticate{Signature: signature})
+			So(err, ShouldBeNil)
+			So(welcome.Details["authrole"], ShouldEqual, "viewer")
+		})
+	})
+}
@@ -0,0 +1,189 @@
+package turnpike
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	cryptosignChallengeSize = 32
+)
+
+// CryptosignPrincipal holds the public keys a principal may authenticate with
+// using WAMP-Cryptosign, and the role it is assigned once authenticated.
+type CryptosignPrincipal struct {
+	PublicKeys []ed25519.PublicKey
+	AuthRole   string
+}
+
+// CryptosignKeyLookup looks up the registered public keys of a principal.
+type CryptosignKeyLookup interface {
+	LookupCryptosignPrincipal(authid string) (*CryptosignPrincipal, error)
+}
+
+// CryptosignPrincipals is a static CryptosignKeyLookup keyed by authid.
+type CryptosignPrincipals map[string]CryptosignPrincipal
+
+func (c CryptosignPrincipals) LookupCryptosignPrincipal(authid string) (*CryptosignPrincipal, error) {
+	principal, ok := c[authid]
+	if !ok {
+		return nil, fmt.Errorf("no such principal: %s", authid)
+	}
+	return &principal, nil
+}
+
+// ParseCryptosignPublicKey parses a hex-encoded Ed25519 public key, the format
+// used for the "pubkey" in the HELLO authextra.
+func ParseCryptosignPublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key length: %d", len(b))
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+type cryptosignAuthenticator struct {
+	keys CryptosignKeyLookup
+	// issued challenges by hex challenge, with the expected public key (if
+	// the client announced one) as data
+	pending pendingChallenges
+}
+
+// NewCryptosignAuthenticator returns a CRAuthenticator for the "cryptosign"
+// authmethod, which authenticates clients by an Ed25519 signature over a random
+// challenge.
+//
+// The client must send its authid in the HELLO details, and may announce the
+// key it will sign with as authextra.pubkey. The signature is accepted if it
+// verifies against any of the principal's registered keys (or the announced
+// key, if it is registered). On success the WELCOME details carry the authid
+// and authrole of the principal.
+func NewCryptosignAuthenticator(keys CryptosignKeyLookup) CRAuthenticator {
+	return &cryptosignAuthenticator{keys: keys}
+}
+
+func (a *cryptosignAuthenticator) Challenge(details map[string]interface{}) (map[string]interface{}, error) {
+	authid, _ := details["authid"].(string)
+	if authid == "" {
+		return nil, fmt.Errorf("no authid given")
+	}
+	authextra, _ := toStringMap(details["authextra"])
+	if cb := authextra["channel_binding"]; cb != nil {
+		return nil, fmt.Errorf("unsupported channel binding: %v", cb)
+	}
+	principal, err := a.keys.LookupCryptosignPrincipal(authid)
+	if err != nil {
+		return nil, err
+	}
+	pubkey, _ := authextra["pubkey"].(string)
+	if pubkey != "" {
+		key, err := ParseCryptosignPublicKey(pubkey)
+		if err != nil {
+			return nil, err
+		}
+		if !principal.hasKey(key) {
+			return nil, fmt.Errorf("public key is not registered for %s", authid)
+		}
+	}
+
+	challenge := make([]byte, cryptosignChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	chal := hex.EncodeToString(challenge)
+	a.pending.add(chal, authid, pubkey)
+	return map[string]interface{}{
+		"challenge":       chal,
+		"channel_binding": nil,
+	}, nil
+}
+
+func (a *cryptosignAuthenticator) Authenticate(challenge map[string]interface{}, signature string) (map[string]interface{}, error) {
+	chal, _ := challenge["challenge"].(string)
+	pending, ok := a.pending.take(chal)
+	if !ok {
+		return nil, fmt.Errorf("unknown or expired challenge")
+	}
+	message, err := hex.DecodeString(chal)
+	if err != nil {
+		return nil, fmt.Errorf("invalid challenge")
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding")
+	}
+	// the signature may be followed by the challenge it signs
+	switch len(sig) {
+	case ed25519.SignatureSize:
+	case ed25519.SignatureSize + len(message):
+		if !bytes.Equal(sig[ed25519.SignatureSize:], message) {
+			return nil, fmt.Errorf("signed message does not match the challenge")
+		}
+		sig = sig[:ed25519.SignatureSize]
+	default:
+		return nil, fmt.Errorf("invalid signature length: %d", len(sig))
+	}
+
+	// look the keys up again in case they were revoked during the handshake
+	principal, err := a.keys.LookupCryptosignPrincipal(pending.authid)
+	if err != nil {
+		return nil, err
+	}
+	keys := principal.PublicKeys
+	if pending.data != "" {
+		key, _ := ParseCryptosignPublicKey(pending.data)
+		if !principal.hasKey(key) {
+			return nil, fmt.Errorf("public key is no longer registered for %s", pending.authid)
+		}
+		keys = []ed25519.PublicKey{key}
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, message, sig) {
+			return map[string]interface{}{
+				"authid":       pending.authid,
+				"authrole":     principal.AuthRole,
+				"authprovider": "turnpike",
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid signature")
+}
+
+func (p *CryptosignPrincipal) hasKey(key ed25519.PublicKey) bool {
+	for _, k := range p.PublicKeys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewCryptosignAuthExtra returns the HELLO authextra for WAMP-Cryptosign,
+// announcing the public key of the private key the client signs with.
+func NewCryptosignAuthExtra(key ed25519.PrivateKey) map[string]interface{} {
+	return map[string]interface{}{
+		"pubkey":          hex.EncodeToString(key.Public().(ed25519.PublicKey)),
+		"channel_binding": nil,
+	}
+}
+
+// NewCryptosignAuthFunc returns an AuthFunc that answers a WAMP-Cryptosign
+// challenge by signing it with the given private key. Clients using it must
+// send their authid in the HELLO details.
+func NewCryptosignAuthFunc(key ed25519.PrivateKey) AuthFunc {
+	return func(hello map[string]interface{}, challenge map[string]interface{}) (string, map[string]interface{}, error) {
+		chal, _ := challenge["challenge"].(string)
+		message, err := hex.DecodeString(chal)
+		if err != nil || len(message) == 0 {
+			return "", nil, fmt.Errorf("invalid challenge: %q", chal)
+		}
+		sig := ed25519.Sign(key, message)
+		return hex.EncodeToString(append(sig, message...)), map[string]interface{}{}, nil
+	}
+}
@@ -0,0 +1,83 @@
+package turnpike
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCryptosignAuthenticator(t *testing.T) {
+	Convey("Given a realm with a WAMP-Cryptosign authenticator", t, func() {
+		pub, priv, _ := ed25519.GenerateKey(nil)
+		_, other, _ := ed25519.GenerateKey(nil)
+		realm := Realm{
+			CRAuthenticators: map[string]CRAuthenticator{
+				"cryptosign": NewCryptosignAuthenticator(CryptosignPrincipals{
+					"alice": {PublicKeys: []ed25519.PublicKey{pub}, AuthRole: "device"},
+				}),
+			},
+		}
+
+		Convey("An unknown authid should not be challenged", func() {
+			_, err := realm.authenticate(map[string]interface{}{"authmethods": []interface{}{"cryptosign"}, "authid": "mallory"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("An unregistered public key should not be challenged", func() {
+			_, err := realm.authenticate(map[string]interface{}{
+				"authmethods": []interface{}{"cryptosign"},
+				"authid":      "alice",
+				"authextra":   NewCryptosignAuthExtra(other),
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A client signing with a registered key should be welcomed with its identity", func() {
+			hello := map[string]interface{}{
+				"authmethods": []interface{}{"cryptosign"},
+				"authid":      "alice",
+				"authextra":   NewCryptosignAuthExtra(priv),
+			}
+			msg, err := realm.authenticate(hello)
+			So(err, ShouldBeNil)
+			challenge := msg.(*Challenge)
+			So(challenge.Extra["challenge"], ShouldHaveLength, 2*cryptosignChallengeSize)
+
+			signature, _, err := NewCryptosignAuthFunc(priv)(hello, challenge.Extra)
+			So(err, ShouldBeNil)
+			welcome, err := realm.checkResponse(challenge, &Authenticate{Signature: signature})
+			So(err, ShouldBeNil)
+			So(welcome.Details["authid"], ShouldEqual, "alice")
+			So(welcome.Details["authrole"], ShouldEqual, "device")
+			So(welcome.Details["authmethod"], ShouldEqual, "cryptosign")
+
+			Convey("And the challenge should not be accepted again", func() {
+				_, err := realm.checkResponse(challenge, &Authenticate{Signature: signature})
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("A signature followed by a message other than the challenge should be rejected", func() {
+			hello := map[string]interface{}{"authmethods": []interface{}{"cryptosign"}, "authid": "alice"}
+			msg, err := realm.authenticate(hello)
+			So(err, ShouldBeNil)
+			challenge := msg.(*Challenge)
+			signature, _, _ := NewCryptosignAuthFunc(priv)(hello, challenge.Extra)
+			forged := signature[:2*ed25519.SignatureSize] + strings.Repeat("00", cryptosignChallengeSize)
+			_, err = realm.checkResponse(challenge, &Authenticate{Signature: forged})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A client signing with another key should be rejected", func() {
+			hello := map[string]interface{}{"authmethods": []interface{}{"cryptosign"}, "authid": "alice"}
+			msg, err := realm.authenticate(hello)
+			So(err, ShouldBeNil)
+			challenge := msg.(*Challenge)
+			signature, _, _ := NewCryptosignAuthFunc(other)(hello, challenge.Extra)
+			_, err = realm.checkResponse(challenge, &Authenticate{Signature: signature})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
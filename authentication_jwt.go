@@ -0,0 +1,343 @@
+package turnpike
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Reasons reported in the ABORT details when a JWT is rejected.
+const (
+	JWTMalformed            = "malformed"
+	JWTUnsupportedAlgorithm = "unsupported_algorithm"
+	JWTUnknownKey           = "unknown_key"
+	JWTInvalidSignature     = "invalid_signature"
+	JWTExpired              = "expired"
+	JWTNotYetValid          = "not_yet_valid"
+	JWTInvalidAudience      = "invalid_audience"
+	JWTInvalidIssuer        = "invalid_issuer"
+	JWTMissingClaim         = "missing_claim"
+)
+
+// JWTConfig configures the verification of JWT tickets.
+type JWTConfig struct {
+	// Keys maps key IDs (the "kid" header) to verification keys: a []byte
+	// secret for HS256, an *rsa.PublicKey for RS256 or an *ecdsa.PublicKey on
+	// P-256 for ES256. Tokens without a kid are checked against every key of
+	// the token's algorithm. See LoadJWKS to read keys from a JWKS file.
+	Keys map[string]interface{}
+	// Issuer and Audience, if set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+	// Leeway is the clock skew tolerated when checking exp and nbf.
+	Leeway time.Duration
+	// AuthIDClaim and AuthRoleClaim name the claims holding the authid and
+	// authrole; they default to "sub" and "role". DefaultAuthRole is used for
+	// tokens without a role claim; if it is empty such tokens are rejected.
+	AuthIDClaim     string
+	AuthRoleClaim   string
+	DefaultAuthRole string
+	// WelcomeClaims maps claims to the WELCOME details they are copied to, if
+	// present in the token.
+	WelcomeClaims map[string]string
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtAuthenticator struct {
+	config JWTConfig
+}
+
+// NewJWTAuthenticator returns a CRAuthenticator for the "ticket" authmethod
+// that accepts JWTs signed with HS256, RS256 or ES256 as tickets. Tokens are
+// verified offline against the configured keys, and their exp, nbf, iss and
+// aud claims are checked.
+//
+// Sessions are killed with wamp.close.auth_expired when their token expires.
+// Rejected tokens are reported with an *AuthFailure, so the ABORT message
+// carries wamp.error.authentication_failed and the reason in its details, e.g.
+// {"reason": "expired"}.
+func NewJWTAuthenticator(config JWTConfig) CRAuthenticator {
+	if config.AuthIDClaim == "" {
+		config.AuthIDClaim = "sub"
+	}
+	if config.AuthRoleClaim == "" {
+		config.AuthRoleClaim = "role"
+	}
+	return &jwtAuthenticator{config: config}
+}
+
+func jwtFailure(reason string, format string, a ...interface{}) error {
+	return &AuthFailure{
+		Reason:  ErrAuthenticationFailed,
+		Message: fmt.Sprintf(format, a...),
+		Details: map[string]interface{}{"reason": reason},
+	}
+}
+
+func (a *jwtAuthenticator) Challenge(details map[string]interface{}) (map[string]interface{}, error) {
+	return make(map[string]interface{}), nil
+}
+
+func (a *jwtAuthenticator) Authenticate(challenge map[string]interface{}, signature string) (map[string]interface{}, error) {
+	claims, err := a.verify(signature, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	authid, _ := claims[a.config.AuthIDClaim].(string)
+	if authid == "" {
+		return nil, jwtFailure(JWTMissingClaim, "token has no %s claim", a.config.AuthIDClaim)
+	}
+	authrole, _ := claims[a.config.AuthRoleClaim].(string)
+	if authrole == "" {
+		authrole = a.config.DefaultAuthRole
+	}
+	if authrole == "" {
+		return nil, jwtFailure(JWTMissingClaim, "token has no %s claim", a.config.AuthRoleClaim)
+	}
+	details := map[string]interface{}{
+		"authid":       authid,
+		"authrole":     authrole,
+		"authprovider": "jwt",
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		details[AuthExpiresDetail] = time.Unix(int64(exp), 0).Add(a.config.Leeway)
+	}
+	for claim, key := range a.config.WelcomeClaims {
+		if v, ok := claims[claim]; ok {
+			details[key] = v
+		}
+	}
+	return details, nil
+}
+
+// verify checks the signature and the registered claims of a token and
+// returns its claims.
+func (a *jwtAuthenticator) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, jwtFailure(JWTMalformed, "malformed token")
+	}
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, jwtFailure(JWTMalformed, "malformed token header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, jwtFailure(JWTMalformed, "malformed token signature: %v", err)
+	}
+	if err := a.verifySignature(header, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, jwtFailure(JWTMalformed, "malformed token claims: %v", err)
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(a.config.Leeway)) {
+			return nil, jwtFailure(JWTExpired, "token expired")
+		}
+	}
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Before(time.Unix(int64(nbf), 0).Add(-a.config.Leeway)) {
+			return nil, jwtFailure(JWTNotYetValid, "token not valid yet")
+		}
+	}
+	if a.config.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.config.Issuer {
+			return nil, jwtFailure(JWTInvalidIssuer, "invalid token issuer: %s", iss)
+		}
+	}
+	if a.config.Audience != "" && !jwtHasAudience(claims["aud"], a.config.Audience) {
+		return nil, jwtFailure(JWTInvalidAudience, "invalid token audience: %v", claims["aud"])
+	}
+	return claims, nil
+}
+
+func (a *jwtAuthenticator) verifySignature(header jwtHeader, signed string, sig []byte) error {
+	switch header.Alg {
+	case "HS256", "RS256", "ES256":
+	default:
+		return jwtFailure(JWTUnsupportedAlgorithm, "unsupported token algorithm: %s", header.Alg)
+	}
+	var keys []interface{}
+	if header.Kid != "" {
+		key, ok := a.config.Keys[header.Kid]
+		if !ok {
+			return jwtFailure(JWTUnknownKey, "unknown token key: %s", header.Kid)
+		}
+		keys = append(keys, key)
+	} else {
+		for _, key := range a.config.Keys {
+			keys = append(keys, key)
+		}
+	}
+	hash := sha256.Sum256([]byte(signed))
+	found := false
+	for _, key := range keys {
+		switch key := key.(type) {
+		case []byte:
+			if header.Alg != "HS256" {
+				continue
+			}
+			found = true
+			mac := hmac.New(sha256.New, key)
+			mac.Write([]byte(signed))
+			if hmac.Equal(sig, mac.Sum(nil)) {
+				return nil
+			}
+		case *rsa.PublicKey:
+			if header.Alg != "RS256" {
+				continue
+			}
+			found = true
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if header.Alg != "ES256" || key.Curve != elliptic.P256() {
+				continue
+			}
+			found = true
+			// ES256 signatures are the 32-byte r and s concatenated
+			if len(sig) != 64 {
+				continue
+			}
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			if ecdsa.Verify(key, hash[:], r, s) {
+				return nil
+			}
+		}
+	}
+	if !found {
+		return jwtFailure(JWTUnknownKey, "no %s key to verify the token with", header.Alg)
+	}
+	return jwtFailure(JWTInvalidSignature, "invalid token signature")
+}
+
+func decodeJWTSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// jwtHasAudience reports whether an aud claim, which is a string or an array
+// of strings, contains audience.
+func jwtHasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// LoadJWKS reads the keys of a local JSON Web Key Set file for use as
+// JWTConfig.Keys. RSA, P-256 EC and symmetric ("oct") keys are supported; keys
+// of other types are skipped. Keys without a kid are stored as "#<index>",
+// their position in the file; tokens without a kid are checked against them
+// all. Duplicate kids are rejected.
+func LoadJWKS(path string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS file %s: %v", path, err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for i, k := range set.Keys {
+		key, err := k.key()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS file %s: key %d: %v", path, i, err)
+		}
+		if key == nil {
+			log.Printf("skipping unsupported key %d of type %s in %s", i, k.Kty, path)
+			continue
+		}
+		kid := k.Kid
+		if kid == "" {
+			kid = fmt.Sprintf("#%d", i)
+		}
+		if _, ok := keys[kid]; ok {
+			return nil, fmt.Errorf("JWKS file %s: duplicate key ID %s", path, kid)
+		}
+		keys[kid] = key
+	}
+	return keys, nil
+}
+
+func (k *jwk) key() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %v", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %v", err)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %v", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %v", err)
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on curve")
+		}
+		return key, nil
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret: %v", err)
+		}
+		return secret, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,224 @@
+package turnpike
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testJWT(alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]interface{}{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	hash := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, key, hash[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func jwtFailureReason(err error) interface{} {
+	if failure, ok := err.(*AuthFailure); ok {
+		return failure.Details["reason"]
+	}
+	return nil
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	Convey("Given a JWT authenticator with HS256, RS256 and ES256 keys", t, func() {
+		secret := []byte("shared secret")
+		rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+		ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		auth := NewJWTAuthenticator(JWTConfig{
+			Keys: map[string]interface{}{
+				"hs":  secret,
+				"rsa": &rsaKey.PublicKey,
+				"ec":  &ecKey.PublicKey,
+			},
+			Issuer:        "https://idp.example.com",
+			Audience:      "turnpike",
+			WelcomeClaims: map[string]string{"site": "site"},
+		})
+		claims := func() map[string]interface{} {
+			return map[string]interface{}{
+				"sub":  "alice",
+				"role": "installer",
+				"site": "hq",
+				"iss":  "https://idp.example.com",
+				"aud":  []string{"turnpike", "other"},
+				"exp":  time.Now().Add(time.Hour).Unix(),
+			}
+		}
+
+		Convey("Tokens signed with each algorithm should be accepted", func() {
+			for _, token := range []string{
+				testJWT("HS256", "hs", secret, claims()),
+				testJWT("RS256", "rsa", rsaKey, claims()),
+				testJWT("ES256", "", ecKey, claims()),
+			} {
+				details, err := auth.Authenticate(nil, token)
+				So(err, ShouldBeNil)
+				So(details["authid"], ShouldEqual, "alice")
+				So(details["authrole"], ShouldEqual, "installer")
+				So(details["site"], ShouldEqual, "hq")
+			}
+		})
+
+		Convey("A token signed with another key should be rejected", func() {
+			_, err := auth.Authenticate(nil, testJWT("HS256", "hs", []byte("wrong"), claims()))
+			So(jwtFailureReason(err), ShouldEqual, JWTInvalidSignature)
+		})
+
+		Convey("A token with an unknown kid should be rejected", func() {
+			_, err := auth.Authenticate(nil, testJWT("HS256", "nope", secret, claims()))
+			So(jwtFailureReason(err), ShouldEqual, JWTUnknownKey)
+		})
+
+		Convey("An unsigned token should be rejected", func() {
+			_, err := auth.Authenticate(nil, testJWT("none", "", nil, claims()))
+			So(jwtFailureReason(err), ShouldEqual, JWTUnsupportedAlgorithm)
+		})
+
+		Convey("Tokens with invalid claims should be rejected with the reason", func() {
+			expired := claims()
+			expired["exp"] = time.Now().Add(-time.Minute).Unix()
+			_, err := auth.Authenticate(nil, testJWT("HS256", "hs", secret, expired))
+			So(jwtFailureReason(err), ShouldEqual, JWTExpired)
+
+			early := claims()
+			early["nbf"] = time.Now().Add(time.Minute).Unix()
+			_, err = auth.Authenticate(nil, testJWT("HS256", "hs", secret, early))
+			So(jwtFailureReason(err), ShouldEqual, JWTNotYetValid)
+
+			audience := claims()
+			audience["aud"] = "other"
+			_, err = auth.Authenticate(nil, testJWT("HS256", "hs", secret, audience))
+			So(jwtFailureReason(err), ShouldEqual, JWTInvalidAudience)
+
+			issuer := claims()
+			issuer["iss"] = "https://evil.example.com"
+			_, err = auth.Authenticate(nil, testJWT("HS256", "hs", secret, issuer))
+			So(jwtFailureReason(err), ShouldEqual, JWTInvalidIssuer)
+
+			role := claims()
+			delete(role, "role")
+			_, err = auth.Authenticate(nil, testJWT("HS256", "hs", secret, role))
+			So(jwtFailureReason(err), ShouldEqual, JWTMissingClaim)
+		})
+
+		Convey("The router should report the reason in the ABORT details", func() {
+			r := NewDefaultRouter()
+			defer r.Close()
+			r.RegisterRealm(testRealm, &Realm{
+				CRAuthenticators: map[string]CRAuthenticator{"ticket": auth},
+			})
+			expired := claims()
+			expired["exp"] = time.Now().Add(-time.Minute).Unix()
+
+			c, server := localPipe()
+			client := &basicPeer{c}
+			client.Send(&Hello{Realm: testRealm, Details: map[string]interface{}{"authmethods": []interface{}{"ticket"}}})
+			client.Send(&Authenticate{Signature: testJWT("HS256", "hs", secret, expired)})
+			So(r.Accept(server), ShouldNotBeNil)
+
+			So((<-client.incoming).MessageType(), ShouldEqual, CHALLENGE)
+			abort, ok := (<-client.incoming).(*Abort)
+			So(ok, ShouldBeTrue)
+			So(abort.Reason, ShouldEqual, ErrAuthenticationFailed)
+			So(abort.Details["reason"], ShouldEqual, JWTExpired)
+		})
+	})
+}
+
+func TestLoadJWKS(t *testing.T) {
+	Convey("Keys should be loaded from a JWKS file", t, func() {
+		rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+		ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		enc := base64.RawURLEncoding.EncodeToString
+		jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "n": enc(rsaKey.N.Bytes()), "e": enc(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": enc(ecKey.X.Bytes()), "y": enc(ecKey.Y.Bytes())},
+			{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": enc([]byte("ignored"))},
+		}})
+		dir, _ := ioutil.TempDir("", "jwks")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "jwks.json")
+		So(ioutil.WriteFile(path, jwks, 0600), ShouldBeNil)
+
+		keys, err := LoadJWKS(path)
+		So(err, ShouldBeNil)
+		So(keys, ShouldHaveLength, 2)
+
+		auth := NewJWTAuthenticator(JWTConfig{Keys: keys, DefaultAuthRole: "user"})
+		details, err := auth.Authenticate(nil, testJWT("RS256", "rsa", rsaKey, map[string]interface{}{"sub": "bob"}))
+		So(err, ShouldBeNil)
+		So(details["authrole"], ShouldEqual, "user")
+		_, err = auth.Authenticate(nil, testJWT("ES256", "ec", ecKey, map[string]interface{}{"sub": "bob"}))
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Keys without a kid should all be kept", t, func() {
+		enc := base64.RawURLEncoding.EncodeToString
+		jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "oct", "k": enc([]byte("first secret"))},
+			{"kty": "oct", "k": enc([]byte("second secret"))},
+		}})
+		dir, _ := ioutil.TempDir("", "jwks")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "jwks.json")
+		So(ioutil.WriteFile(path, jwks, 0600), ShouldBeNil)
+
+		keys, err := LoadJWKS(path)
+		So(err, ShouldBeNil)
+		So(keys, ShouldHaveLength, 2)
+		auth := NewJWTAuthenticator(JWTConfig{Keys: keys, DefaultAuthRole: "user"})
+		_, err = auth.Authenticate(nil, testJWT("HS256", "", []byte("first secret"), map[string]interface{}{"sub": "bob"}))
+		So(err, ShouldBeNil)
+		_, err = auth.Authenticate(nil, testJWT("HS256", "", []byte("second secret"), map[string]interface{}{"sub": "bob"}))
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Duplicate key IDs should be rejected", t, func() {
+		enc := base64.RawURLEncoding.EncodeToString
+		jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "oct", "kid": "k", "k": enc([]byte("first secret"))},
+			{"kty": "oct", "kid": "k", "k": enc([]byte("second secret"))},
+		}})
+		dir, _ := ioutil.TempDir("", "jwks")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "jwks.json")
+		So(ioutil.WriteFile(path, jwks, 0600), ShouldBeNil)
+
+		_, err := LoadJWKS(path)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,298 @@
+package turnpike
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultProcedureAuthenticatorTimeout = 5 * time.Second
+
+	// AuthenticatorUnavailable is the reason reported in the ABORT details
+	// when an authenticator procedure can't be called.
+	AuthenticatorUnavailable = "authenticator_unavailable"
+)
+
+type authenticationResult struct {
+	details map[string]interface{}
+	err     error
+	expires time.Time
+}
+
+// procedureAuth calls an authenticator procedure and caches its results.
+type procedureAuth struct {
+	realm     *Realm
+	procedure string
+	ttl       time.Duration
+	timeout   time.Duration
+
+	cache     map[string]authenticationResult
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+func newProcedureAuth(realm *Realm, procedure string, ttl time.Duration) *procedureAuth {
+	return &procedureAuth{
+		realm:     realm,
+		procedure: procedure,
+		ttl:       ttl,
+		timeout:   defaultProcedureAuthenticatorTimeout,
+		cache:     make(map[string]authenticationResult),
+	}
+}
+
+type procedureAuthenticator struct {
+	*procedureAuth
+}
+
+// NewProcedureAuthenticator returns an Authenticator that delegates
+// authentication to a WAMP procedure registered on the realm, which it calls
+// through the realm's own internal client. Use it for authmethods that don't
+// need a challenge, e.g. "anonymous" or "tls", or as the realm's
+// DefaultAuthenticator, in which case the authmethod is empty.
+//
+// The procedure is called with the positional arguments [realm, authid,
+// details], where details holds the authmethod, authid, authextra and session
+// ID of the HELLO, and its transport (remote_addr, headers, cookies and the
+// peer_certificate, if any). It must return a dict with at least an
+// "authrole", which becomes the WELCOME details; "authid" defaults to the
+// authid of the HELLO. A string result is taken as the authrole.
+//
+// An error returned by the procedure rejects the client with the error's URI
+// as ABORT reason. If the procedure can't be called, clients are rejected with
+// wamp.error.authentication_failed and the reason "authenticator_unavailable".
+// Results are cached for ttl per set of call arguments; a ttl of 0 disables
+// caching.
+func NewProcedureAuthenticator(realm *Realm, procedure string, ttl time.Duration) Authenticator {
+	return &procedureAuthenticator{newProcedureAuth(realm, procedure, ttl)}
+}
+
+func (a *procedureAuthenticator) Authenticate(details map[string]interface{}) (map[string]interface{}, error) {
+	authmethod, _ := details["authmethod"].(string)
+	return a.authenticate(authmethod, details, nil)
+}
+
+type procedureTicketAuthenticator struct {
+	*procedureAuth
+	// HELLO details by challenge nonce
+	pending pendingChallenges
+}
+
+// NewProcedureTicketAuthenticator returns a CRAuthenticator for the "ticket"
+// authmethod that delegates authentication to a WAMP procedure, like
+// NewProcedureAuthenticator. The ticket is passed to the procedure as
+// details.ticket.
+func NewProcedureTicketAuthenticator(realm *Realm, procedure string, ttl time.Duration) CRAuthenticator {
+	return &procedureTicketAuthenticator{procedureAuth: newProcedureAuth(realm, procedure, ttl)}
+}
+
+func (a *procedureTicketAuthenticator) Challenge(details map[string]interface{}) (map[string]interface{}, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	nonce := hex.EncodeToString(b)
+	a.pending.addHello(nonce, copyDetails(details))
+	return map[string]interface{}{"nonce": nonce}, nil
+}
+
+func (a *procedureTicketAuthenticator) Authenticate(challenge map[string]interface{}, signature string) (map[string]interface{}, error) {
+	nonce, _ := challenge["nonce"].(string)
+	pending, ok := a.pending.take(nonce)
+	if !ok {
+		return nil, fmt.Errorf("unknown or expired challenge")
+	}
+	return a.authenticate("ticket", pending.hello, map[string]interface{}{"ticket": signature})
+}
+
+func (a *procedureAuth) authenticate(authmethod string, hello map[string]interface{}, credentials map[string]interface{}) (map[string]interface{}, error) {
+	authid, _ := hello["authid"].(string)
+	authextra, _ := toStringMap(hello["authextra"])
+	details := map[string]interface{}{
+		"authmethod": authmethod,
+		"authid":     authid,
+		"authextra":  authextra,
+	}
+	if transport, ok := transportFromDetails(hello); ok {
+		details["transport"] = transportDetails(transport)
+	}
+	for k, v := range credentials {
+		details[k] = v
+	}
+	// results of arguments that can't be hashed aren't cached
+	key := authenticationCacheKey(a.realm.URI, details)
+	if result, ok := a.cached(key); ok {
+		return copyDetails(result.details), result.err
+	}
+
+	details["session"] = hello["session"]
+	result, err := a.call(authid, details)
+	if err != nil {
+		// don't cache unavailability, so a restarted procedure is called again
+		var failure *AuthFailure
+		if !errors.As(err, &failure) || failure.Details["reason"] != AuthenticatorUnavailable {
+			a.store(key, nil, err)
+		}
+		return nil, err
+	}
+	a.store(key, result, nil)
+	log.WithFields(logrus.Fields{
+		"authid":        result["authid"],
+		"authrole":      result["authrole"],
+		"authmethod":    authmethod,
+		"authenticator": a.procedure,
+	}).Debug("dynamic authentication")
+	return copyDetails(result), nil
+}
+
+// call calls the authenticator procedure and interprets its result.
+func (a *procedureAuth) call(authid string, details map[string]interface{}) (map[string]interface{}, error) {
+	client := a.realm.localClient
+	if client == nil {
+		return nil, a.unavailable(fmt.Errorf("realm has not been initialized"))
+	}
+	options := map[string]interface{}{"timeout": int64(a.timeout / time.Millisecond)}
+	res, err := client.Call(a.procedure, options, []interface{}{string(a.realm.URI), authid, details}, nil)
+	if rpcErr, ok := err.(RPCError); ok {
+		switch rpcErr.ErrorMessage.Error {
+		case ErrNoSuchProcedure, ErrTimeout, ErrSystemShutdown:
+			return nil, a.unavailable(err)
+		}
+		message := fmt.Sprintf("rejected by authenticator %s", a.procedure)
+		if len(rpcErr.ErrorMessage.Arguments) > 0 {
+			message = fmt.Sprint(rpcErr.ErrorMessage.Arguments[0])
+		}
+		return nil, &AuthFailure{Reason: rpcErr.ErrorMessage.Error, Message: message}
+	} else if err != nil {
+		return nil, a.unavailable(err)
+	}
+	if len(res.Arguments) == 0 {
+		return nil, fmt.Errorf("authenticator %s returned no result", a.procedure)
+	}
+	result := make(map[string]interface{})
+	if authrole, ok := res.Arguments[0].(string); ok {
+		result["authrole"] = authrole
+	} else if m, ok := toStringMap(res.Arguments[0]); ok {
+		for k, v := range m {
+			result[k] = v
+		}
+	} else {
+		return nil, fmt.Errorf("invalid result from authenticator %s: %v", a.procedure, res.Arguments[0])
+	}
+	if authrole, _ := result["authrole"].(string); authrole == "" {
+		return nil, fmt.Errorf("authenticator %s returned no authrole", a.procedure)
+	}
+	if id, _ := result["authid"].(string); id == "" {
+		result["authid"] = authid
+	}
+	if _, ok := result["authprovider"]; !ok {
+		result["authprovider"] = "dynamic"
+	}
+	return result, nil
+}
+
+func (a *procedureAuth) unavailable(err error) error {
+	log.WithFields(logrus.Fields{
+		"authenticator": a.procedure,
+		"error":         err,
+	}).Error("authenticator unavailable")
+	return &AuthFailure{
+		Reason:  ErrAuthenticationFailed,
+		Message: fmt.Sprintf("authenticator %s is unavailable", a.procedure),
+		Details: map[string]interface{}{"reason": AuthenticatorUnavailable},
+	}
+}
+
+// transportDetails converts transport information to a dict that can be
+// serialized.
+func transportDetails(t *TransportInfo) map[string]interface{} {
+	headers := make(map[string]interface{}, len(t.Headers))
+	for k, v := range t.Headers {
+		headers[k] = v
+	}
+	cookies := make(map[string]interface{}, len(t.Cookies))
+	for _, c := range t.Cookies {
+		cookies[c.Name] = c.Value
+	}
+	details := map[string]interface{}{
+		"remote_addr": t.RemoteAddr,
+		"headers":     headers,
+		"cookies":     cookies,
+	}
+	if len(t.PeerCertificates) > 0 {
+		cert := t.PeerCertificates[0]
+		fingerprint := sha256.Sum256(cert.Raw)
+		details["peer_certificate"] = map[string]interface{}{
+			"subject":     cert.Subject.String(),
+			"common_name": cert.Subject.CommonName,
+			"issuer":      cert.Issuer.String(),
+			"fingerprint": hex.EncodeToString(fingerprint[:]),
+		}
+	}
+	return details
+}
+
+// authenticationCacheKey hashes the arguments of an authentication, so that
+// credentials aren't kept in the cache.
+func authenticationCacheKey(realm URI, details map[string]interface{}) string {
+	b, err := json.Marshal(details)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(append([]byte(string(realm)+"\x00"), b...))
+	return hex.EncodeToString(sum[:])
+}
+
+func copyDetails(details map[string]interface{}) map[string]interface{} {
+	if details == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(details))
+	for k, v := range details {
+		c[k] = v
+	}
+	return c
+}
+
+func (a *procedureAuth) cached(key string) (authenticationResult, bool) {
+	if key == "" {
+		return authenticationResult{}, false
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	result, ok := a.cache[key]
+	if !ok {
+		return authenticationResult{}, false
+	}
+	if time.Now().After(result.expires) {
+		delete(a.cache, key)
+		return authenticationResult{}, false
+	}
+	return result, true
+}
+
+func (a *procedureAuth) store(key string, details map[string]interface{}, err error) {
+	if a.ttl <= 0 || key == "" {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	if now.Sub(a.lastSweep) > a.ttl {
+		for k, result := range a.cache {
+			if now.After(result.expires) {
+				delete(a.cache, k)
+			}
+		}
+		a.lastSweep = now
+	}
+	a.cache[key] = authenticationResult{details: details, err: err, expires: now.Add(a.ttl)}
+}
@@ -0,0 +1,103 @@
+package turnpike
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProcedureAuthenticator(t *testing.T) {
+	Convey("Given a realm that delegates authentication to a procedure", t, func() {
+		router := NewDefaultRouter().(*defaultRouter)
+		defer router.Close()
+		realm := &Realm{}
+		realm.CRAuthenticators = map[string]CRAuthenticator{
+			"ticket": NewProcedureTicketAuthenticator(realm, "turnpike.test.authenticate", time.Minute),
+		}
+		realm.Authenticators = map[string]Authenticator{
+			"anonymous": NewProcedureAuthenticator(realm, "turnpike.test.authenticate", 0),
+		}
+		So(router.RegisterRealm("turnpike.test", realm), ShouldBeNil)
+		So(realm.URI, ShouldEqual, "turnpike.test")
+
+		var calls int32
+		var lastDetails map[string]interface{}
+		register := func() {
+			err := realm.localClient.Register("turnpike.test.authenticate", func(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+				atomic.AddInt32(&calls, 1)
+				lastDetails = args[2].(map[string]interface{})
+				if args[0] != "turnpike.test" {
+					return &CallResult{Err: "com.example.wrong_realm"}
+				}
+				switch lastDetails["authmethod"] {
+				case "anonymous":
+					return &CallResult{Args: []interface{}{"guest"}}
+				case "ticket":
+					if lastDetails["ticket"] == "ticket1" {
+						return &CallResult{Args: []interface{}{map[string]interface{}{
+							"authrole":  "installer",
+							"authextra": map[string]interface{}{"site": "hq"},
+						}}}
+					}
+				}
+				return &CallResult{Err: "com.example.invalid_ticket"}
+			}, nil)
+			So(err, ShouldBeNil)
+		}
+		ticket := func(authid, signature string) (*Welcome, error) {
+			hello := map[string]interface{}{"authmethods": []interface{}{"ticket"}, "authid": authid, "session": NewID()}
+			msg, err := realm.authenticate(hello)
+			So(err, ShouldBeNil)
+			return realm.checkResponse(msg.(*Challenge), &Authenticate{Signature: signature})
+		}
+
+		Convey("When the procedure is registered", func() {
+			register()
+
+			Convey("Its result should become the welcome details and be cached", func() {
+				welcome, err := ticket("alice", "ticket1")
+				So(err, ShouldBeNil)
+				So(welcome.Details["authid"], ShouldEqual, "alice")
+				So(welcome.Details["authrole"], ShouldEqual, "installer")
+				So(welcome.Details["authmethod"], ShouldEqual, "ticket")
+				So(welcome.Details["authextra"], ShouldResemble, map[string]interface{}{"site": "hq"})
+				So(lastDetails["authid"], ShouldEqual, "alice")
+
+				welcome, err = ticket("alice", "ticket1")
+				So(err, ShouldBeNil)
+				So(welcome.Details["authrole"], ShouldEqual, "installer")
+				So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+			})
+
+			Convey("Its errors should become the ABORT reason", func() {
+				_, err := ticket("alice", "ticket2")
+				failure, ok := err.(*AuthFailure)
+				So(ok, ShouldBeTrue)
+				So(failure.Reason, ShouldEqual, "com.example.invalid_ticket")
+			})
+
+			Convey("A string result should be taken as the authrole", func() {
+				msg, err := realm.authenticate(map[string]interface{}{"authmethods": []interface{}{"anonymous"}, "authid": "kiosk-1"})
+				So(err, ShouldBeNil)
+				So(msg.(*Welcome).Details["authrole"], ShouldEqual, "guest")
+				So(msg.(*Welcome).Details["authid"], ShouldEqual, "kiosk-1")
+			})
+		})
+
+		Convey("When the procedure isn't registered, clients should be rejected", func() {
+			_, err := ticket("alice", "ticket1")
+			failure, ok := err.(*AuthFailure)
+			So(ok, ShouldBeTrue)
+			So(failure.Reason, ShouldEqual, ErrAuthenticationFailed)
+			So(failure.Details["reason"], ShouldEqual, AuthenticatorUnavailable)
+
+			Convey("And accepted once it is, without a stale cached failure", func() {
+				register()
+				_, err := ticket("alice", "ticket1")
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+}
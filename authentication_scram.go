@@ -0,0 +1,286 @@
+package turnpike
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Key derivation functions supported by WAMP-SCRAM.
+const (
+	SCRAMArgon2id = "argon2id13"
+	SCRAMPBKDF2   = "pbkdf2"
+)
+
+const (
+	defaultSCRAMArgon2Iterations = 3
+	defaultSCRAMArgon2Memory     = 32 * 1024
+	defaultSCRAMPBKDF2Iterations = 4096
+
+	scramNonceSize = 16
+	scramSaltSize  = 16
+	scramKeySize   = 32
+)
+
+// SCRAMCredential holds what the router needs to know about a principal that
+// authenticates with WAMP-SCRAM. It does not contain the password, nor anything
+// a client could authenticate with; create it with NewSCRAMCredential.
+type SCRAMCredential struct {
+	KDF        string `json:"kdf"`
+	Salt       string `json:"salt"`
+	Iterations int    `json:"iterations"`
+	// Memory is the argon2id memory cost in KiB.
+	Memory    int    `json:"memory,omitempty"`
+	StoredKey string `json:"stored_key"`
+	ServerKey string `json:"server_key"`
+	AuthRole  string `json:"authrole"`
+}
+
+// NewSCRAMCredential derives the stored credential for a password with a
+// random salt and the default cost parameters of the given KDF (SCRAMArgon2id
+// or SCRAMPBKDF2).
+func NewSCRAMCredential(password, kdf, authrole string) (*SCRAMCredential, error) {
+	salt := make([]byte, scramSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cred := &SCRAMCredential{
+		KDF:      kdf,
+		Salt:     base64.StdEncoding.EncodeToString(salt),
+		AuthRole: authrole,
+	}
+	switch kdf {
+	case SCRAMArgon2id:
+		cred.Iterations = defaultSCRAMArgon2Iterations
+		cred.Memory = defaultSCRAMArgon2Memory
+	case SCRAMPBKDF2:
+		cred.Iterations = defaultSCRAMPBKDF2Iterations
+	default:
+		return nil, fmt.Errorf("unsupported kdf: %s", kdf)
+	}
+	saltedPassword, err := scramSaltedPassword(password, cred.KDF, cred.Salt, cred.Iterations, cred.Memory)
+	if err != nil {
+		return nil, err
+	}
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	cred.StoredKey = base64.StdEncoding.EncodeToString(storedKey[:])
+	cred.ServerKey = base64.StdEncoding.EncodeToString(scramHMAC(saltedPassword, "Server Key"))
+	return cred, nil
+}
+
+// SCRAMCredentialLookup looks up the WAMP-SCRAM credential of a principal.
+type SCRAMCredentialLookup interface {
+	LookupSCRAMCredential(authid string) (*SCRAMCredential, error)
+}
+
+// SCRAMCredentials is a static SCRAMCredentialLookup keyed by authid.
+type SCRAMCredentials map[string]SCRAMCredential
+
+func (c SCRAMCredentials) LookupSCRAMCredential(authid string) (*SCRAMCredential, error) {
+	cred, ok := c[authid]
+	if !ok {
+		return nil, fmt.Errorf("no such principal: %s", authid)
+	}
+	return &cred, nil
+}
+
+func scramSaltedPassword(password, kdf, salt string, iterations, memory int) ([]byte, error) {
+	rawSalt, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %v", err)
+	}
+	switch kdf {
+	case SCRAMArgon2id:
+		return argon2.IDKey([]byte(password), rawSalt, uint32(iterations), uint32(memory), 1, scramKeySize), nil
+	case SCRAMPBKDF2:
+		return pbkdf2.Key([]byte(password), rawSalt, iterations, scramKeySize, sha256.New), nil
+	}
+	return nil, fmt.Errorf("unsupported kdf: %s", kdf)
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// scramAuthMessage builds the AuthMessage that both the client proof and the
+// server signature are computed over.
+func scramAuthMessage(authid, clientNonce, nonce, salt string, iterations int) string {
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(authid)
+	// no channel binding: base64 of the GS2 header "n,,"
+	cbind := base64.StdEncoding.EncodeToString([]byte("n,,"))
+	return fmt.Sprintf("n=%s,r=%s,r=%s,s=%s,i=%d,c=%s,r=%s",
+		name, clientNonce, nonce, salt, iterations, cbind, nonce)
+}
+
+func scramNonce() (string, error) {
+	nonce := make([]byte, scramNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
+
+type scramAuthenticator struct {
+	credentials SCRAMCredentialLookup
+	// issued challenges by combined nonce, with the client nonce as data
+	pending pendingChallenges
+}
+
+// NewSCRAMAuthenticator returns a CRAuthenticator for the "wamp-scram"
+// authmethod.
+//
+// The client must send its authid in the HELLO details, and its nonce and
+// channel binding in the HELLO authextra. Channel binding is not supported, so
+// channel_binding must be null. On success the WELCOME details carry the
+// authid and authrole of the principal, and the server signature in
+// authextra.scram_server_signature.
+func NewSCRAMAuthenticator(credentials SCRAMCredentialLookup) CRAuthenticator {
+	return &scramAuthenticator{credentials: credentials}
+}
+
+func (a *scramAuthenticator) Challenge(details map[string]interface{}) (map[string]interface{}, error) {
+	authid, _ := details["authid"].(string)
+	if authid == "" {
+		return nil, fmt.Errorf("no authid given")
+	}
+	authextra, _ := toStringMap(details["authextra"])
+	clientNonce, _ := authextra["nonce"].(string)
+	if clientNonce == "" {
+		return nil, fmt.Errorf("no nonce given in authextra")
+	}
+	if cb := authextra["channel_binding"]; cb != nil {
+		return nil, fmt.Errorf("unsupported channel binding: %v", cb)
+	}
+	cred, err := a.credentials.LookupSCRAMCredential(authid)
+	if err != nil {
+		return nil, err
+	}
+	serverNonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+	nonce := clientNonce + serverNonce
+	a.pending.add(nonce, authid, clientNonce)
+
+	extra := map[string]interface{}{
+		"nonce":           nonce,
+		"salt":            cred.Salt,
+		"kdf":             cred.KDF,
+		"iterations":      cred.Iterations,
+		"channel_binding": nil,
+	}
+	if cred.KDF == SCRAMArgon2id {
+		extra["memory"] = cred.Memory
+	}
+	return extra, nil
+}
+
+func (a *scramAuthenticator) Authenticate(challenge map[string]interface{}, signature string) (map[string]interface{}, error) {
+	return a.AuthenticateExtra(challenge, signature, nil)
+}
+
+func (a *scramAuthenticator) AuthenticateExtra(challenge map[string]interface{}, signature string, extra map[string]interface{}) (map[string]interface{}, error) {
+	nonce, _ := challenge["nonce"].(string)
+	pending, ok := a.pending.take(nonce)
+	if !ok {
+		return nil, fmt.Errorf("unknown or expired challenge")
+	}
+	if n, ok := extra["nonce"].(string); ok && n != nonce {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+	if cb := extra["channel_binding"]; cb != nil {
+		return nil, fmt.Errorf("unsupported channel binding: %v", cb)
+	}
+
+	cred, err := a.credentials.LookupSCRAMCredential(pending.authid)
+	if err != nil {
+		return nil, err
+	}
+	storedKey, err := base64.StdEncoding.DecodeString(cred.StoredKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stored key for %s", pending.authid)
+	}
+	serverKey, err := base64.StdEncoding.DecodeString(cred.ServerKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server key for %s", pending.authid)
+	}
+	proof, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(proof) != sha256.Size {
+		return nil, fmt.Errorf("invalid client proof")
+	}
+
+	authMessage := scramAuthMessage(pending.authid, pending.data, nonce, cred.Salt, cred.Iterations)
+	clientSignature := scramHMAC(storedKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	computed := sha256.Sum256(clientKey)
+	if !hmac.Equal(computed[:], storedKey) {
+		return nil, fmt.Errorf("invalid client proof")
+	}
+	serverSignature := scramHMAC(serverKey, authMessage)
+	return map[string]interface{}{
+		"authid":       pending.authid,
+		"authrole":     cred.AuthRole,
+		"authprovider": "turnpike",
+		"authextra": map[string]interface{}{
+			"scram_server_signature": base64.StdEncoding.EncodeToString(serverSignature),
+		},
+	}, nil
+}
+
+// NewSCRAMAuthExtra returns the HELLO authextra for WAMP-SCRAM, containing a
+// fresh client nonce. Send it with the authid in the HELLO details.
+func NewSCRAMAuthExtra() (map[string]interface{}, error) {
+	nonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"nonce": nonce, "channel_binding": nil}, nil
+}
+
+// NewSCRAMAuthFunc returns an AuthFunc that answers a WAMP-SCRAM challenge
+// with the given password. The HELLO details must contain the authid and the
+// authextra created by NewSCRAMAuthExtra.
+func NewSCRAMAuthFunc(password string) AuthFunc {
+	return func(hello map[string]interface{}, challenge map[string]interface{}) (string, map[string]interface{}, error) {
+		authid, _ := hello["authid"].(string)
+		authextra, _ := toStringMap(hello["authextra"])
+		clientNonce, _ := authextra["nonce"].(string)
+		if authid == "" || clientNonce == "" {
+			return "", nil, fmt.Errorf("HELLO details must contain authid and authextra.nonce")
+		}
+		nonce, _ := challenge["nonce"].(string)
+		if !strings.HasPrefix(nonce, clientNonce) || len(nonce) == len(clientNonce) {
+			return "", nil, fmt.Errorf("invalid nonce in challenge")
+		}
+		kdf, _ := challenge["kdf"].(string)
+		salt, _ := challenge["salt"].(string)
+		iterations, _ := toInt64(challenge["iterations"])
+		memory, _ := toInt64(challenge["memory"])
+		saltedPassword, err := scramSaltedPassword(password, kdf, salt, int(iterations), int(memory))
+		if err != nil {
+			return "", nil, err
+		}
+		clientKey := scramHMAC(saltedPassword, "Client Key")
+		storedKey := sha256.Sum256(clientKey)
+		authMessage := scramAuthMessage(authid, clientNonce, nonce, salt, int(iterations))
+		clientSignature := scramHMAC(storedKey[:], authMessage)
+		proof := make([]byte, len(clientKey))
+		for i := range clientKey {
+			proof[i] = clientKey[i] ^ clientSignature[i]
+		}
+		extra := map[string]interface{}{"nonce": nonce, "channel_binding": nil}
+		return base64.StdEncoding.EncodeToString(proof), extra, nil
+	}
+}
@@ -0,0 +1,69 @@
+package turnpike
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSCRAMAuthenticator(t *testing.T) {
+	for _, kdf := range []string{SCRAMPBKDF2, SCRAMArgon2id} {
+		Convey("Given a realm with a WAMP-SCRAM authenticator using "+kdf, t, func() {
+			cred, err := NewSCRAMCredential("correct horse", kdf, "installer")
+			So(err, ShouldBeNil)
+			realm := Realm{
+				CRAuthenticators: map[string]CRAuthenticator{
+					"wamp-scram": NewSCRAMAuthenticator(SCRAMCredentials{"alice": *cred}),
+				},
+			}
+			authextra, err := NewSCRAMAuthExtra()
+			So(err, ShouldBeNil)
+			hello := map[string]interface{}{
+				"authmethods": []interface{}{"wamp-scram"},
+				"authid":      "alice",
+				"authextra":   authextra,
+			}
+			msg, err := realm.authenticate(hello)
+			So(err, ShouldBeNil)
+			challenge := msg.(*Challenge)
+
+			Convey("The challenge should extend the client nonce", func() {
+				So(challenge.Extra["nonce"], ShouldStartWith, authextra["nonce"])
+				So(challenge.Extra["kdf"], ShouldEqual, kdf)
+			})
+
+			Convey("A client with the right password should be welcomed", func() {
+				signature, extra, err := NewSCRAMAuthFunc("correct horse")(hello, challenge.Extra)
+				So(err, ShouldBeNil)
+				welcome, err := realm.checkResponse(challenge, &Authenticate{Signature: signature, Extra: extra})
+				So(err, ShouldBeNil)
+				So(welcome.Details["authid"], ShouldEqual, "alice")
+				So(welcome.Details["authrole"], ShouldEqual, "installer")
+				So(welcome.Details["authextra"], ShouldContainKey, "scram_server_signature")
+
+				Convey("And the challenge should not be accepted twice", func() {
+					_, err := realm.checkResponse(challenge, &Authenticate{Signature: signature, Extra: extra})
+					So(err, ShouldNotBeNil)
+				})
+			})
+
+			Convey("A client with the wrong password should be rejected", func() {
+				signature, extra, err := NewSCRAMAuthFunc("battery staple")(hello, challenge.Extra)
+				So(err, ShouldBeNil)
+				_, err = realm.checkResponse(challenge, &Authenticate{Signature: signature, Extra: extra})
+				So(err, ShouldNotBeNil)
+			})
+		})
+	}
+
+	Convey("Channel binding should be rejected", t, func() {
+		cred, err := NewSCRAMCredential("pw", SCRAMPBKDF2, "")
+		So(err, ShouldBeNil)
+		auth := NewSCRAMAuthenticator(SCRAMCredentials{"alice": *cred})
+		_, err = auth.Challenge(map[string]interface{}{
+			"authid":    "alice",
+			"authextra": map[string]interface{}{"nonce": "abc", "channel_binding": "tls-unique"},
+		})
+		So(err, ShouldNotBeNil)
+	})
+}
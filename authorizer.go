@@ -1,5 +1,13 @@
 package turnpike
 
+// Actions that can be granted to a session by an Authorizer.
+const (
+	ActionPublish   = "publish"
+	ActionSubscribe = "subscribe"
+	ActionCall      = "call"
+	ActionRegister  = "register"
+)
+
 // Authorizer is the interface implemented by an object that can determine
 // whether a particular request is authorized or not.
 //
@@ -21,3 +29,20 @@ func NewDefaultAuthorizer() Authorizer {
 func (da *defaultAuthorizer) Authorize(session *Session, msg Message) (bool, error) {
 	return true, nil
 }
+
+// messageAction returns the action a message performs and the topic or
+// procedure it performs it on. ok is false for messages that are not subject
+// to URI-based authorization.
+func messageAction(msg Message) (action string, uri URI, ok bool) {
+	switch msg := msg.(type) {
+	case *Publish:
+		return ActionPublish, msg.Topic, true
+	case *Subscribe:
+		return ActionSubscribe, msg.Topic, true
+	case *Call:
+		return ActionCall, msg.Procedure, true
+	case *Register:
+		return ActionRegister, msg.Procedure, true
+	}
+	return "", "", false
+}
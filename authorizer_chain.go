@@ -0,0 +1,159 @@
+package turnpike
+
+import (
+	"fmt"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// AuthorizerMatcher may be implemented by an Authorizer that only has an
+// opinion about some messages. A first-match chain skips links that don't
+// match a message; links that don't implement AuthorizerMatcher match every
+// message.
+type AuthorizerMatcher interface {
+	Matches(session *Session, msg Message) bool
+}
+
+// Matches reports whether the session's role has a permission for the
+// message's URI. Messages that aren't subject to URI-based authorization
+// always match.
+func (a *permissionAuthorizer) Matches(sess *Session, msg Message) bool {
+	_, uri, ok := messageAction(msg)
+	if !ok {
+		return true
+	}
+	return a.permission(sess, uri) != nil
+}
+
+type namedAuthorizer struct {
+	Authorizer
+	name string
+}
+
+// NameAuthorizer gives an Authorizer a name that identifies it in the decision
+// traces logged by authorizer chains.
+func NameAuthorizer(name string, authorizer Authorizer) Authorizer {
+	return &namedAuthorizer{Authorizer: authorizer, name: name}
+}
+
+func (n *namedAuthorizer) Matches(sess *Session, msg Message) bool {
+	if m, ok := n.Authorizer.(AuthorizerMatcher); ok {
+		return m.Matches(sess, msg)
+	}
+	return true
+}
+
+func authorizerName(a Authorizer, index int) string {
+	if n, ok := a.(*namedAuthorizer); ok {
+		return n.name
+	}
+	return fmt.Sprintf("%d:%T", index, a)
+}
+
+func traceDecision(chain string, link string, sess *Session, msg Message, allowed bool, err error) {
+	log.WithFields(logrus.Fields{
+		"chain":        chain,
+		"link":         link,
+		"session_id":   sess.Id,
+		"message_type": msg.MessageType().String(),
+		"allowed":      allowed,
+		"err":          err,
+	}).Debug("authorization decision")
+}
+
+type allOfAuthorizer struct {
+	links []Authorizer
+}
+
+// NewAllOfAuthorizer returns an Authorizer that authorizes a message only if
+// every link authorizes it. The links are consulted in order, and the first
+// link that denies the message or fails decides. A chain without links
+// authorizes nothing.
+func NewAllOfAuthorizer(links ...Authorizer) Authorizer {
+	return &allOfAuthorizer{links: links}
+}
+
+func (a *allOfAuthorizer) Authorize(sess *Session, msg Message) (bool, error) {
+	if len(a.links) == 0 {
+		traceDecision("all-of", "", sess, msg, false, nil)
+		return false, nil
+	}
+	for i, link := range a.links {
+		allowed, err := link.Authorize(sess, msg)
+		if !allowed || err != nil {
+			traceDecision("all-of", authorizerName(link, i), sess, msg, false, err)
+			return false, err
+		}
+	}
+	traceDecision("all-of", "", sess, msg, true, nil)
+	return true, nil
+}
+
+type firstMatchAuthorizer struct {
+	links []Authorizer
+}
+
+// NewFirstMatchAuthorizer returns an Authorizer that lets the first link that
+// matches a message decide (see AuthorizerMatcher). Messages that no link
+// matches are not authorized.
+func NewFirstMatchAuthorizer(links ...Authorizer) Authorizer {
+	return &firstMatchAuthorizer{links: links}
+}
+
+func (a *firstMatchAuthorizer) Authorize(sess *Session, msg Message) (bool, error) {
+	for i, link := range a.links {
+		if m, ok := link.(AuthorizerMatcher); ok && !m.Matches(sess, msg) {
+			continue
+		}
+		allowed, err := link.Authorize(sess, msg)
+		traceDecision("first-match", authorizerName(link, i), sess, msg, allowed, err)
+		return allowed, err
+	}
+	traceDecision("first-match", "", sess, msg, false, nil)
+	return false, nil
+}
+
+func (a *firstMatchAuthorizer) Matches(sess *Session, msg Message) bool {
+	for _, link := range a.links {
+		if m, ok := link.(AuthorizerMatcher); !ok || m.Matches(sess, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+type messageTypeAuthorizer struct {
+	routes   map[MessageType]Authorizer
+	fallback Authorizer
+}
+
+// NewMessageTypeAuthorizer returns an Authorizer that routes each message to
+// the Authorizer registered for its type, e.g. PUBLISH or CALL. Messages of
+// other types go to fallback, which defaults to authorizing everything.
+func NewMessageTypeAuthorizer(routes map[MessageType]Authorizer, fallback Authorizer) Authorizer {
+	if fallback == nil {
+		fallback = NewDefaultAuthorizer()
+	}
+	return &messageTypeAuthorizer{routes: routes, fallback: fallback}
+}
+
+func (a *messageTypeAuthorizer) route(msg Message) Authorizer {
+	if link, ok := a.routes[msg.MessageType()]; ok {
+		return link
+	}
+	return a.fallback
+}
+
+func (a *messageTypeAuthorizer) Authorize(sess *Session, msg Message) (bool, error) {
+	link := a.route(msg)
+	allowed, err := link.Authorize(sess, msg)
+	traceDecision("message-type", authorizerName(link, int(msg.MessageType())), sess, msg, allowed, err)
+	return allowed, err
+}
+
+func (a *messageTypeAuthorizer) Matches(sess *Session, msg Message) bool {
+	if m, ok := a.route(msg).(AuthorizerMatcher); ok {
+		return m.Matches(sess, msg)
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package turnpike
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testAuthorizer struct {
+	allowed bool
+	err     error
+	calls   int
+}
+
+func (a *testAuthorizer) Authorize(sess *Session, msg Message) (bool, error) {
+	a.calls++
+	return a.allowed, a.err
+}
+
+func TestAllOfAuthorizer(t *testing.T) {
+	Convey("Given an all-of chain", t, func() {
+		sess := testSession("alice", "installer")
+		allow := &testAuthorizer{allowed: true}
+
+		Convey("It should authorize a message every link authorizes", func() {
+			ok, err := NewAllOfAuthorizer(allow, allow).Authorize(sess, &Publish{})
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("The first link that denies should decide", func() {
+			deny := &testAuthorizer{}
+			after := &testAuthorizer{allowed: true}
+			ok, err := NewAllOfAuthorizer(allow, deny, after).Authorize(sess, &Publish{})
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+			So(after.calls, ShouldEqual, 0)
+		})
+
+		Convey("A failing link should report its error", func() {
+			fail := &testAuthorizer{allowed: true, err: fmt.Errorf("rate limiter unavailable")}
+			ok, err := NewAllOfAuthorizer(allow, fail).Authorize(sess, &Publish{})
+			So(err, ShouldNotBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("A chain without links should authorize nothing", func() {
+			ok, err := NewAllOfAuthorizer().Authorize(sess, &Publish{})
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestFirstMatchAuthorizer(t *testing.T) {
+	Convey("Given a first-match chain of a permission matrix and a fallback", t, func() {
+		acl, err := NewPermissionAuthorizer(Roles{
+			"installer": {{URI: "site.", Match: MatchPrefix, Allow: []string{ActionSubscribe}}},
+		})
+		So(err, ShouldBeNil)
+		fallback := &testAuthorizer{allowed: true}
+		chain := NewFirstMatchAuthorizer(NameAuthorizer("acl", acl), NameAuthorizer("fallback", fallback))
+		sess := testSession("alice", "installer")
+
+		Convey("The matrix should decide URIs it has permissions for", func() {
+			ok, _ := chain.Authorize(sess, &Subscribe{Topic: "site.a"})
+			So(ok, ShouldBeTrue)
+			ok, _ = chain.Authorize(sess, &Publish{Topic: "site.a"})
+			So(ok, ShouldBeFalse)
+			So(fallback.calls, ShouldEqual, 0)
+		})
+
+		Convey("Other URIs should fall through to the next link", func() {
+			ok, _ := chain.Authorize(sess, &Publish{Topic: "other.topic"})
+			So(ok, ShouldBeTrue)
+			So(fallback.calls, ShouldEqual, 1)
+		})
+
+		Convey("Messages no link matches should be denied", func() {
+			ok, err := NewFirstMatchAuthorizer(acl).Authorize(sess, &Publish{Topic: "other.topic"})
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestMessageTypeAuthorizer(t *testing.T) {
+	Convey("Given authorizers routed by message type", t, func() {
+		publish := &testAuthorizer{}
+		fallback := &testAuthorizer{allowed: true}
+		authorizer := NewMessageTypeAuthorizer(map[MessageType]Authorizer{PUBLISH: publish}, fallback)
+		sess := testSession("alice", "installer")
+
+		Convey("Messages should go to the authorizer for their type", func() {
+			ok, _ := authorizer.Authorize(sess, &Publish{Topic: "a"})
+			So(ok, ShouldBeFalse)
+			ok, _ = authorizer.Authorize(sess, &Call{Procedure: "a"})
+			So(ok, ShouldBeTrue)
+			So(publish.calls, ShouldEqual, 1)
+			So(fallback.calls, ShouldEqual, 1)
+		})
+	})
+}
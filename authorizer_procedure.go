@@ -0,0 +1,198 @@
+package turnpike
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultProcedureAuthorizerTimeout = 5 * time.Second
+)
+
+type authorizationDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+type procedureAuthorizer struct {
+	realm     *Realm
+	procedure string
+	// calleeAuthRole is the authrole that may provide the procedure, besides
+	// the realm's TrustedAuthRole
+	calleeAuthRole string
+	ttl            time.Duration
+	timeout        time.Duration
+
+	cache     map[string]authorizationDecision
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+// NewProcedureAuthorizer returns an Authorizer that delegates decisions to a
+// WAMP procedure registered on the realm, which it calls through the realm's
+// own internal client.
+//
+// The procedure is called for every publish, subscribe, call and register with
+// the positional arguments [session details, uri, action], and must return
+// either a boolean or a dict with a boolean "allow" key. A dict may set "cache"
+// to false to prevent the decision from being cached. Decisions are cached for
+// ttl per session, action and URI; a ttl of 0 disables caching.
+//
+// If the procedure can't be called, or returns anything else, the request is
+// denied with wamp.error.authorization_failed. The realm's own session is never
+// authorized through the procedure. Only internal sessions, which have the
+// realm's TrustedAuthRole, may register the procedure without being authorized
+// by it; see NewRemoteProcedureAuthorizer for a callee that is a client.
+func NewProcedureAuthorizer(realm *Realm, procedure string, ttl time.Duration) Authorizer {
+	return NewRemoteProcedureAuthorizer(realm, procedure, "", ttl)
+}
+
+// NewRemoteProcedureAuthorizer returns an Authorizer like NewProcedureAuthorizer
+// whose procedure may also be registered by clients with calleeAuthRole.
+//
+// The session that registered the procedure with one of these authroles isn't
+// authorized through it, since the invocation would wait for a YIELD that only
+// the request's own receive loop can route. Everyone else, including sessions
+// that try to register the procedure, is authorized through it.
+func NewRemoteProcedureAuthorizer(realm *Realm, procedure, calleeAuthRole string, ttl time.Duration) Authorizer {
+	return &procedureAuthorizer{
+		realm:          realm,
+		procedure:      procedure,
+		calleeAuthRole: calleeAuthRole,
+		ttl:            ttl,
+		timeout:        defaultProcedureAuthorizerTimeout,
+		cache:          make(map[string]authorizationDecision),
+	}
+}
+
+func (a *procedureAuthorizer) Authorize(sess *Session, msg Message) (bool, error) {
+	action, uri, ok := messageAction(msg)
+	if !ok {
+		return true, nil
+	}
+	client := a.realm.localClient
+	if client == nil {
+		return false, fmt.Errorf("realm has not been initialized")
+	}
+	if sess == client.session {
+		return true, nil
+	}
+	if a.mayProvide(sess) {
+		if action == ActionRegister && uri == URI(a.procedure) {
+			// the procedure can't authorize its own registration
+			return true, nil
+		}
+		if a.isCallee(sess) {
+			return true, nil
+		}
+	}
+
+	key := fmt.Sprintf("%d %s %s", sess.Id, action, uri)
+	if allowed, ok := a.cached(key); ok {
+		return allowed, nil
+	}
+
+	details := make(map[string]interface{}, len(sess.Details)+1)
+	for k, v := range sess.Details {
+		details[k] = v
+	}
+	details["session"] = sess.Id
+	options := map[string]interface{}{"timeout": int64(a.timeout / time.Millisecond)}
+	result, err := client.Call(a.procedure, options, []interface{}{details, string(uri), action}, nil)
+	if err != nil {
+		return false, fmt.Errorf("error calling authorizer %s: %v", a.procedure, err)
+	}
+	if len(result.Arguments) == 0 {
+		return false, fmt.Errorf("authorizer %s returned no result", a.procedure)
+	}
+	allowed, cache, err := parseAuthorization(result.Arguments[0])
+	if err != nil {
+		return false, fmt.Errorf("authorizer %s: %v", a.procedure, err)
+	}
+	if cache {
+		a.store(key, allowed)
+	}
+	log.WithFields(logrus.Fields{
+		"session_id": sess.Id,
+		"action":     action,
+		"uri":        uri,
+		"allowed":    allowed,
+		"authorizer": a.procedure,
+	}).Debug("dynamic authorization")
+	return allowed, nil
+}
+
+// mayProvide reports whether sess has an authrole that may register the
+// procedure without being authorized by it.
+func (a *procedureAuthorizer) mayProvide(sess *Session) bool {
+	if sess.AuthRole == "" {
+		return false
+	}
+	return sess.AuthRole == a.realm.TrustedAuthRole || sess.AuthRole == a.calleeAuthRole
+}
+
+// isCallee reports whether sess registered the authorizer procedure.
+func (a *procedureAuthorizer) isCallee(sess *Session) bool {
+	lookup, ok := a.realm.Dealer.(CalleeLookup)
+	if !ok {
+		return false
+	}
+	callee, ok := lookup.Callee(URI(a.procedure))
+	return ok && callee == sess
+}
+
+// parseAuthorization interprets the result of an authorizer procedure.
+func parseAuthorization(result interface{}) (allowed bool, cache bool, err error) {
+	if res, ok := result.(bool); ok {
+		return res, true, nil
+	}
+	res, ok := toStringMap(result)
+	if !ok {
+		return false, false, fmt.Errorf("invalid authorization result: %v", result)
+	}
+	allowed, ok = res["allow"].(bool)
+	if !ok {
+		return false, false, fmt.Errorf("invalid allow value in authorization result: %v", res["allow"])
+	}
+	cache, ok = res["cache"].(bool)
+	if !ok {
+		cache = true
+	}
+	return allowed, cache, nil
+}
+
+func (a *procedureAuthorizer) cached(key string) (bool, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	decision, ok := a.cache[key]
+	if !ok {
+		return false, false
+	}
+	if time.Now().After(decision.expires) {
+		delete(a.cache, key)
+		return false, false
+	}
+	return decision.allowed, true
+}
+
+func (a *procedureAuthorizer) store(key string, allowed bool) {
+	if a.ttl <= 0 {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	// drop expired decisions, e.g. of sessions that have since left
+	if now.Sub(a.lastSweep) > a.ttl {
+		for k, decision := range a.cache {
+			if now.After(decision.expires) {
+				delete(a.cache, k)
+			}
+		}
+		a.lastSweep = now
+	}
+	a.cache[key] = authorizationDecision{allowed: allowed, expires: now.Add(a.ttl)}
+}
@@ -0,0 +1,100 @@
+package turnpike
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProcedureAuthorizer(t *testing.T) {
+	Convey("Given a realm that delegates authorization to a procedure", t, func() {
+		router := NewDefaultRouter().(*defaultRouter)
+		realm := &Realm{}
+		realm.Authorizer = NewProcedureAuthorizer(realm, "turnpike.test.authorize", time.Minute)
+		So(router.RegisterRealm("turnpike.test", realm), ShouldBeNil)
+
+		var calls int32
+		err := realm.localClient.Register("turnpike.test.authorize", func(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+			atomic.AddInt32(&calls, 1)
+			uri := args[1].(string)
+			switch uri {
+			case "allowed.topic":
+				return &CallResult{Args: []interface{}{true}}
+			case "dict.topic":
+				return &CallResult{Args: []interface{}{map[string]interface{}{"allow": true, "cache": false}}}
+			case "broken.topic":
+				return &CallResult{Args: []interface{}{"yes"}}
+			}
+			return &CallResult{Args: []interface{}{false}}
+		}, nil)
+		So(err, ShouldBeNil)
+
+		client := newTestClient(router.getTestPeer())
+		noop := func(args []interface{}, kwargs map[string]interface{}) {}
+
+		Convey("An allowed request should succeed and its decision be cached", func() {
+			So(client.Subscribe("allowed.topic", nil, noop), ShouldBeNil)
+			So(client.Unsubscribe("allowed.topic"), ShouldBeNil)
+			So(client.Subscribe("allowed.topic", nil, noop), ShouldBeNil)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+		})
+
+		Convey("A dict result should be honored, including its cache flag", func() {
+			So(client.Subscribe("dict.topic", nil, noop), ShouldBeNil)
+			So(client.Unsubscribe("dict.topic"), ShouldBeNil)
+			So(client.Subscribe("dict.topic", nil, noop), ShouldBeNil)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+		})
+
+		Convey("A denied request should fail with not_authorized", func() {
+			err := client.Subscribe("denied.topic", nil, noop)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, string(ErrNotAuthorized))
+		})
+
+		Convey("An invalid result should fail with authorization_failed", func() {
+			err := client.Subscribe("broken.topic", nil, noop)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, string(ErrAuthorizationFailed))
+		})
+	})
+
+	Convey("Given a realm that delegates authorization to a remote callee", t, func() {
+		router := NewDefaultRouter().(*defaultRouter)
+		defer router.Close()
+		realm := &Realm{Authenticators: map[string]Authenticator{"test": &testRoleAuthenticator{}}}
+		realm.Authorizer = NewRemoteProcedureAuthorizer(realm, "turnpike.test.authorize", "authorizer", time.Minute)
+		So(router.RegisterRealm(testRealm, realm), ShouldBeNil)
+		noop := func(args []interface{}, kwargs map[string]interface{}) {}
+		authorize := func(args []interface{}, kwargs map[string]interface{}) *CallResult {
+			return &CallResult{Args: []interface{}{args[1] == "allowed.topic"}}
+		}
+
+		Convey("Other sessions should not be able to register the procedure before the callee", func() {
+			client := joinWithRole(router, "mallory", "user")
+			So(client.BasicRegister("turnpike.test.authorize", authorize), ShouldNotBeNil)
+		})
+
+		Convey("Once the callee registered the procedure", func() {
+			callee := joinWithRole(router, "authz", "authorizer")
+			So(callee.BasicRegister("turnpike.test.authorize", authorize), ShouldBeNil)
+
+			Convey("Other sessions should be authorized through the callee", func() {
+				client := joinWithRole(router, "alice", "user")
+				So(client.Subscribe("allowed.topic", nil, noop), ShouldBeNil)
+				So(client.Subscribe("denied.topic", nil, noop), ShouldNotBeNil)
+			})
+
+			Convey("The callee's own requests should not be authorized through itself", func() {
+				So(callee.Subscribe("denied.topic", nil, noop), ShouldBeNil)
+			})
+
+			Convey("Other sessions with the callee's authrole should still be authorized", func() {
+				other := joinWithRole(router, "authz-2", "authorizer")
+				So(other.Subscribe("denied.topic", nil, noop), ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -27,6 +27,8 @@ type defaultBroker struct {
 
 	lastRequestId ID
 
+	deadLetter DeadLetterHandler
+
 	sync.RWMutex
 }
 
@@ -76,15 +78,20 @@ func (br *defaultBroker) Publish(sess *Session, msg *Publish) {
 		excludePublisher = exclude
 	}
 
+	delivered := 0
 	for id, sub := range br.routes[msg.Topic] {
 		// shallow-copy the template
 		event := evtTemplate
 		event.Subscription = id
 		// don't send event to publisher
 		if sub != pub || !excludePublisher {
-			go sub.Send(&event)
+			delivered++
+			go sendEvent(sess, msg, sub, &event, br.deadLetter)
 		}
 	}
+	if delivered == 0 && br.deadLetter != nil {
+		br.deadLetter(sess, msg.Topic, msg.Arguments, msg.ArgumentsKw, DeadLetterNoSubscribers)
+	}
 
 	// only send published message if acknowledge is present and set to true
 	if doPub, _ := msg.Options["acknowledge"].(bool); doPub {
@@ -92,6 +99,31 @@ func (br *defaultBroker) Publish(sess *Session, msg *Publish) {
 	}
 }
 
+// sendEvent delivers a single event, reporting it as a dead letter if the
+// subscriber could not accept it. The handler is passed in since it is read
+// under the broker's lock.
+func sendEvent(sess *Session, msg *Publish, sub Sender, event *Event, deadLetter DeadLetterHandler) {
+	if err := sub.Send(event); err != nil {
+		log.WithFields(logrus.Fields{
+			"session_id":      sess.Id,
+			"subscription_id": event.Subscription,
+			"topic":           msg.Topic,
+			"err":             err,
+		}).Warning("EVENT dropped")
+		if deadLetter != nil {
+			deadLetter(sess, msg.Topic, msg.Arguments, msg.ArgumentsKw, DeadLetterEventDropped)
+		}
+	}
+}
+
+// SetDeadLetterHandler sets the function that is called for publications that
+// matched no subscribers and events that could not be delivered.
+func (br *defaultBroker) SetDeadLetterHandler(handler DeadLetterHandler) {
+	br.Lock()
+	defer br.Unlock()
+	br.deadLetter = handler
+}
+
 // Subscribe subscribes the client to the given topic.
 func (br *defaultBroker) Subscribe(sess *Session, msg *Subscribe) {
 	br.Lock()
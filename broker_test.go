@@ -168,3 +168,35 @@ func TestRemove(t *testing.T) {
 		})
 	})
 }
+
+func TestPublishDeadLetter(t *testing.T) {
+	Convey("Publishing to a topic with a dead-letter handler", t, func() {
+		broker := NewDefaultBroker().(*defaultBroker)
+		var reasons []URI
+		var topics []URI
+		var lock sync.Mutex
+		broker.SetDeadLetterHandler(func(sess *Session, uri URI, args []interface{}, kwargs map[string]interface{}, reason URI) {
+			lock.Lock()
+			defer lock.Unlock()
+			topics = append(topics, uri)
+			reasons = append(reasons, reason)
+		})
+		publisher := &Session{Peer: &TestPeer{}, Id: NewID()}
+		testTopic := URI("turnpike.test.topic")
+
+		Convey("A publication with no subscribers should be reported", func() {
+			broker.Publish(publisher, &Publish{Request: 1, Topic: testTopic, Arguments: []interface{}{"x"}})
+			So(topics, ShouldResemble, []URI{testTopic})
+			So(reasons, ShouldResemble, []URI{DeadLetterNoSubscribers})
+		})
+
+		Convey("A publication with a subscriber should not be reported", func() {
+			broker.Subscribe(&Session{Peer: &TestPeer{}, Id: NewID()}, &Subscribe{Request: 2, Topic: testTopic})
+			broker.Publish(publisher, &Publish{Request: 3, Topic: testTopic})
+			time.Sleep(10 * time.Millisecond)
+			lock.Lock()
+			defer lock.Unlock()
+			So(reasons, ShouldBeEmpty)
+		})
+	})
+}
@@ -3,6 +3,7 @@ package turnpike
 import (
 	"crypto/tls"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -35,12 +36,26 @@ type Client struct {
 	ReceiveTimeout time.Duration
 	// Auth is a map of WAMP authmethods to functions that will handle each auth type
 	Auth map[string]AuthFunc
+	// AuthMethods lists the authmethods offered to the router, in order of
+	// preference. The router uses the first one it supports and for which
+	// the client has credentials, so e.g. []string{"cookie", "ticket"} falls
+	// back to a ticket if the client has no auth cookie. Methods that need no
+	// challenge, such as cookie, tls or anonymous, don't need an Auth
+	// function. Methods in Auth that aren't listed are offered after these.
+	AuthMethods []string
+	// AuthID and AuthExtra are sent in the HELLO details, unless the details
+	// passed to JoinRealm contain them already.
+	AuthID    string
+	AuthExtra map[string]interface{}
 	// ReceiveDone is notified when the client's connection to the router is lost.
 	ReceiveDone  chan bool
 	listeners    map[ID]chan Message
 	events       map[ID]*eventDesc
 	procedures   map[ID]*procedureDesc
 	requestCount uint
+	// routerRoles holds the features of the router's roles, as announced in
+	// its WELCOME
+	routerRoles map[string]map[string]bool
 
 	lock sync.RWMutex
 }
@@ -83,86 +98,134 @@ func (c *Client) SetLogLevel(level logrus.Level) {
 	log.Level = level
 }
 
-// JoinRealm joins a WAMP realm, but does not handle challenge/response authentication.
+// JoinRealm joins a WAMP realm, authenticating with the client's AuthMethods
+// and Auth functions if it has any. If the router aborts the join, the error is
+// an AbortError.
 func (c *Client) JoinRealm(realm string, details map[string]interface{}) (map[string]interface{}, error) {
 	if details == nil {
 		details = map[string]interface{}{}
 	}
 	details["roles"] = clientRoles()
-	if c.Auth != nil && len(c.Auth) > 0 {
-		return c.joinRealmCRA(realm, details)
+	if _, ok := details["authmethods"]; !ok {
+		if authmethods := c.authMethods(); len(authmethods) > 0 {
+			details["authmethods"] = authmethods
+		}
+	}
+	if _, ok := details["authid"]; !ok && c.AuthID != "" {
+		details["authid"] = c.AuthID
+	}
+	if _, ok := details["authextra"]; !ok && c.AuthExtra != nil {
+		details["authextra"] = c.AuthExtra
 	}
 	if err := c.Send(&Hello{Realm: URI(realm), Details: details}); err != nil {
 		c.Peer.Close()
 		return nil, err
 	}
-	if msg, err := GetMessageTimeout(c.Peer, c.ReceiveTimeout); err != nil {
-		c.Peer.Close()
+	msg, err := c.receiveJoin(WELCOME)
+	if err != nil {
 		return nil, err
-	} else if welcome, ok := msg.(*Welcome); !ok {
-		c.Send(abortUnexpectedMsg)
-		c.Peer.Close()
-		return nil, fmt.Errorf(formatUnexpectedMessage(msg, WELCOME))
-	} else {
-		go c.Receive()
-		return welcome.Details, nil
 	}
+	// the router may welcome the client without a challenge, e.g. for the
+	// anonymous, cookie or tls authmethods
+	if challenge, ok := msg.(*Challenge); ok {
+		if err := c.authenticate(details, challenge); err != nil {
+			return nil, err
+		}
+		if msg, err = c.receiveJoin(WELCOME); err != nil {
+			return nil, err
+		}
+		if _, ok := msg.(*Challenge); ok {
+			c.Send(abortUnexpectedMsg)
+			c.Peer.Close()
+			return nil, fmt.Errorf(formatUnexpectedMessage(msg, WELCOME))
+		}
+	}
+	welcome := msg.(*Welcome)
+	c.lock.Lock()
+	c.routerRoles = parseRouterRoles(welcome.Details)
+	c.lock.Unlock()
+	go c.Receive()
+	return welcome.Details, nil
 }
 
-// AuthFunc takes the HELLO details and CHALLENGE details and returns the
-// signature string and a details map
-type AuthFunc func(map[string]interface{}, map[string]interface{}) (string, map[string]interface{}, error)
-
-// joinRealmCRA joins a WAMP realm and handles challenge/response authentication.
-func (c *Client) joinRealmCRA(realm string, details map[string]interface{}) (map[string]interface{}, error) {
+// authMethods returns the authmethods to announce in the HELLO details: the
+// AuthMethods, followed by those of the Auth functions that aren't among them.
+func (c *Client) authMethods() []interface{} {
 	authmethods := []interface{}{}
+	listed := make(map[string]bool)
+	for _, m := range c.AuthMethods {
+		if !listed[m] {
+			authmethods = append(authmethods, m)
+			listed[m] = true
+		}
+	}
+	extra := []string{}
 	for m := range c.Auth {
+		if !listed[m] {
+			extra = append(extra, m)
+		}
+	}
+	sort.Strings(extra)
+	for _, m := range extra {
 		authmethods = append(authmethods, m)
 	}
-	details["authmethods"] = authmethods
-	if err := c.Send(&Hello{Realm: URI(realm), Details: details}); err != nil {
+	return authmethods
+}
+
+// receiveJoin waits for a WELCOME or CHALLENGE message during the opening
+// handshake.
+func (c *Client) receiveJoin(expected MessageType) (Message, error) {
+	msg, err := GetMessageTimeout(c.Peer, c.ReceiveTimeout)
+	if err != nil {
 		c.Peer.Close()
 		return nil, err
 	}
-	if msg, err := GetMessageTimeout(c.Peer, c.ReceiveTimeout); err != nil {
-		c.Peer.Close()
-		return nil, err
-	} else if challenge, ok := msg.(*Challenge); !ok {
-		c.Send(abortUnexpectedMsg)
+	switch msg := msg.(type) {
+	case *Welcome, *Challenge:
+		return msg, nil
+	case *Abort:
 		c.Peer.Close()
-		return nil, fmt.Errorf(formatUnexpectedMessage(msg, CHALLENGE))
-	} else if authFunc, ok := c.Auth[challenge.AuthMethod]; !ok {
+		return nil, AbortError{Reason: msg.Reason, Details: msg.Details}
+	}
+	c.Send(abortUnexpectedMsg)
+	c.Peer.Close()
+	return nil, fmt.Errorf(formatUnexpectedMessage(msg, expected))
+}
+
+// authenticate answers a CHALLENGE with the Auth function of its authmethod.
+func (c *Client) authenticate(details map[string]interface{}, challenge *Challenge) error {
+	authFunc, ok := c.Auth[challenge.AuthMethod]
+	if !ok {
 		c.Send(abortNoAuthHandler)
 		c.Peer.Close()
-		return nil, fmt.Errorf("no auth handler for method: %s", challenge.AuthMethod)
-	} else if signature, authDetails, err := authFunc(details, challenge.Extra); err != nil {
+		return fmt.Errorf("no auth handler for method: %s", challenge.AuthMethod)
+	}
+	signature, authDetails, err := authFunc(details, challenge.Extra)
+	if err != nil {
 		c.Send(abortAuthFailure)
 		c.Peer.Close()
-		return nil, err
-	} else if err := c.Send(&Authenticate{Signature: signature, Extra: authDetails}); err != nil {
-		c.Peer.Close()
-		return nil, err
+		return err
 	}
-	if msg, err := GetMessageTimeout(c.Peer, c.ReceiveTimeout); err != nil {
-		c.Peer.Close()
-		return nil, err
-	} else if welcome, ok := msg.(*Welcome); !ok {
-		c.Send(abortUnexpectedMsg)
+	if err := c.Send(&Authenticate{Signature: signature, Extra: authDetails}); err != nil {
 		c.Peer.Close()
-		return nil, fmt.Errorf(formatUnexpectedMessage(msg, WELCOME))
-	} else {
-		go c.Receive()
-		return welcome.Details, nil
+		return err
 	}
+	return nil
 }
 
-func clientRoles() map[string]map[string]interface{} {
-	return map[string]map[string]interface{}{
-		"publisher":  make(map[string]interface{}),
-		"subscriber": make(map[string]interface{}),
-		"callee":     make(map[string]interface{}),
-		"caller":     make(map[string]interface{}),
-	}
+// AuthFunc takes the HELLO details and CHALLENGE details and returns the
+// signature string and a details map
+type AuthFunc func(map[string]interface{}, map[string]interface{}) (string, map[string]interface{}, error)
+
+// AbortError is returned by JoinRealm when the router aborts the join, e.g.
+// because authentication failed.
+type AbortError struct {
+	Reason  URI
+	Details map[string]interface{}
+}
+
+func (e AbortError) Error() string {
+	return "join aborted: " + string(e.Reason) + formatUnknownMap(e.Details)
 }
 
 func formatUnexpectedMessage(msg Message, expected MessageType) string {
@@ -244,11 +307,30 @@ func (c *Client) Receive() {
 		case *Result:
 			c.notifyListener(msg, msg.Request)
 		case *Error:
+			if msg.Type == YIELD {
+				// the request is an invocation, not one of ours
+				log.WithFields(logrus.Fields{
+					"invocation_id": msg.Request,
+					"error":         msg.Error,
+					"args":          msg.Arguments,
+				}).Warning("result rejected by the router")
+				break
+			}
 			c.notifyListener(msg, msg.Request)
 
+		case *Interrupt:
+			// handlers can't be stopped; their result will be dropped
+			log.WithFields(logrus.Fields{
+				"invocation_id": msg.Request,
+				"reason":        msg.Options["reason"],
+			}).Info("invocation interrupted")
+
 		case *Goodbye:
 			log.Infof("client received Goodbye message")
-			break
+			// reply unless this is the reply to our own GOODBYE
+			if msg.Reason != ErrGoodbyeAndOut {
+				logErr(c.Send(&Goodbye{Reason: ErrGoodbyeAndOut, Details: map[string]interface{}{}}))
+			}
 
 		default:
 			log.WithFields(logrus.Fields{
@@ -364,6 +446,9 @@ func (c *Client) Subscribe(topic string, options map[string]interface{}, fn Even
 	if options == nil {
 		options = make(map[string]interface{})
 	}
+	if err := c.checkSubscribeOptions(options); err != nil {
+		return err
+	}
 	id := NewID()
 	c.registerListener(id)
 	// TODO: figure out where to clean this up
@@ -447,6 +532,9 @@ type MethodHandler func(
 
 // Register registers a MethodHandler procedure with the router.
 func (c *Client) Register(procedure string, fn MethodHandler, options map[string]interface{}) error {
+	if err := c.checkRegisterOptions(options); err != nil {
+		return err
+	}
 	id := NewID()
 	c.registerListener(id)
 	// TODO: figure out where to clean this up
@@ -541,6 +629,9 @@ func (c *Client) Publish(topic string, options map[string]interface{}, args []in
 	if options == nil {
 		options = make(map[string]interface{})
 	}
+	if err := c.checkPublishOptions(options); err != nil {
+		return err
+	}
 	return c.Send(&Publish{
 		Request:     NewID(),
 		Options:     options,
@@ -561,6 +652,9 @@ func (rpc RPCError) Error() string {
 
 // Call calls a procedure given a URI.
 func (c *Client) Call(procedure string, options map[string]interface{}, args []interface{}, kwargs map[string]interface{}) (*Result, error) {
+	if err := c.checkCallOptions(options); err != nil {
+		return nil, err
+	}
 	id := NewID()
 	c.registerListener(id)
 	defer c.unregisterListener(id)
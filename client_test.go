@@ -1,6 +1,7 @@
 package turnpike
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -63,6 +64,60 @@ func TestJoinRealmWithAuth(t *testing.T) {
 	})
 }
 
+type testIdentityAuthenticator struct{}
+
+func (t *testIdentityAuthenticator) Authenticate(details map[string]interface{}) (map[string]interface{}, error) {
+	return map[string]interface{}{"authid": details["authid"], "authextra": details["authextra"]}, nil
+}
+
+func TestJoinRealmWithAuthMethods(t *testing.T) {
+	Convey("Given a realm with several authmethods", t, func() {
+		router := newTestRouter()
+		router.RegisterRealm(URI("turnpike.test.auth"), &Realm{
+			Authenticators: map[string]Authenticator{
+				"tls":      NewTLSAuthenticator(TLSCommonNames(nil)),
+				"identity": &testIdentityAuthenticator{},
+			},
+			CRAuthenticators: map[string]CRAuthenticator{"ticket": NewBasicTicketAuthenticator("ticket1")},
+		})
+		client := NewClient(router.getTestPeer())
+		client.ReceiveTimeout = 100 * time.Millisecond
+
+		Convey("A client should fall back to the next method it has credentials for", func() {
+			client.AuthMethods = []string{"tls", "ticket"}
+			client.Auth = map[string]AuthFunc{"ticket": NewTicketAuthFunc("ticket1")}
+			_, err := client.JoinRealm("turnpike.test.auth", nil)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("A client should be welcomed without a challenge if the method needs none", func() {
+			client.AuthMethods = []string{"identity"}
+			client.AuthID = "alice"
+			client.AuthExtra = map[string]interface{}{"device": "d7"}
+			details, err := client.JoinRealm("turnpike.test.auth", nil)
+			So(err, ShouldBeNil)
+			So(details["authid"], ShouldEqual, "alice")
+			So(details["authextra"], ShouldResemble, map[string]interface{}{"device": "d7"})
+		})
+
+		Convey("A rejected client should get an AbortError", func() {
+			client.Auth = map[string]AuthFunc{"ticket": NewTicketAuthFunc("ticket2")}
+			_, err := client.JoinRealm("turnpike.test.auth", nil)
+			var abort AbortError
+			So(errors.As(err, &abort), ShouldBeTrue)
+			So(abort.Reason, ShouldEqual, ErrAuthorizationFailed)
+			So(abort.Details["error"], ShouldEqual, "Invalid ticket")
+		})
+
+		Convey("A client joining an unknown realm should get an AbortError", func() {
+			_, err := client.JoinRealm("turnpike.test.unknown", nil)
+			var abort AbortError
+			So(errors.As(err, &abort), ShouldBeTrue)
+			So(abort.Reason, ShouldEqual, ErrNoSuchRealm)
+		})
+	})
+}
+
 func TestRemoteCall(t *testing.T) {
 	Convey("Given two clients connected to the same server", t, func() {
 		callee, caller := connectedTestClients()
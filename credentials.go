@@ -0,0 +1,418 @@
+package turnpike
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logrus "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/pbkdf2"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	ticketHashScheme     = "pbkdf2-sha256"
+	ticketHashIterations = 10000
+	ticketHashSaltSize   = 16
+	ticketHashSize       = 32
+
+	fileCredentialPollInterval = 5 * time.Second
+)
+
+// Credential is what a CredentialStore knows about a principal.
+type Credential struct {
+	// AuthRole is the role the principal is assigned once authenticated.
+	AuthRole string `json:"authrole" yaml:"authrole"`
+	// Ticket is the hash of the principal's ticket, as created by HashTicket.
+	Ticket string `json:"ticket,omitempty" yaml:"ticket,omitempty"`
+	// Secret is the principal's WAMP-CRA secret. Store a salted secret (see
+	// DeriveCRAKey) with its Salt, Iterations and KeyLen rather than a plain
+	// one, so the store doesn't hold anything the client could log in with.
+	Secret     string `json:"secret,omitempty" yaml:"secret,omitempty"`
+	Salt       string `json:"salt,omitempty" yaml:"salt,omitempty"`
+	Iterations int    `json:"iterations,omitempty" yaml:"iterations,omitempty"`
+	KeyLen     int    `json:"keylen,omitempty" yaml:"keylen,omitempty"`
+	// Disabled principals can't authenticate with any method.
+	Disabled bool `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+}
+
+// CredentialStore looks up the credentials of principals. Authenticators
+// backed by a store consult it on every authentication attempt, so changes to
+// the store apply to the next session.
+//
+// LookupCredential returns an error if authid is unknown.
+type CredentialStore interface {
+	LookupCredential(authid string) (*Credential, error)
+}
+
+// HashTicket hashes a ticket for use as Credential.Ticket, with PBKDF2-SHA256
+// and a random salt.
+func HashTicket(ticket string) (string, error) {
+	salt := make([]byte, ticketHashSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash := pbkdf2.Key([]byte(ticket), salt, ticketHashIterations, ticketHashSize, sha256.New)
+	return fmt.Sprintf("%s$%d$%s$%s", ticketHashScheme, ticketHashIterations,
+		base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(hash)), nil
+}
+
+// CheckTicket reports whether ticket matches the credential's ticket hash.
+func (c *Credential) CheckTicket(ticket string) bool {
+	parts := strings.Split(c.Ticket, "$")
+	if len(parts) != 4 || parts[0] != ticketHashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+	hash := pbkdf2.Key([]byte(ticket), salt, iterations, len(expected), sha256.New)
+	return hmac.Equal(hash, expected)
+}
+
+// lookupEnabledCredential looks up a credential and fails if it is disabled.
+func lookupEnabledCredential(store CredentialStore, authid string) (*Credential, error) {
+	cred, err := store.LookupCredential(authid)
+	if err != nil {
+		return nil, err
+	}
+	if cred.Disabled {
+		return nil, fmt.Errorf("principal is disabled: %s", authid)
+	}
+	return cred, nil
+}
+
+// revokes reports whether replacing a credential with another one revokes
+// access gained with the old one.
+func (c *Credential) revokes(next *Credential) bool {
+	if c.Disabled {
+		return false
+	}
+	return next == nil || next.Disabled || next.Ticket != c.Ticket || next.Secret != c.Secret ||
+		next.AuthRole != c.AuthRole
+}
+
+// revocationHooks holds the hooks registered with OnRevoke.
+type revocationHooks struct {
+	hooks []func(authid string)
+	lock  sync.Mutex
+}
+
+func (h *revocationHooks) OnRevoke(hook func(authid string)) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.hooks = append(h.hooks, hook)
+}
+
+func (h *revocationHooks) revoke(authids ...string) {
+	h.lock.Lock()
+	hooks := h.hooks
+	h.lock.Unlock()
+	for _, authid := range authids {
+		log.WithField("authid", authid).Info("credentials revoked")
+		for _, hook := range hooks {
+			hook(authid)
+		}
+	}
+}
+
+// MemoryCredentialStore is a CredentialStore that keeps credentials in memory.
+// It is safe for concurrent use.
+//
+// Removing a principal, or disabling or changing its credential, revokes the
+// sessions that authenticated with the old credential (see
+// RevocationNotifier).
+type MemoryCredentialStore struct {
+	revocationHooks
+	credentials map[string]Credential
+	lock        sync.RWMutex
+}
+
+// NewMemoryCredentialStore returns a MemoryCredentialStore holding a copy of
+// the given credentials, keyed by authid.
+func NewMemoryCredentialStore(credentials map[string]Credential) *MemoryCredentialStore {
+	s := &MemoryCredentialStore{credentials: make(map[string]Credential, len(credentials))}
+	for authid, cred := range credentials {
+		s.credentials[authid] = cred
+	}
+	return s
+}
+
+// Set adds or replaces the credential of a principal.
+func (s *MemoryCredentialStore) Set(authid string, cred Credential) {
+	s.lock.Lock()
+	old, ok := s.credentials[authid]
+	s.credentials[authid] = cred
+	s.lock.Unlock()
+	if ok && old.revokes(&cred) {
+		s.revoke(authid)
+	}
+}
+
+// Remove removes a principal.
+func (s *MemoryCredentialStore) Remove(authid string) {
+	s.lock.Lock()
+	old, ok := s.credentials[authid]
+	delete(s.credentials, authid)
+	s.lock.Unlock()
+	if ok && old.revokes(nil) {
+		s.revoke(authid)
+	}
+}
+
+func (s *MemoryCredentialStore) LookupCredential(authid string) (*Credential, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	cred, ok := s.credentials[authid]
+	if !ok {
+		return nil, fmt.Errorf("no such principal: %s", authid)
+	}
+	return &cred, nil
+}
+
+type credentialFile struct {
+	Principals map[string]Credential `json:"principals" yaml:"principals"`
+}
+
+type fileCredentialStore struct {
+	revocationHooks
+	path    string
+	modTime time.Time
+	size    int64
+	store   *MemoryCredentialStore
+	ticker  *time.Ticker
+	stop    chan struct{}
+	lock    sync.Mutex
+}
+
+// NewFileCredentialStore returns a CredentialStore that reads credentials from
+// a JSON or YAML file. Files with a .yaml or .yml extension are parsed as
+// YAML, anything else as JSON. The file has a single "principals" key:
+//
+//	{"principals": {"installer-7": {"authrole": "installer", "ticket": "pbkdf2-sha256$...", "disabled": false}}}
+//
+// The file is reloaded when its modification time or size changes, so
+// principals can be added, changed or disabled without restarting the router.
+// If the changed file can't be read, the previous credentials stay in effect.
+//
+// Once a revocation hook is registered (see RevocationNotifier), the file is
+// also checked for changes every few seconds, so that sessions of principals
+// that were removed, disabled or changed are revoked promptly, and lookups use
+// the credentials read by the last check instead of checking the file
+// themselves. The returned store implements io.Closer; Close stops the checks.
+func NewFileCredentialStore(path string) (CredentialStore, error) {
+	s := &fileCredentialStore{path: path}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileCredentialStore) OnRevoke(hook func(authid string)) {
+	s.revocationHooks.OnRevoke(hook)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ticker == nil {
+		s.ticker = time.NewTicker(fileCredentialPollInterval)
+		s.stop = make(chan struct{})
+		go s.poll(s.ticker, s.stop)
+	}
+}
+
+func (s *fileCredentialStore) poll(ticker *time.Ticker, stop chan struct{}) {
+	for {
+		select {
+		case <-ticker.C:
+			s.reloadAndRevoke()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close stops checking the file for changes. Later lookups check the file
+// themselves again.
+func (s *fileCredentialStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ticker != nil {
+		s.ticker.Stop()
+		close(s.stop)
+		s.ticker, s.stop = nil, nil
+	}
+	return nil
+}
+
+// reloadAndRevoke reloads the file, notifies the revocation hooks of the
+// changes, and returns the current credentials.
+func (s *fileCredentialStore) reloadAndRevoke() *MemoryCredentialStore {
+	s.lock.Lock()
+	revoked, err := s.reload()
+	store := s.store
+	s.lock.Unlock()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"path":  s.path,
+			"error": err,
+		}).Error("error reloading credentials")
+	}
+	s.revoke(revoked...)
+	return store
+}
+
+// reload reads the file if it changed since it was last read, and returns the
+// authids whose credentials were revoked by the change.
+func (s *fileCredentialStore) reload() ([]string, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if s.store != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var f credentialFile
+	switch strings.ToLower(filepath.Ext(s.path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &f)
+	default:
+		err = json.Unmarshal(b, &f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing credentials file %s: %v", s.path, err)
+	}
+	var revoked []string
+	if s.store != nil {
+		for authid, old := range s.store.credentials {
+			var next *Credential
+			if cred, ok := f.Principals[authid]; ok {
+				next = &cred
+			}
+			if old.revokes(next) {
+				revoked = append(revoked, authid)
+			}
+		}
+	}
+	s.store = NewMemoryCredentialStore(f.Principals)
+	s.modTime, s.size = info.ModTime(), info.Size()
+	log.WithFields(logrus.Fields{
+		"path":       s.path,
+		"principals": len(f.Principals),
+	}).Info("loaded credentials")
+	return revoked, nil
+}
+
+func (s *fileCredentialStore) LookupCredential(authid string) (*Credential, error) {
+	s.lock.Lock()
+	store, polling := s.store, s.ticker != nil
+	s.lock.Unlock()
+	if !polling {
+		store = s.reloadAndRevoke()
+	}
+	return store.LookupCredential(authid)
+}
+
+type storeTicketAuthenticator struct {
+	store CredentialStore
+}
+
+// NewTicketAuthenticator returns a CRAuthenticator for the "ticket" authmethod
+// that checks tickets against the hashed tickets of a CredentialStore.
+//
+// The client must send its authid in the HELLO details. On success the WELCOME
+// details carry the authid and authrole of the principal.
+func NewTicketAuthenticator(store CredentialStore) CRAuthenticator {
+	return &storeTicketAuthenticator{store: store}
+}
+
+func (a *storeTicketAuthenticator) Challenge(details map[string]interface{}) (map[string]interface{}, error) {
+	authid, _ := details["authid"].(string)
+	if authid == "" {
+		return nil, fmt.Errorf("no authid given")
+	}
+	if _, err := lookupEnabledCredential(a.store, authid); err != nil {
+		return nil, err
+	}
+	// the challenge stays with the router, so the client can't swap the authid
+	return map[string]interface{}{"authid": authid}, nil
+}
+
+func (a *storeTicketAuthenticator) Authenticate(challenge map[string]interface{}, signature string) (map[string]interface{}, error) {
+	authid, _ := challenge["authid"].(string)
+	cred, err := lookupEnabledCredential(a.store, authid)
+	if err != nil {
+		return nil, err
+	}
+	if !cred.CheckTicket(signature) {
+		return nil, fmt.Errorf("invalid ticket")
+	}
+	return map[string]interface{}{
+		"authid":       authid,
+		"authrole":     cred.AuthRole,
+		"authprovider": "turnpike",
+	}, nil
+}
+
+// OnRevoke registers a revocation hook with the store, if it supports them.
+func (a *storeTicketAuthenticator) OnRevoke(hook func(authid string)) {
+	if n, ok := a.store.(RevocationNotifier); ok {
+		n.OnRevoke(hook)
+	}
+}
+
+type storeCRACredentials struct {
+	store CredentialStore
+}
+
+// OnRevoke registers a revocation hook with the store, if it supports them.
+func (s *storeCRACredentials) OnRevoke(hook func(authid string)) {
+	if n, ok := s.store.(RevocationNotifier); ok {
+		n.OnRevoke(hook)
+	}
+}
+
+// NewStoreCRACredentials returns a CRACredentialLookup backed by a
+// CredentialStore, for use with NewCRAAuthenticator. Disabled principals and
+// principals without a secret can't authenticate.
+func NewStoreCRACredentials(store CredentialStore) CRACredentialLookup {
+	return &storeCRACredentials{store: store}
+}
+
+func (s *storeCRACredentials) LookupCRACredential(authid string) (*CRACredential, error) {
+	cred, err := lookupEnabledCredential(s.store, authid)
+	if err != nil {
+		return nil, err
+	}
+	if cred.Secret == "" {
+		return nil, fmt.Errorf("principal has no WAMP-CRA secret: %s", authid)
+	}
+	return &CRACredential{
+		Secret:     cred.Secret,
+		Salt:       cred.Salt,
+		Iterations: cred.Iterations,
+		KeyLen:     cred.KeyLen,
+		AuthRole:   cred.AuthRole,
+	}, nil
+}
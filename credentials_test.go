@@ -0,0 +1,193 @@
+package turnpike
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHashTicket(t *testing.T) {
+	Convey("A hashed ticket should only match the original ticket", t, func() {
+		hash, err := HashTicket("ticket1")
+		So(err, ShouldBeNil)
+		So(hash, ShouldNotContainSubstring, "ticket1")
+		cred := &Credential{Ticket: hash}
+		So(cred.CheckTicket("ticket1"), ShouldBeTrue)
+		So(cred.CheckTicket("ticket2"), ShouldBeFalse)
+		So((&Credential{Ticket: "ticket1"}).CheckTicket("ticket1"), ShouldBeFalse)
+	})
+}
+
+func TestTicketAuthenticator(t *testing.T) {
+	Convey("Given a realm with a ticket authenticator backed by a memory store", t, func() {
+		hash, _ := HashTicket("ticket1")
+		store := NewMemoryCredentialStore(map[string]Credential{
+			"alice": {AuthRole: "installer", Ticket: hash},
+		})
+		realm := Realm{
+			CRAuthenticators: map[string]CRAuthenticator{"ticket": NewTicketAuthenticator(store)},
+		}
+		hello := map[string]interface{}{"authmethods": []interface{}{"ticket"}, "authid": "alice"}
+
+		Convey("A client with the right ticket should be welcomed with its identity", func() {
+			msg, err := realm.authenticate(hello)
+			So(err, ShouldBeNil)
+			welcome, err := realm.checkResponse(msg.(*Challenge), &Authenticate{Signature: "ticket1"})
+			So(err, ShouldBeNil)
+			So(welcome.Details["authid"], ShouldEqual, "alice")
+			So(welcome.Details["authrole"], ShouldEqual, "installer")
+		})
+
+		Convey("A client with the wrong ticket should be rejected", func() {
+			msg, err := realm.authenticate(hello)
+			So(err, ShouldBeNil)
+			_, err = realm.checkResponse(msg.(*Challenge), &Authenticate{Signature: "ticket2"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A principal disabled during the handshake should be rejected", func() {
+			msg, err := realm.authenticate(hello)
+			So(err, ShouldBeNil)
+			store.Set("alice", Credential{AuthRole: "installer", Ticket: hash, Disabled: true})
+			_, err = realm.checkResponse(msg.(*Challenge), &Authenticate{Signature: "ticket1"})
+			So(err, ShouldNotBeNil)
+			_, err = realm.authenticate(hello)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestFileCredentialStore(t *testing.T) {
+	Convey("Given a credentials file", t, func() {
+		dir, _ := ioutil.TempDir("", "credentials")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "credentials.yaml")
+		write := func(content string, mtime time.Time) {
+			So(ioutil.WriteFile(path, []byte(content), 0600), ShouldBeNil)
+			So(os.Chtimes(path, mtime, mtime), ShouldBeNil)
+		}
+		secret := DeriveCRAKey("password", "salt123", 100, 16)
+		write(`
+principals:
+  alice:
+    authrole: installer
+    secret: `+secret+`
+    salt: salt123
+    iterations: 100
+    keylen: 16
+`, time.Now().Add(-time.Minute))
+
+		store, err := NewFileCredentialStore(path)
+		So(err, ShouldBeNil)
+		defer store.(io.Closer).Close()
+		realm := Realm{
+			CRAuthenticators: map[string]CRAuthenticator{"wampcra": NewCRAAuthenticator(NewStoreCRACredentials(store))},
+		}
+		hello := map[string]interface{}{"authmethods": []interface{}{"wampcra"}, "authid": "alice"}
+
+		Convey("Its principals should be able to authenticate", func() {
+			msg, err := realm.authenticate(hello)
+			So(err, ShouldBeNil)
+			challenge := msg.(*Challenge)
+			signature, _, _ := NewCRAAuthFunc("password")(hello, challenge.Extra)
+			welcome, err := realm.checkResponse(challenge, &Authenticate{Signature: signature})
+			So(err, ShouldBeNil)
+			So(welcome.Details["authrole"], ShouldEqual, "installer")
+		})
+
+		Convey("A principal disabled in the file should be rejected without a restart", func() {
+			write(`
+principals:
+  alice:
+    authrole: installer
+    secret: `+secret+`
+    disabled: true
+`, time.Now())
+			_, err := realm.authenticate(hello)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A broken file should leave the previous credentials in effect", func() {
+			write("principals: [", time.Now())
+			cred, err := store.LookupCredential("alice")
+			So(err, ShouldBeNil)
+			So(cred.AuthRole, ShouldEqual, "installer")
+		})
+
+		Convey("Lookups should use the last check while the file is polled", func() {
+			store.(RevocationNotifier).OnRevoke(func(string) {})
+			write(`
+principals:
+  alice:
+    authrole: installer
+    disabled: true
+`, time.Now())
+			cred, err := store.LookupCredential("alice")
+			So(err, ShouldBeNil)
+			So(cred.Disabled, ShouldBeFalse)
+
+			Convey("And check the file themselves once the store is closed", func() {
+				So(store.(io.Closer).Close(), ShouldBeNil)
+				cred, err := store.LookupCredential("alice")
+				So(err, ShouldBeNil)
+				So(cred.Disabled, ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestCredentialRevocation(t *testing.T) {
+	Convey("Given a session authenticated with a ticket from a memory store", t, func() {
+		hash, _ := HashTicket("ticket1")
+		store := NewMemoryCredentialStore(map[string]Credential{
+			"alice": {AuthRole: "installer", Ticket: hash},
+		})
+		r := NewDefaultRouter()
+		defer r.Close()
+		r.RegisterRealm(testRealm, &Realm{
+			CRAuthenticators: map[string]CRAuthenticator{"ticket": NewTicketAuthenticator(store)},
+		})
+		c, server := localPipe()
+		client := &basicPeer{c}
+		client.Send(&Hello{Realm: testRealm, Details: map[string]interface{}{
+			"authmethods": []interface{}{"ticket"},
+			"authid":      "alice",
+		}})
+		client.Send(&Authenticate{Signature: "ticket1"})
+		So(r.Accept(server), ShouldBeNil)
+		So((<-client.incoming).MessageType(), ShouldEqual, CHALLENGE)
+		So((<-client.incoming).MessageType(), ShouldEqual, WELCOME)
+
+		Convey("Setting the same credentials again should not end the session", func() {
+			store.Set("alice", Credential{AuthRole: "installer", Ticket: hash})
+			select {
+			case msg := <-client.incoming:
+				t.Fatalf("unexpected message %v", msg)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+
+		for name, cred := range map[string]Credential{
+			"Disabling the principal":       {AuthRole: "installer", Ticket: hash, Disabled: true},
+			"Changing the principal's role": {AuthRole: "admin", Ticket: hash},
+		} {
+			cred := cred
+			Convey(name+" should kill the session", func() {
+				store.Set("alice", cred)
+				select {
+				case msg := <-client.incoming:
+					goodbye, ok := msg.(*Goodbye)
+					So(ok, ShouldBeTrue)
+					So(goodbye.Reason, ShouldEqual, ErrAuthRevoked)
+				case <-time.After(time.Second):
+					t.Fatal("session was not killed")
+				}
+			})
+		}
+	})
+}
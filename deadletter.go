@@ -0,0 +1,50 @@
+package turnpike
+
+import (
+	"strings"
+)
+
+const (
+	// A publication matched no subscribers.
+	DeadLetterNoSubscribers = URI("turnpike.dead_letter.no_subscribers")
+
+	// An event could not be delivered to a subscriber, e.g. because the
+	// subscriber was too slow to accept it and the send timed out.
+	DeadLetterEventDropped = URI("turnpike.dead_letter.event_dropped")
+)
+
+// DeadLetterHandler is called for every message that could not be delivered.
+//
+// sess is the session that sent the original PUBLISH or CALL, uri is its topic
+// or procedure, and reason describes why the message was not delivered.
+type DeadLetterHandler func(sess *Session, uri URI, args []interface{}, kwargs map[string]interface{}, reason URI)
+
+// DeadLetterReporter is implemented by Brokers and Dealers that can report
+// undeliverable messages. The realm installs its handler when it is
+// initialized and a DeadLetterTopic is configured.
+type DeadLetterReporter interface {
+	SetDeadLetterHandler(DeadLetterHandler)
+}
+
+// deadLetter publishes a meta event describing an undeliverable message to the
+// realm's dead-letter topic.
+func (r *Realm) deadLetter(sess *Session, uri URI, args []interface{}, kwargs map[string]interface{}, reason URI) {
+	// never dead-letter the dead letters themselves, or the router's own meta events
+	if uri == r.DeadLetterTopic || strings.HasPrefix(string(uri), "wamp.") {
+		return
+	}
+	details := map[string]interface{}{
+		"uri":    uri,
+		"reason": reason,
+	}
+	if sess != nil {
+		details["session"] = sess.Id
+	}
+	if args != nil {
+		details["args"] = args
+	}
+	if kwargs != nil {
+		details["kwargs"] = kwargs
+	}
+	go r.localClient.Publish(string(r.DeadLetterTopic), nil, []interface{}{details}, nil)
+}
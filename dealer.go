@@ -2,6 +2,7 @@ package turnpike
 
 import (
 	"sync"
+	"time"
 
 	logrus "github.com/sirupsen/logrus"
 )
@@ -22,17 +23,74 @@ type Dealer interface {
 	RemoveSession(*Session)
 }
 
+// CalleeLookup is implemented by Dealers that can tell which session registered
+// a procedure.
+type CalleeLookup interface {
+	Callee(procedure URI) (*Session, bool)
+}
+
+// InvocationTracker is implemented by Dealers that can tell whether they sent
+// a callee an invocation it may still answer. Realms abort callees that send a
+// YIELD or ERROR for any other invocation; with other Dealers, such messages
+// are passed on unchecked.
+type InvocationTracker interface {
+	Invoked(callee *Session, invocationID ID) bool
+}
+
+// InvocationLookup is implemented by Dealers that can tell which procedure an
+// invocation they sent a callee, and that it hasn't answered yet, is for.
+// Realms with Schemas use it to validate the results callees YIELD.
+type InvocationLookup interface {
+	InvokedProcedure(callee *Session, invocationID ID) (URI, bool)
+}
+
+// Cancel modes of the "mode" option of a CANCEL.
+const (
+	// The caller gets an ERROR right away; the callee isn't told.
+	CancelModeSkip = "skip"
+	// The callee is interrupted, and its answer is returned to the caller.
+	CancelModeKill = "kill"
+	// The caller gets an ERROR right away and the callee is interrupted.
+	CancelModeKillNoWait = "killnowait"
+)
+
+// CallCanceler is implemented by Dealers that let callers cancel their calls.
+// Realms abort sessions that send a CANCEL if their Dealer doesn't implement
+// it.
+type CallCanceler interface {
+	Cancel(*Session, *Cancel)
+}
+
 type remoteProcedure struct {
 	Endpoint     *Session
 	Procedure    URI
 	Registration ID
+	// DiscloseCaller is set by the "disclose_caller" register option; the
+	// invocations of such procedures identify the caller in their details.
+	DiscloseCaller bool
 }
 
 type rpcRequest struct {
-	caller    *Session
-	requestId ID
+	caller      *Session
+	requestId   ID
+	procedure   URI
+	arguments   []interface{}
+	argumentsKw map[string]interface{}
+	// timer fails the call when the timeout requested by the caller expires
+	timer *time.Timer
+}
+
+// stopTimer stops the call's timeout, if it has one.
+func (r rpcRequest) stopTimer() {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
 }
 
+// interruptedAnswerTimeout is how long a callee may still answer an
+// invocation after it was interrupted.
+const interruptedAnswerTimeout = time.Minute
+
 type defaultDealer struct {
 	// map registration IDs to procedures
 	procedures map[URI]remoteProcedure
@@ -43,12 +101,17 @@ type defaultDealer struct {
 
 	// link the invocation ID to the call ID
 	invocations map[*Session]map[ID]rpcRequest
+	// invocations whose caller stopped waiting, which the callee may still
+	// answer, with the time they were interrupted
+	interrupted map[*Session]map[ID]time.Time
 	// callees map[*Session]map[ID]bool
 
 	// single lock for all invocations; could use RWLock, but in most (all?) cases we want a write lock
 	// TODO: add the lock per session
 	invocationLock sync.Mutex
 
+	deadLetter DeadLetterHandler
+
 	sync.RWMutex
 }
 
@@ -58,9 +121,26 @@ func NewDefaultDealer() Dealer {
 		procedures:    make(map[URI]remoteProcedure),
 		registrations: make(map[ID]URI),
 		invocations:   make(map[*Session]map[ID]rpcRequest),
+		interrupted:   make(map[*Session]map[ID]time.Time),
 	}
 }
 
+// SetDeadLetterHandler sets the function that is called for calls that failed
+// with no_such_procedure or a timeout.
+func (d *defaultDealer) SetDeadLetterHandler(handler DeadLetterHandler) {
+	d.Lock()
+	defer d.Unlock()
+	d.deadLetter = handler
+}
+
+// Callee returns the session that registered a procedure.
+func (d *defaultDealer) Callee(procedure URI) (*Session, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	rproc, ok := d.procedures[procedure]
+	return rproc.Endpoint, ok
+}
+
 func (d *defaultDealer) Register(sess *Session, msg *Register) {
 	d.Lock()
 	defer d.Unlock()
@@ -85,7 +165,8 @@ func (d *defaultDealer) Register(sess *Session, msg *Register) {
 	}
 
 	registrationId := NewID()
-	d.procedures[msg.Procedure] = remoteProcedure{sess, msg.Procedure, registrationId}
+	discloseCaller, _ := msg.Options["disclose_caller"].(bool)
+	d.procedures[msg.Procedure] = remoteProcedure{sess, msg.Procedure, registrationId, discloseCaller}
 	d.registrations[registrationId] = msg.Procedure
 
 	// d.addCalleeRegistration(sess, reg)
@@ -152,6 +233,9 @@ func (d *defaultDealer) Call(sess *Session, msg *Call) {
 			"message_type": msg.MessageType().String(),
 			"err":          e,
 		}).Debug("CALL: no such procedure")
+		if d.deadLetter != nil {
+			d.deadLetter(sess, msg.Procedure, msg.Arguments, msg.ArgumentsKw, ErrNoSuchProcedure)
+		}
 	} else {
 		// everything checks out, make the invocation request
 		// TODO: make the Request ID specific to the caller
@@ -160,11 +244,26 @@ func (d *defaultDealer) Call(sess *Session, msg *Call) {
 		if d.invocations[rproc.Endpoint] == nil {
 			d.invocations[rproc.Endpoint] = make(map[ID]rpcRequest)
 		}
-		d.invocations[rproc.Endpoint][invocationID] = rpcRequest{sess, msg.Request}
+		call := rpcRequest{sess, msg.Request, msg.Procedure, msg.Arguments, msg.ArgumentsKw, nil}
+		if timeout := callTimeout(msg.Options); timeout > 0 {
+			endpoint := rproc.Endpoint
+			// the timer can't fire before the invocation is stored, since
+			// timeout() waits for the invocation lock
+			call.timer = time.AfterFunc(timeout, func() {
+				d.timeout(endpoint, invocationID)
+			})
+		}
+		d.invocations[rproc.Endpoint][invocationID] = call
+		details := map[string]interface{}{}
+		if rproc.DiscloseCaller {
+			details["caller"] = sess.Id
+			details["caller_authid"] = sess.AuthID
+			details["caller_authrole"] = sess.AuthRole
+		}
 		rproc.Endpoint.Send(&Invocation{
 			Request:      invocationID,
 			Registration: rproc.Registration,
-			Details:      map[string]interface{}{},
+			Details:      details,
 			Arguments:    msg.Arguments,
 			ArgumentsKw:  msg.ArgumentsKw,
 		})
@@ -185,6 +284,10 @@ func (d *defaultDealer) Yield(sess *Session, msg *Yield) {
 	d.invocationLock.Lock()
 	defer d.invocationLock.Unlock()
 
+	if d.answerInterrupted(sess, msg.Request) {
+		log.WithField("request_id", msg.Request).Debug("YIELD: invocation was interrupted")
+		return
+	}
 	if d.invocations[sess] == nil {
 		log.WithField("session_id", sess.Id).Error("YIELD: unknown session")
 		return
@@ -195,6 +298,7 @@ func (d *defaultDealer) Yield(sess *Session, msg *Yield) {
 	} else {
 		// delete old keys
 		delete(d.invocations[sess], msg.Request)
+		call.stopTimer()
 
 		// return the result to the caller
 		go call.caller.Send(&Result{
@@ -215,9 +319,16 @@ func (d *defaultDealer) Yield(sess *Session, msg *Yield) {
 }
 
 func (d *defaultDealer) Error(sess *Session, msg *Error) {
+	d.RLock()
+	defer d.RUnlock()
+
 	d.invocationLock.Lock()
 	defer d.invocationLock.Unlock()
 
+	if d.answerInterrupted(sess, msg.Request) {
+		log.WithField("request_id", msg.Request).Debug("ERROR: invocation was interrupted")
+		return
+	}
 	if d.invocations[sess] == nil {
 		log.WithField("session_id", sess.Id).Error("ERROR: unknown session")
 		return
@@ -229,6 +340,7 @@ func (d *defaultDealer) Error(sess *Session, msg *Error) {
 		}).Error("ERROR: invalid invocation request ID")
 	} else {
 		delete(d.invocations[sess], msg.Request)
+		call.stopTimer()
 
 		// return an error to the caller
 		go call.caller.Peer.Send(&Error{
@@ -243,6 +355,9 @@ func (d *defaultDealer) Error(sess *Session, msg *Error) {
 			"err":        msg.Request,
 			"request_id": call.requestId,
 		}).Error("ERROR: returned to caller")
+		if msg.Error == ErrTimeout && d.deadLetter != nil {
+			d.deadLetter(call.caller, call.procedure, call.arguments, call.argumentsKw, ErrTimeout)
+		}
 	}
 
 	if len(d.invocations[sess]) == 0 {
@@ -250,6 +365,121 @@ func (d *defaultDealer) Error(sess *Session, msg *Error) {
 	}
 }
 
+// timeout fails an invocation that has not been answered within the timeout
+// requested by the caller, and interrupts the callee.
+func (d *defaultDealer) timeout(callee *Session, invocationID ID) {
+	d.RLock()
+	defer d.RUnlock()
+
+	d.invocationLock.Lock()
+	defer d.invocationLock.Unlock()
+
+	call, ok := d.invocations[callee][invocationID]
+	if !ok {
+		// already answered
+		return
+	}
+	delete(d.invocations[callee], invocationID)
+	if len(d.invocations[callee]) == 0 {
+		delete(d.invocations, callee)
+	}
+
+	go call.caller.Peer.Send(&Error{
+		Type:    CALL,
+		Request: call.requestId,
+		Error:   ErrTimeout,
+		Details: make(map[string]interface{}),
+	})
+	d.interrupt(callee, invocationID, ErrTimeout)
+	log.WithFields(logrus.Fields{
+		"session_id":    call.caller.Id,
+		"endpoint_id":   callee.Id,
+		"request_id":    call.requestId,
+		"procedure":     call.procedure,
+		"invocation_id": invocationID,
+	}).Warning("CALL: timed out")
+	if d.deadLetter != nil {
+		d.deadLetter(call.caller, call.procedure, call.arguments, call.argumentsKw, ErrTimeout)
+	}
+}
+
+// Cancel cancels a call of the session. In "skip" mode the caller gets an
+// ERROR right away and the callee isn't told; in "killnowait" mode, the
+// default, the callee is also sent an INTERRUPT. In "kill" mode the callee is
+// sent an INTERRUPT and its answer is returned to the caller as usual. CANCELs
+// for calls that were already answered are ignored.
+func (d *defaultDealer) Cancel(sess *Session, msg *Cancel) {
+	d.RLock()
+	defer d.RUnlock()
+
+	d.invocationLock.Lock()
+	defer d.invocationLock.Unlock()
+
+	callee, invocationID, call, ok := d.pendingCall(sess, msg.Request)
+	if !ok {
+		log.WithFields(logrus.Fields{
+			"session_id": sess.Id,
+			"request_id": msg.Request,
+		}).Debug("CANCEL: no such call")
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"session_id":    sess.Id,
+		"endpoint_id":   callee.Id,
+		"request_id":    msg.Request,
+		"procedure":     call.procedure,
+		"invocation_id": invocationID,
+		"mode":          msg.Options["mode"],
+	}).Info("CANCEL")
+
+	mode, _ := msg.Options["mode"].(string)
+	if mode == CancelModeKill {
+		go callee.Send(&Interrupt{
+			Request: invocationID,
+			Options: map[string]interface{}{"mode": CancelModeKill, "reason": ErrCanceled},
+		})
+		return
+	}
+	delete(d.invocations[callee], invocationID)
+	if len(d.invocations[callee]) == 0 {
+		delete(d.invocations, callee)
+	}
+	call.stopTimer()
+	go sess.Peer.Send(&Error{
+		Type:    CALL,
+		Request: msg.Request,
+		Error:   ErrCanceled,
+		Details: make(map[string]interface{}),
+	})
+	if mode == CancelModeSkip {
+		d.markInterrupted(callee, invocationID)
+	} else {
+		d.interrupt(callee, invocationID, ErrCanceled)
+	}
+}
+
+// pendingCall returns the invocation of a call the caller made that hasn't
+// been answered yet. The caller must hold the invocation lock.
+func (d *defaultDealer) pendingCall(caller *Session, requestID ID) (*Session, ID, rpcRequest, bool) {
+	for callee, calls := range d.invocations {
+		for invocationID, call := range calls {
+			if call.caller == caller && call.requestId == requestID {
+				return callee, invocationID, call, true
+			}
+		}
+	}
+	return nil, 0, rpcRequest{}, false
+}
+
+// callTimeout returns the timeout requested in the options of a CALL, which is
+// given in milliseconds.
+func callTimeout(options map[string]interface{}) time.Duration {
+	if ms, ok := toInt64(options["timeout"]); ok && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return 0
+}
+
 func (d *defaultDealer) RemoveSession(sess *Session) {
 	d.Lock()
 	defer d.Unlock()
@@ -263,4 +493,96 @@ func (d *defaultDealer) RemoveSession(sess *Session) {
 			delete(d.procedures, rproc.Procedure)
 		}
 	}
+
+	d.invocationLock.Lock()
+	defer d.invocationLock.Unlock()
+	// the calls the session was invoked for fail
+	for _, call := range d.invocations[sess] {
+		call.stopTimer()
+		go call.caller.Peer.Send(&Error{
+			Type:    CALL,
+			Request: call.requestId,
+			Error:   ErrCanceled,
+			Details: make(map[string]interface{}),
+		})
+	}
+	delete(d.invocations, sess)
+	delete(d.interrupted, sess)
+	// and the calls it made are interrupted
+	for callee, calls := range d.invocations {
+		for invocationID, call := range calls {
+			if call.caller == sess {
+				call.stopTimer()
+				delete(calls, invocationID)
+				d.interrupt(callee, invocationID, ErrCanceled)
+			}
+		}
+		if len(calls) == 0 {
+			delete(d.invocations, callee)
+		}
+	}
+}
+
+// interrupt tells a callee to stop working on an invocation that nobody waits
+// for anymore. The callee may still answer it for a while; answers that come
+// later are protocol violations. The caller must hold the invocation lock.
+func (d *defaultDealer) interrupt(callee *Session, invocationID ID, reason URI) {
+	d.markInterrupted(callee, invocationID)
+	go callee.Send(&Interrupt{
+		Request: invocationID,
+		Options: map[string]interface{}{"mode": CancelModeKillNoWait, "reason": reason},
+	})
+}
+
+// markInterrupted records that nobody waits for the answer to an invocation
+// anymore, so that the callee may still answer it for a while. The caller
+// must hold the invocation lock.
+func (d *defaultDealer) markInterrupted(callee *Session, invocationID ID) {
+	now := time.Now()
+	interrupted := d.interrupted[callee]
+	if interrupted == nil {
+		interrupted = make(map[ID]time.Time)
+		d.interrupted[callee] = interrupted
+	}
+	for id, at := range interrupted {
+		if now.Sub(at) > interruptedAnswerTimeout {
+			delete(interrupted, id)
+		}
+	}
+	interrupted[invocationID] = now
+}
+
+// answerInterrupted reports whether an answer of a callee is for an invocation
+// that was interrupted, and forgets the invocation. The caller must hold the
+// invocation lock.
+func (d *defaultDealer) answerInterrupted(callee *Session, invocationID ID) bool {
+	if _, ok := d.interrupted[callee][invocationID]; !ok {
+		return false
+	}
+	delete(d.interrupted[callee], invocationID)
+	if len(d.interrupted[callee]) == 0 {
+		delete(d.interrupted, callee)
+	}
+	return true
+}
+
+// Invoked reports whether the dealer sent an invocation to the callee that it
+// hasn't answered yet, or was interrupted recently.
+func (d *defaultDealer) Invoked(callee *Session, invocationID ID) bool {
+	d.invocationLock.Lock()
+	defer d.invocationLock.Unlock()
+	if _, ok := d.invocations[callee][invocationID]; ok {
+		return true
+	}
+	at, ok := d.interrupted[callee][invocationID]
+	return ok && time.Since(at) <= interruptedAnswerTimeout
+}
+
+// InvokedProcedure returns the procedure of an invocation the dealer sent to
+// the callee that it hasn't answered yet.
+func (d *defaultDealer) InvokedProcedure(callee *Session, invocationID ID) (URI, bool) {
+	d.invocationLock.Lock()
+	defer d.invocationLock.Unlock()
+	call, ok := d.invocations[callee][invocationID]
+	return call.procedure, ok
 }
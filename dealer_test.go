@@ -1,6 +1,7 @@
 package turnpike
 
 import (
+	"sync"
 	"testing"
 	"time"
 
@@ -155,3 +156,117 @@ func TestRemovePeer(t *testing.T) {
 		})
 	})
 }
+
+func TestCallDeadLetter(t *testing.T) {
+	Convey("With a dead-letter handler", t, func() {
+		dealer := NewDefaultDealer().(*defaultDealer)
+		var reasons []URI
+		var lock sync.Mutex
+		dealer.SetDeadLetterHandler(func(sess *Session, uri URI, args []interface{}, kwargs map[string]interface{}, reason URI) {
+			lock.Lock()
+			defer lock.Unlock()
+			reasons = append(reasons, reason)
+		})
+		caller := &TestPeer{}
+		callerSession := &Session{Peer: caller}
+
+		Convey("Calling an invalid procedure should be reported", func() {
+			dealer.Call(callerSession, &Call{Request: 124, Procedure: URI("turnpike.test.bad")})
+			So(reasons, ShouldResemble, []URI{ErrNoSuchProcedure})
+		})
+
+		Convey("A call that is not answered within its timeout", func() {
+			callee := &TestPeer{}
+			testProcedure := URI("turnpike.test.endpoint")
+			dealer.Register(&Session{Peer: callee}, &Register{Request: 123, Procedure: testProcedure})
+			options := map[string]interface{}{"timeout": float64(10)}
+			dealer.Call(callerSession, &Call{Request: 125, Procedure: testProcedure, Options: options})
+			time.Sleep(50 * time.Millisecond)
+
+			Convey("The caller should have received a timeout ERROR", func() {
+				err := caller.getReceived().(*Error)
+				So(err.Error, ShouldEqual, ErrTimeout)
+				So(err.Request, ShouldEqual, 125)
+			})
+
+			Convey("The call should be reported", func() {
+				lock.Lock()
+				defer lock.Unlock()
+				So(reasons, ShouldResemble, []URI{ErrTimeout})
+			})
+
+			Convey("The callee should have been interrupted", func() {
+				So(callee.getReceived(), ShouldHaveSameTypeAs, &Interrupt{})
+				So(callee.getReceived().(*Interrupt).Options["reason"], ShouldEqual, ErrTimeout)
+			})
+		})
+
+		Convey("A call that is answered within its timeout", func() {
+			callee := &TestPeer{}
+			calleeSession := &Session{Peer: callee}
+			testProcedure := URI("turnpike.test.endpoint")
+			dealer.Register(calleeSession, &Register{Request: 123, Procedure: testProcedure})
+			options := map[string]interface{}{"timeout": float64(10)}
+			dealer.Call(callerSession, &Call{Request: 126, Procedure: testProcedure, Options: options})
+			invocation := callee.getReceived().(*Invocation)
+			dealer.Yield(calleeSession, &Yield{Request: invocation.Request})
+			time.Sleep(50 * time.Millisecond)
+
+			Convey("Should not time out", func() {
+				So(caller.getReceived(), ShouldHaveSameTypeAs, &Result{})
+				So(callee.getReceived(), ShouldHaveSameTypeAs, &Invocation{})
+				So(reasons, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestCancel(t *testing.T) {
+	Convey("Given a call that the callee hasn't answered yet", t, func() {
+		router := NewDefaultRouter()
+		defer router.Close()
+		router.RegisterRealm(testRealm, &Realm{})
+		callee, caller := joinRaw(router, testRealm), joinRaw(router, testRealm)
+		callee.Send(&Register{Request: 1, Procedure: "com.example.proc", Options: map[string]interface{}{}})
+		<-callee.incoming
+		caller.Send(&Call{Request: 1, Procedure: "com.example.proc", Options: map[string]interface{}{}})
+		invocation := (<-callee.incoming).(*Invocation)
+
+		Convey("Canceling it should fail the call and interrupt the callee", func() {
+			caller.Send(&Cancel{Request: 1, Options: map[string]interface{}{}})
+			So((<-caller.incoming).(*Error).Error, ShouldEqual, ErrCanceled)
+			interrupt := (<-callee.incoming).(*Interrupt)
+			So(interrupt.Request, ShouldEqual, invocation.Request)
+			So(interrupt.Options["mode"], ShouldEqual, CancelModeKillNoWait)
+
+			Convey("And the callee's late answer should be dropped", func() {
+				callee.Send(&Yield{Request: invocation.Request, Options: map[string]interface{}{}})
+				caller.Send(&Subscribe{Request: 2, Topic: "com.example.topic", Options: map[string]interface{}{}})
+				So((<-caller.incoming).MessageType(), ShouldEqual, SUBSCRIBED)
+			})
+		})
+
+		Convey("Skipping it should fail the call without telling the callee", func() {
+			caller.Send(&Cancel{Request: 1, Options: map[string]interface{}{"mode": CancelModeSkip}})
+			So((<-caller.incoming).(*Error).Error, ShouldEqual, ErrCanceled)
+			callee.Send(&Subscribe{Request: 2, Topic: "com.example.topic", Options: map[string]interface{}{}})
+			So((<-callee.incoming).MessageType(), ShouldEqual, SUBSCRIBED)
+		})
+
+		Convey("Killing it should return the callee's answer to the caller", func() {
+			caller.Send(&Cancel{Request: 1, Options: map[string]interface{}{"mode": CancelModeKill}})
+			interrupt := (<-callee.incoming).(*Interrupt)
+			So(interrupt.Options["mode"], ShouldEqual, CancelModeKill)
+			callee.Send(&Error{Type: INVOCATION, Request: invocation.Request, Error: ErrCanceled, Details: map[string]interface{}{}})
+			So((<-caller.incoming).(*Error).Error, ShouldEqual, ErrCanceled)
+		})
+
+		Convey("Canceling it after it was answered should be ignored", func() {
+			callee.Send(&Yield{Request: invocation.Request, Options: map[string]interface{}{}})
+			So((<-caller.incoming).MessageType(), ShouldEqual, RESULT)
+			caller.Send(&Cancel{Request: 1, Options: map[string]interface{}{}})
+			caller.Send(&Subscribe{Request: 2, Topic: "com.example.topic", Options: map[string]interface{}{}})
+			So((<-caller.incoming).MessageType(), ShouldEqual, SUBSCRIBED)
+		})
+	})
+}
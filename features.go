@@ -0,0 +1,193 @@
+package turnpike
+
+import "fmt"
+
+// RouterAgent is the agent announced in the WELCOME details.
+const RouterAgent = "turnpike"
+
+// Advanced profile features, announced per role in the HELLO and WELCOME
+// details.
+const (
+	FeaturePublisherExclusion          = "publisher_exclusion"
+	FeaturePublisherIdentification     = "publisher_identification"
+	FeatureSubscriberBlackwhiteListing = "subscriber_blackwhite_listing"
+	FeaturePatternBasedSubscription    = "pattern_based_subscription"
+	FeaturePatternBasedRegistration    = "pattern_based_registration"
+	FeatureCallerIdentification        = "caller_identification"
+	FeatureCallTimeout                 = "call_timeout"
+	FeatureCallCanceling               = "call_canceling"
+	FeatureProgressiveCallResults      = "progressive_call_results"
+	FeatureSessionMetaAPI              = "session_meta_api"
+	FeatureTestamentMetaAPI            = "testament_meta_api"
+)
+
+// FeatureAnnouncer is implemented by brokers and dealers to announce the
+// advanced profile features they support in the WELCOME details of their realm.
+// Brokers and dealers that don't implement it are announced without features.
+type FeatureAnnouncer interface {
+	Features() map[string]bool
+}
+
+// Features returns the features of the default broker.
+func (br *defaultBroker) Features() map[string]bool {
+	return map[string]bool{FeaturePublisherExclusion: true}
+}
+
+// Features returns the features of the default dealer.
+func (d *defaultDealer) Features() map[string]bool {
+	return map[string]bool{
+		FeatureCallerIdentification: true,
+		FeatureCallTimeout:          true,
+		FeatureCallCanceling:        true,
+	}
+}
+
+// welcomeRoles returns the roles announced in the WELCOME details of the realm,
+// with the features of its broker and dealer.
+func (r *Realm) welcomeRoles() map[string]interface{} {
+	broker := map[string]interface{}{FeatureSessionMetaAPI: true}
+	if a, ok := r.Broker.(FeatureAnnouncer); ok {
+		for f, v := range a.Features() {
+			broker[f] = v
+		}
+	}
+	// the meta procedures are provided by the realm itself
+	dealer := map[string]interface{}{
+		FeatureSessionMetaAPI:   true,
+		FeatureTestamentMetaAPI: true,
+	}
+	if a, ok := r.Dealer.(FeatureAnnouncer); ok {
+		for f, v := range a.Features() {
+			dealer[f] = v
+		}
+	}
+	return map[string]interface{}{
+		"broker": map[string]interface{}{"features": broker},
+		"dealer": map[string]interface{}{"features": dealer},
+	}
+}
+
+func clientRoles() map[string]interface{} {
+	return map[string]interface{}{
+		"publisher": map[string]interface{}{"features": map[string]interface{}{
+			FeaturePublisherExclusion: true,
+		}},
+		"subscriber": map[string]interface{}{"features": map[string]interface{}{}},
+		"callee": map[string]interface{}{"features": map[string]interface{}{
+			FeatureCallerIdentification: true,
+		}},
+		"caller": map[string]interface{}{"features": map[string]interface{}{
+			FeatureCallTimeout: true,
+		}},
+	}
+}
+
+// FeatureNotSupportedError is returned by the methods of a Client that are
+// given an option the router didn't announce support for in its WELCOME.
+type FeatureNotSupportedError struct {
+	Role    string
+	Feature string
+}
+
+func (e FeatureNotSupportedError) Error() string {
+	return fmt.Sprintf("router %s does not support %s", e.Role, e.Feature)
+}
+
+// parseRouterRoles returns the features of each role announced in the WELCOME
+// details, or nil if the router announced no roles.
+func parseRouterRoles(details map[string]interface{}) map[string]map[string]bool {
+	roles, ok := toStringMap(details["roles"])
+	if !ok {
+		return nil
+	}
+	parsed := make(map[string]map[string]bool, len(roles))
+	for role, v := range roles {
+		features := make(map[string]bool)
+		if r, ok := toStringMap(v); ok {
+			if fs, ok := toStringMap(r["features"]); ok {
+				for f, enabled := range fs {
+					features[f], _ = enabled.(bool)
+				}
+			}
+		}
+		parsed[role] = features
+	}
+	return parsed
+}
+
+// RouterSupports reports whether the router announced a feature for one of its
+// roles, "broker" or "dealer", when the client joined. Routers that announced
+// no roles are assumed to support everything.
+func (c *Client) RouterSupports(role, feature string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.routerRoles == nil {
+		return true
+	}
+	return c.routerRoles[role][feature]
+}
+
+func (c *Client) requireFeature(role, feature string) error {
+	if !c.RouterSupports(role, feature) {
+		return FeatureNotSupportedError{Role: role, Feature: feature}
+	}
+	return nil
+}
+
+// checkPublishOptions returns an error if the router doesn't support one of the
+// options of a PUBLISH.
+func (c *Client) checkPublishOptions(options map[string]interface{}) error {
+	if _, ok := options["exclude_me"]; ok {
+		if err := c.requireFeature("broker", FeaturePublisherExclusion); err != nil {
+			return err
+		}
+	}
+	if _, ok := options["disclose_me"]; ok {
+		if err := c.requireFeature("broker", FeaturePublisherIdentification); err != nil {
+			return err
+		}
+	}
+	for _, option := range []string{"exclude", "exclude_authid", "exclude_authrole", "eligible", "eligible_authid", "eligible_authrole"} {
+		if _, ok := options[option]; ok {
+			return c.requireFeature("broker", FeatureSubscriberBlackwhiteListing)
+		}
+	}
+	return nil
+}
+
+// checkSubscribeOptions returns an error if the router doesn't support one of
+// the options of a SUBSCRIBE.
+func (c *Client) checkSubscribeOptions(options map[string]interface{}) error {
+	if isPatternMatch(options) {
+		return c.requireFeature("broker", FeaturePatternBasedSubscription)
+	}
+	return nil
+}
+
+// checkRegisterOptions returns an error if the router doesn't support one of
+// the options of a REGISTER.
+func (c *Client) checkRegisterOptions(options map[string]interface{}) error {
+	if isPatternMatch(options) {
+		if err := c.requireFeature("dealer", FeaturePatternBasedRegistration); err != nil {
+			return err
+		}
+	}
+	if disclose, _ := options["disclose_caller"].(bool); disclose {
+		return c.requireFeature("dealer", FeatureCallerIdentification)
+	}
+	return nil
+}
+
+// checkCallOptions returns an error if the router doesn't support one of the
+// options of a CALL.
+func (c *Client) checkCallOptions(options map[string]interface{}) error {
+	if _, ok := options["timeout"]; ok {
+		if err := c.requireFeature("dealer", FeatureCallTimeout); err != nil {
+			return err
+		}
+	}
+	if progress, _ := options["receive_progress"].(bool); progress {
+		return c.requireFeature("dealer", FeatureProgressiveCallResults)
+	}
+	return nil
+}
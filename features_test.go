@@ -0,0 +1,51 @@
+package turnpike
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFeatureAnnouncement(t *testing.T) {
+	Convey("Given a client joined to a realm with the default broker and dealer", t, func() {
+		router := newTestRouter()
+		defer router.Close()
+		client := NewClient(router.getTestPeer())
+		details, err := client.JoinRealm("turnpike.test", nil)
+		So(err, ShouldBeNil)
+
+		Convey("The WELCOME should announce the agent and the features of each role", func() {
+			So(details["agent"], ShouldEqual, RouterAgent)
+			roles := parseRouterRoles(details)
+			So(roles["broker"][FeaturePublisherExclusion], ShouldBeTrue)
+			So(roles["broker"][FeaturePatternBasedSubscription], ShouldBeFalse)
+			So(roles["dealer"][FeatureCallTimeout], ShouldBeTrue)
+			So(roles["dealer"][FeatureCallCanceling], ShouldBeTrue)
+			So(roles["dealer"][FeatureSessionMetaAPI], ShouldBeTrue)
+		})
+
+		Convey("Pattern-based subscriptions should fail without reaching the router", func() {
+			err := client.Subscribe("com.example.", map[string]interface{}{"match": MatchPrefix}, nil)
+			So(err, ShouldResemble, FeatureNotSupportedError{Role: "broker", Feature: FeaturePatternBasedSubscription})
+		})
+
+		Convey("Calls asking for progressive results should fail", func() {
+			_, err := client.Call(MetaSessionCount, map[string]interface{}{"receive_progress": true}, nil, nil)
+			So(err, ShouldResemble, FeatureNotSupportedError{Role: "dealer", Feature: FeatureProgressiveCallResults})
+		})
+
+		Convey("Supported options should be accepted", func() {
+			_, err := client.Call(MetaSessionCount, map[string]interface{}{"timeout": 1000}, nil, nil)
+			So(err, ShouldBeNil)
+		})
+	})
+
+	Convey("A router that announces no roles should be assumed to support everything", t, func() {
+		client := NewClient(nil)
+		So(client.RouterSupports("broker", FeaturePatternBasedSubscription), ShouldBeTrue)
+		client.routerRoles = parseRouterRoles(map[string]interface{}{
+			"roles": map[string]interface{}{"broker": map[string]interface{}{}},
+		})
+		So(client.RouterSupports("broker", FeaturePatternBasedSubscription), ShouldBeFalse)
+	})
+}
@@ -18,4 +18,5 @@ require (
 	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
 	gopkg.in/beatgammit/turnpike.v2 v2.0.0-20170911161258-573f579df7ee
 	gopkg.in/jcelliott/turnpike.v2 v2.0.0-20210629143239-1dadcad507a3
+	gopkg.in/yaml.v2 v2.4.0
 )
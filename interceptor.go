@@ -5,6 +5,11 @@ package turnpike
 //
 // Intercept takes the session and (a pointer to) the message, and (possibly)
 // modifies the message.
+//
+// Deprecated: an Interceptor only sees inbound messages and can't reject them;
+// use Middleware instead. A realm's Interceptor runs as its first Middleware,
+// after the schemas, and unlike Middleware also sees the messages of the
+// realm's own session.
 type Interceptor interface {
 	Intercept(session *Session, msg *Message)
 }
@@ -20,3 +25,12 @@ func NewDefaultInterceptor() Interceptor {
 
 func (di *defaultInterceptor) Intercept(session *Session, msg *Message) {
 }
+
+// InterceptorMiddleware adapts an Interceptor to a Middleware that intercepts
+// inbound messages.
+func InterceptorMiddleware(i Interceptor) Middleware {
+	return InboundFunc(func(sess *Session, msg Message) (Message, error) {
+		i.Intercept(sess, &msg)
+		return msg, nil
+	})
+}
@@ -0,0 +1,294 @@
+package turnpike
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// ErrAuthenticationLocked is the ABORT reason for clients that are locked out
+// after too many failed authentication attempts.
+const ErrAuthenticationLocked = URI("turnpike.error.authentication_locked")
+
+// Meta procedures registered on realms with an AuthLimiter. Only sessions with
+// one of the realm's LockoutAdminRoles may call them.
+const (
+	// Returns the active lockouts as a list of dicts with the keys kind,
+	// value, until (RFC 3339) and retry_after (seconds).
+	MetaGetLockouts = "turnpike.auth.get_lockouts"
+	// Clears the lockout of [kind, value], or all lockouts if called without
+	// arguments. Returns whether a lockout was cleared.
+	MetaClearLockout = "turnpike.auth.clear_lockout"
+)
+
+// What a lockout applies to.
+const (
+	LockoutRemoteAddr = "remote_addr"
+	LockoutAuthID     = "authid"
+)
+
+const (
+	defaultLockoutMaxFailures = 5
+	defaultLockoutWindow      = 5 * time.Minute
+	defaultLockoutDuration    = time.Minute
+	defaultMaxLockoutDuration = time.Hour
+)
+
+// LockoutPolicy configures when an AuthLimiter locks out clients. Zero values
+// are replaced with the defaults given below.
+type LockoutPolicy struct {
+	// MaxFailures is the number of failed attempts within Window after which a
+	// remote address or authid is locked out; it defaults to 5 in 5 minutes.
+	MaxFailures int
+	Window      time.Duration
+	// Lockout is how long a lockout lasts; it defaults to a minute. Each
+	// further lockout without a successful authentication in between lasts
+	// twice as long as the previous one, up to MaxLockout (an hour).
+	Lockout    time.Duration
+	MaxLockout time.Duration
+	// RetryAfter adds the seconds until the lockout ends to the ABORT details
+	// as "retry_after".
+	RetryAfter bool
+}
+
+// Lockout is an active lockout of a remote address or authid.
+type Lockout struct {
+	Kind  string
+	Value string
+	Until time.Time
+}
+
+type lockoutKey struct {
+	kind  string
+	value string
+}
+
+type lockoutState struct {
+	// failures within the window, oldest first
+	failures []time.Time
+	// consecutive lockouts, for the backoff
+	lockouts int
+	until    time.Time
+}
+
+// AuthLimiter protects a realm against credential guessing by locking out
+// remote addresses and authids after repeated authentication failures. Set it
+// as Realm.AuthLimiter.
+//
+// Note that locking out authids lets anyone who knows an authid keep it locked
+// out; use a policy that allows enough attempts for legitimate clients.
+type AuthLimiter struct {
+	policy LockoutPolicy
+	states map[lockoutKey]*lockoutState
+	lock   sync.Mutex
+}
+
+// NewAuthLimiter returns an AuthLimiter with the given policy.
+func NewAuthLimiter(policy LockoutPolicy) *AuthLimiter {
+	if policy.MaxFailures <= 0 {
+		policy.MaxFailures = defaultLockoutMaxFailures
+	}
+	if policy.Window <= 0 {
+		policy.Window = defaultLockoutWindow
+	}
+	if policy.Lockout <= 0 {
+		policy.Lockout = defaultLockoutDuration
+	}
+	if policy.MaxLockout < policy.Lockout {
+		policy.MaxLockout = defaultMaxLockoutDuration
+		if policy.MaxLockout < policy.Lockout {
+			policy.MaxLockout = policy.Lockout
+		}
+	}
+	return &AuthLimiter{policy: policy, states: make(map[lockoutKey]*lockoutState)}
+}
+
+// keys returns what an authentication attempt is tracked by: the remote host
+// of its transport and the authid it asked for, if known.
+func (l *AuthLimiter) keys(details map[string]interface{}) []lockoutKey {
+	var keys []lockoutKey
+	if t, ok := transportFromDetails(details); ok && t.RemoteAddr != "" {
+		host, _, err := net.SplitHostPort(t.RemoteAddr)
+		if err != nil {
+			host = t.RemoteAddr
+		}
+		keys = append(keys, lockoutKey{LockoutRemoteAddr, host})
+	}
+	if authid, _ := details["authid"].(string); authid != "" {
+		keys = append(keys, lockoutKey{LockoutAuthID, authid})
+	}
+	return keys
+}
+
+// check returns an error if any of the keys is locked out.
+func (l *AuthLimiter) check(keys []lockoutKey) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	var locked *lockoutKey
+	var until time.Time
+	for i, key := range keys {
+		if s, ok := l.states[key]; ok && now.Before(s.until) && s.until.After(until) {
+			locked, until = &keys[i], s.until
+		}
+	}
+	if locked == nil {
+		return nil
+	}
+	failure := &AuthFailure{
+		Reason:  ErrAuthenticationLocked,
+		Message: fmt.Sprintf("too many failed authentication attempts for %s %s", locked.kind, locked.value),
+		Details: map[string]interface{}{},
+	}
+	if l.policy.RetryAfter {
+		failure.Details["retry_after"] = int64(math.Ceil(until.Sub(now).Seconds()))
+	}
+	return failure
+}
+
+// fail records a failed authentication attempt.
+func (l *AuthLimiter) fail(keys []lockoutKey) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	for _, key := range keys {
+		s, ok := l.states[key]
+		if !ok {
+			s = &lockoutState{}
+			l.states[key] = s
+		}
+		s.failures = append(s.failures, now)
+		for len(s.failures) > 0 && now.Sub(s.failures[0]) > l.policy.Window {
+			s.failures = s.failures[1:]
+		}
+		if len(s.failures) < l.policy.MaxFailures {
+			continue
+		}
+		duration := l.policy.Lockout
+		for i := 0; i < s.lockouts && duration < l.policy.MaxLockout; i++ {
+			duration *= 2
+		}
+		if duration > l.policy.MaxLockout {
+			duration = l.policy.MaxLockout
+		}
+		s.lockouts++
+		s.failures = nil
+		s.until = now.Add(duration)
+		log.WithFields(logrus.Fields{
+			"kind":     key.kind,
+			"value":    key.value,
+			"duration": duration,
+		}).Warning("authentication locked out")
+	}
+}
+
+// succeed resets the failures and backoff of the authid a client proved it
+// owns. Anonymous sessions prove nothing, and remote addresses are never
+// reset, since a client with valid credentials could use them to keep
+// guessing those of others from the same address.
+func (l *AuthLimiter) succeed(keys []lockoutKey, welcome map[string]interface{}) {
+	if method, _ := welcome["authmethod"].(string); method == "" || method == "anonymous" {
+		return
+	}
+	authid, _ := welcome["authid"].(string)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, key := range keys {
+		if key.kind == LockoutAuthID && key.value == authid {
+			delete(l.states, key)
+		}
+	}
+}
+
+// sweep drops states that can't affect future attempts anymore.
+func (l *AuthLimiter) sweep(now time.Time) {
+	for key, s := range l.states {
+		quiet := len(s.failures) == 0 || now.Sub(s.failures[len(s.failures)-1]) > l.policy.Window
+		if quiet && now.Sub(s.until) > l.policy.MaxLockout {
+			delete(l.states, key)
+		}
+	}
+}
+
+// Lockouts returns the active lockouts, ordered by kind and value.
+func (l *AuthLimiter) Lockouts() []Lockout {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	lockouts := []Lockout{}
+	for key, s := range l.states {
+		if now.Before(s.until) {
+			lockouts = append(lockouts, Lockout{Kind: key.kind, Value: key.value, Until: s.until})
+		}
+	}
+	sort.Slice(lockouts, func(i, j int) bool {
+		if lockouts[i].Kind != lockouts[j].Kind {
+			return lockouts[i].Kind < lockouts[j].Kind
+		}
+		return lockouts[i].Value < lockouts[j].Value
+	})
+	return lockouts
+}
+
+// Clear lifts the lockout of a remote address or authid and resets its
+// failures. It returns false if it wasn't locked out.
+func (l *AuthLimiter) Clear(kind, value string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	key := lockoutKey{kind, value}
+	s, ok := l.states[key]
+	delete(l.states, key)
+	return ok && time.Now().Before(s.until)
+}
+
+// ClearAll lifts all lockouts and resets all failures.
+func (l *AuthLimiter) ClearAll() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.states = make(map[lockoutKey]*lockoutState)
+}
+
+// isLockoutProcedure reports whether procedure is one of the meta procedures
+// of the AuthLimiter.
+func isLockoutProcedure(procedure URI) bool {
+	return procedure == MetaGetLockouts || procedure == MetaClearLockout
+}
+
+// mayManageLockouts reports whether a session is allowed to call the meta
+// procedures of the AuthLimiter.
+func (r *Realm) mayManageLockouts(sess *Session) bool {
+	return sess.AuthRole != "" && hasAuthRole(r.LockoutAdminRoles)(sess)
+}
+
+func (l *AuthLimiter) getLockouts(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	now := time.Now()
+	lockouts := []interface{}{}
+	for _, lockout := range l.Lockouts() {
+		lockouts = append(lockouts, map[string]interface{}{
+			"kind":        lockout.Kind,
+			"value":       lockout.Value,
+			"until":       lockout.Until.UTC().Format(time.RFC3339),
+			"retry_after": int64(math.Ceil(lockout.Until.Sub(now).Seconds())),
+		})
+	}
+	return &CallResult{Args: []interface{}{lockouts}}
+}
+
+func (l *AuthLimiter) clearLockout(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	if len(args) == 0 {
+		l.ClearAll()
+		return &CallResult{Args: []interface{}{true}}
+	}
+	if len(args) != 2 {
+		return &CallResult{Err: ErrInvalidArgument, Args: []interface{}{"expected [kind, value]"}}
+	}
+	kind, _ := args[0].(string)
+	value, _ := args[1].(string)
+	return &CallResult{Args: []interface{}{l.Clear(kind, value)}}
+}
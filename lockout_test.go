@@ -0,0 +1,134 @@
+package turnpike
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAuthLimiter(t *testing.T) {
+	Convey("Given a realm that locks out clients after two failures", t, func() {
+		router := NewDefaultRouter().(*defaultRouter)
+		defer router.Close()
+		limiter := NewAuthLimiter(LockoutPolicy{MaxFailures: 2, Lockout: time.Minute, RetryAfter: true})
+		realm := &Realm{
+			CRAuthenticators:  map[string]CRAuthenticator{"ticket": NewBasicTicketAuthenticator("ticket1")},
+			Authenticators:    map[string]Authenticator{"test": &testRoleAuthenticator{}},
+			AuthLimiter:       limiter,
+			LockoutAdminRoles: []string{"admin"},
+		}
+		So(router.RegisterRealm(testRealm, realm), ShouldBeNil)
+
+		join := func(addr string, hello map[string]interface{}, auth *Authenticate) []Message {
+			c, server := localPipe()
+			client := &basicPeer{c}
+			client.Send(&Hello{Realm: testRealm, Details: hello})
+			if auth != nil {
+				client.Send(auth)
+			}
+			router.Accept(&testTransportPeer{localPeer: server, transport: &TransportInfo{RemoteAddr: addr}})
+			var msgs []Message
+			for len(client.incoming) > 0 {
+				msgs = append(msgs, <-client.incoming)
+			}
+			return msgs
+		}
+		// attempt authenticates with a shared ticket, which proves no authid
+		attempt := func(addr, authid, ticket string) []Message {
+			hello := map[string]interface{}{"authmethods": []interface{}{"ticket"}, "authid": authid}
+			return join(addr, hello, &Authenticate{Signature: ticket})
+		}
+		// login authenticates as authid
+		login := func(addr, authid string) {
+			msgs := join(addr, map[string]interface{}{"authmethods": []interface{}{"test"}, "authid": authid}, nil)
+			So(msgs[0].MessageType(), ShouldEqual, WELCOME)
+		}
+
+		Convey("A client should be locked out after too many failures", func() {
+			attempt("10.0.0.1:1000", "alice", "wrong")
+			attempt("10.0.0.1:1001", "bob", "wrong")
+			msgs := attempt("10.0.0.1:1002", "carol", "ticket1")
+			So(msgs, ShouldHaveLength, 1)
+			abort := msgs[0].(*Abort)
+			So(abort.Reason, ShouldEqual, ErrAuthenticationLocked)
+			So(abort.Details["retry_after"], ShouldEqual, 60)
+
+			Convey("But other addresses should not", func() {
+				msgs := attempt("10.0.0.2:1000", "carol", "ticket1")
+				So(msgs[len(msgs)-1].MessageType(), ShouldEqual, WELCOME)
+			})
+
+			Convey("And the lockout should be listed and cleared through meta procedures", func() {
+				client := realm.localClient
+				res, err := client.Call(MetaGetLockouts, nil, nil, nil)
+				So(err, ShouldBeNil)
+				lockouts := res.Arguments[0].([]interface{})
+				So(lockouts, ShouldHaveLength, 1)
+				So(lockouts[0].(map[string]interface{})["value"], ShouldEqual, "10.0.0.1")
+
+				res, err = client.Call(MetaClearLockout, nil, []interface{}{LockoutRemoteAddr, "10.0.0.1"}, nil)
+				So(err, ShouldBeNil)
+				So(res.Arguments[0], ShouldEqual, true)
+				So(limiter.Lockouts(), ShouldBeEmpty)
+				msgs := attempt("10.0.0.1:1003", "carol", "ticket1")
+				So(msgs[len(msgs)-1].MessageType(), ShouldEqual, WELCOME)
+			})
+		})
+
+		Convey("An authid should be locked out across addresses", func() {
+			attempt("10.0.0.1:1000", "alice", "wrong")
+			attempt("10.0.0.2:1000", "alice", "wrong")
+			msgs := attempt("10.0.0.3:1000", "alice", "ticket1")
+			So(msgs[0].(*Abort).Reason, ShouldEqual, ErrAuthenticationLocked)
+		})
+
+		Convey("A successful authentication should reset the failures of its authid", func() {
+			attempt("10.0.0.1:1000", "alice", "wrong")
+			login("10.0.0.2:1000", "alice")
+			attempt("10.0.0.3:1000", "alice", "wrong")
+			msgs := attempt("10.0.0.4:1000", "alice", "ticket1")
+			So(msgs[len(msgs)-1].MessageType(), ShouldEqual, WELCOME)
+		})
+
+		Convey("A successful authentication should not reset the failures of its address", func() {
+			attempt("10.0.0.1:1000", "alice", "wrong")
+			login("10.0.0.1:1000", "bob")
+			attempt("10.0.0.1:1000", "carol", "wrong")
+			msgs := attempt("10.0.0.1:1000", "dave", "ticket1")
+			So(msgs[0].(*Abort).Reason, ShouldEqual, ErrAuthenticationLocked)
+		})
+
+		Convey("An authentication that proves no authid should not reset its failures", func() {
+			attempt("10.0.0.1:1000", "alice", "wrong")
+			attempt("10.0.0.2:1000", "alice", "ticket1")
+			attempt("10.0.0.3:1000", "alice", "wrong")
+			msgs := attempt("10.0.0.4:1000", "alice", "ticket1")
+			So(msgs[0].(*Abort).Reason, ShouldEqual, ErrAuthenticationLocked)
+		})
+
+		Convey("Only lockout admins should be able to call the meta procedures", func() {
+			_, err := joinWithRole(router, "user-1", "user").Call(MetaGetLockouts, nil, nil, nil)
+			So(err, ShouldNotBeNil)
+			So(err.(RPCError).ErrorMessage.Error, ShouldEqual, ErrNotAuthorized)
+			_, err = joinWithRole(router, "user-1", "user").Call(MetaClearLockout, nil, nil, nil)
+			So(err.(RPCError).ErrorMessage.Error, ShouldEqual, ErrNotAuthorized)
+
+			_, err = joinWithRole(router, "admin-1", "admin").Call(MetaGetLockouts, nil, nil, nil)
+			So(err, ShouldBeNil)
+		})
+	})
+
+	Convey("Repeated lockouts should back off up to the maximum", t, func() {
+		limiter := NewAuthLimiter(LockoutPolicy{MaxFailures: 1, Lockout: time.Minute, MaxLockout: 3 * time.Minute})
+		keys := []lockoutKey{{LockoutAuthID, "alice"}}
+		for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+			limiter.fail(keys)
+			state := limiter.states[keys[0]]
+			So(state.until.Sub(time.Now()), ShouldAlmostEqual, expected, time.Second)
+			So(limiter.check(keys), ShouldNotBeNil)
+			// let the lockout end
+			state.until = time.Now()
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package turnpike
+
+import (
+	"errors"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// Middleware is a stage of a realm's message pipeline. Every message a session
+// sends to the realm passes through the Inbound method of each stage, after
+// the message was authorized and before it is routed; every message the realm
+// sends to a session passes through Outbound. The realm's own session, which
+// provides the meta API, bypasses the pipeline.
+//
+// A stage passes a message on by returning it, modifies it by returning a
+// changed or different message, and drops it by returning nil. Returning an
+// error rejects the message, which is answered with an ERROR where possible:
+//   - an inbound request, e.g. a CALL or SUBSCRIBE, is answered to the session;
+//   - an inbound YIELD fails the call of the caller, and is answered to the
+//     callee with an ERROR;
+//   - an inbound invocation ERROR fails the call of the caller;
+//   - an outbound INVOCATION fails the call of the caller;
+//   - an outbound RESULT is replaced with an ERROR to the caller.
+//
+// Other rejected messages are dropped. A RejectError sets the ERROR's URI and
+// arguments; other errors are answered with wamp.error.not_authorized.
+type Middleware interface {
+	Inbound(sess *Session, msg Message) (Message, error)
+	Outbound(sess *Session, msg Message) (Message, error)
+}
+
+// InboundFunc is a Middleware that only handles inbound messages and passes
+// outbound messages unchanged.
+type InboundFunc func(sess *Session, msg Message) (Message, error)
+
+func (f InboundFunc) Inbound(sess *Session, msg Message) (Message, error) {
+	return f(sess, msg)
+}
+
+func (f InboundFunc) Outbound(sess *Session, msg Message) (Message, error) {
+	return msg, nil
+}
+
+// OutboundFunc is a Middleware that only handles outbound messages and passes
+// inbound messages unchanged.
+type OutboundFunc func(sess *Session, msg Message) (Message, error)
+
+func (f OutboundFunc) Inbound(sess *Session, msg Message) (Message, error) {
+	return msg, nil
+}
+
+func (f OutboundFunc) Outbound(sess *Session, msg Message) (Message, error) {
+	return f(sess, msg)
+}
+
+// RejectError is returned by a Middleware to reject a message with a specific
+// ERROR.
+type RejectError struct {
+	Reason      URI
+	Arguments   []interface{}
+	ArgumentsKw map[string]interface{}
+}
+
+func (e *RejectError) Error() string {
+	return "message rejected: " + string(e.Reason)
+}
+
+// rejection returns the ERROR that answers a message rejected with err. Its
+// type and request still have to be set.
+func rejection(err error) *Error {
+	var reject *RejectError
+	if errors.As(err, &reject) {
+		return &Error{
+			Error:       reject.Reason,
+			Details:     make(map[string]interface{}),
+			Arguments:   reject.Arguments,
+			ArgumentsKw: reject.ArgumentsKw,
+		}
+	}
+	return &Error{
+		Error:     ErrNotAuthorized,
+		Details:   make(map[string]interface{}),
+		Arguments: []interface{}{err.Error()},
+	}
+}
+
+// inbound runs a message from a session through the realm's middleware, in
+// order. It returns nil if the message was dropped or rejected.
+func (r *Realm) inbound(sess *Session, msg Message) Message {
+	for _, m := range r.middleware {
+		out, err := m.Inbound(sess, msg)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"session_id":   sess.Id,
+				"message_type": msg.MessageType().String(),
+				"err":          err,
+			}).Info("inbound message rejected")
+			r.rejectInbound(sess, msg, err)
+			return nil
+		} else if out == nil {
+			return nil
+		}
+		msg = out
+	}
+	return msg
+}
+
+func (r *Realm) rejectInbound(sess *Session, msg Message, err error) {
+	errMsg := rejection(err)
+	switch msg := msg.(type) {
+	case *Yield:
+		errMsg.Type = INVOCATION
+		errMsg.Request = msg.Request
+		r.Dealer.Error(sess, errMsg)
+		logErr(sess.Send(&Error{
+			Type:        YIELD,
+			Request:     msg.Request,
+			Error:       errMsg.Error,
+			Details:     make(map[string]interface{}),
+			Arguments:   errMsg.Arguments,
+			ArgumentsKw: errMsg.ArgumentsKw,
+		}))
+	case *Error:
+		if msg.Type == INVOCATION {
+			errMsg.Type = INVOCATION
+			errMsg.Request = msg.Request
+			r.Dealer.Error(sess, errMsg)
+		}
+	case *Goodbye, *Cancel:
+	default:
+		if errMsg.Request = requestID(msg); errMsg.Request != 0 {
+			errMsg.Type = msg.MessageType()
+			logErr(sess.Send(errMsg))
+		}
+	}
+}
+
+// outbound runs a message to a session through the realm's middleware, in
+// reverse order, so that the first stage sees inbound messages first and
+// outbound messages last. It returns nil if the message was dropped or
+// rejected.
+func (r *Realm) outbound(sess *Session, peer Peer, msg Message) Message {
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		out, err := r.middleware[i].Outbound(sess, msg)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"session_id":   sess.Id,
+				"message_type": msg.MessageType().String(),
+				"err":          err,
+			}).Info("outbound message rejected")
+			r.rejectOutbound(sess, peer, msg, err)
+			return nil
+		} else if out == nil {
+			return nil
+		}
+		msg = out
+	}
+	return msg
+}
+
+func (r *Realm) rejectOutbound(sess *Session, peer Peer, msg Message, err error) {
+	errMsg := rejection(err)
+	switch msg := msg.(type) {
+	case *Invocation:
+		errMsg.Type = INVOCATION
+		errMsg.Request = msg.Request
+		// the dealer sends invocations while holding its locks
+		go r.Dealer.Error(sess, errMsg)
+	case *Result:
+		errMsg.Type = CALL
+		errMsg.Request = msg.Request
+		logErr(peer.Send(errMsg))
+	}
+}
+
+// middlewarePeer runs the messages sent to a session through the realm's
+// middleware.
+type middlewarePeer struct {
+	Peer
+	realm *Realm
+	sess  *Session
+}
+
+func (p *middlewarePeer) Send(msg Message) error {
+	if msg = p.realm.outbound(p.sess, p.Peer, msg); msg == nil {
+		return nil
+	}
+	return p.Peer.Send(msg)
+}
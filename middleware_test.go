@@ -0,0 +1,109 @@
+package turnpike
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type tagInterceptor struct{}
+
+func (tagInterceptor) Intercept(sess *Session, msg *Message) {
+	if publish, ok := (*msg).(*Publish); ok {
+		if publish.ArgumentsKw == nil {
+			publish.ArgumentsKw = make(map[string]interface{})
+		}
+		publish.ArgumentsKw["intercepted"] = true
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	Convey("Given a realm with a middleware pipeline", t, func() {
+		router := NewDefaultRouter().(*defaultRouter)
+		defer router.Close()
+		realm := &Realm{
+			Interceptor: tagInterceptor{},
+			Middleware: []Middleware{
+				// tag publications with the publisher's realm
+				InboundFunc(func(sess *Session, msg Message) (Message, error) {
+					if publish, ok := msg.(*Publish); ok {
+						publish.ArgumentsKw["tenant"] = sess.Details["realm"]
+					}
+					if call, ok := msg.(*Call); ok && call.Procedure == "com.example.forbidden" {
+						return nil, &RejectError{Reason: "com.example.error.forbidden"}
+					}
+					return msg, nil
+				}),
+				OutboundFunc(func(sess *Session, msg Message) (Message, error) {
+					if event, ok := msg.(*Event); ok && event.ArgumentsKw["drop"] == true {
+						return nil, nil
+					}
+					if invocation, ok := msg.(*Invocation); ok && len(invocation.Arguments) > 0 && invocation.Arguments[0] == "secret" {
+						return nil, &RejectError{Reason: "com.example.error.scrubbed"}
+					}
+					return msg, nil
+				}),
+			},
+		}
+		router.RegisterRealm(testRealm, realm)
+		join := func() *Client {
+			client := NewClient(router.getTestPeer())
+			client.ReceiveTimeout = time.Second
+			_, err := client.JoinRealm(string(testRealm), nil)
+			So(err, ShouldBeNil)
+			return client
+		}
+		publisher, subscriber := join(), join()
+
+		events := make(chan map[string]interface{}, 2)
+		So(subscriber.Subscribe("com.example.topic", nil, func(args []interface{}, kwargs map[string]interface{}) {
+			events <- kwargs
+		}), ShouldBeNil)
+
+		Convey("Inbound messages should pass the Interceptor and then each stage", func() {
+			So(publisher.Publish("com.example.topic", nil, nil, nil), ShouldBeNil)
+			kwargs := <-events
+			So(kwargs["intercepted"], ShouldEqual, true)
+			So(kwargs["tenant"], ShouldEqual, testRealm)
+		})
+
+		Convey("Messages of the realm's own session should only pass the Interceptor", func() {
+			So(realm.localClient.Publish("com.example.topic", nil, nil, nil), ShouldBeNil)
+			kwargs := <-events
+			So(kwargs["intercepted"], ShouldEqual, true)
+			So(kwargs, ShouldNotContainKey, "tenant")
+		})
+
+		Convey("Dropped outbound messages should not be delivered", func() {
+			So(publisher.Publish("com.example.topic", nil, nil, map[string]interface{}{"drop": true}), ShouldBeNil)
+			delivered := false
+			select {
+			case <-events:
+				delivered = true
+			case <-time.After(50 * time.Millisecond):
+			}
+			So(delivered, ShouldBeFalse)
+		})
+
+		Convey("Rejected inbound requests should be answered with an ERROR", func() {
+			_, err := publisher.Call("com.example.forbidden", nil, nil, nil)
+			So(err, ShouldNotBeNil)
+			So(err.(RPCError).ErrorMessage.Error, ShouldEqual, "com.example.error.forbidden")
+		})
+
+		Convey("Rejected invocations should fail the call", func() {
+			So(subscriber.BasicRegister("com.example.echo", func(args []interface{}, kwargs map[string]interface{}) *CallResult {
+				return &CallResult{Args: args}
+			}), ShouldBeNil)
+
+			res, err := publisher.Call("com.example.echo", nil, []interface{}{"public"}, nil)
+			So(err, ShouldBeNil)
+			So(res.Arguments, ShouldResemble, []interface{}{"public"})
+
+			_, err = publisher.Call("com.example.echo", nil, []interface{}{"secret"}, nil)
+			So(err, ShouldNotBeNil)
+			So(err.(RPCError).ErrorMessage.Error, ShouldEqual, "com.example.error.scrubbed")
+		})
+	})
+}
@@ -0,0 +1,206 @@
+package turnpike
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	logrus "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// URI match policies.
+const (
+	// The URI must equal the pattern.
+	MatchExact = "exact"
+	// The URI must start with the pattern.
+	MatchPrefix = "prefix"
+	// The URI must have the same number of components as the pattern, and each
+	// non-empty component of the pattern must equal the URI's component, e.g.
+	// "com.example..update" matches "com.example.lights.update".
+	MatchWildcard = "wildcard"
+)
+
+// Permission grants a set of actions on all URIs that match a pattern.
+//
+// The pattern may contain the placeholders {authid} and {authrole}, which are
+// replaced with the authid and authrole of the session being authorized.
+type Permission struct {
+	// URI is the pattern to match.
+	URI string `json:"uri" yaml:"uri"`
+	// Match is the match policy of the pattern; it defaults to MatchExact.
+	Match string `json:"match,omitempty" yaml:"match,omitempty"`
+	// Allow lists the actions that are allowed: publish, subscribe, call and register.
+	Allow []string `json:"allow" yaml:"allow"`
+}
+
+// Roles maps an authrole to the permissions granted to sessions with that role.
+type Roles map[string][]Permission
+
+type permissionFile struct {
+	Roles Roles `json:"roles" yaml:"roles"`
+}
+
+type permissionAuthorizer struct {
+	roles Roles
+}
+
+// NewPermissionAuthorizer returns an Authorizer that authorizes sessions by
+// their authrole (Session.AuthRole) according to a permission matrix.
+//
+// When several permissions of a role match a URI, the most specific one
+// decides: exact matches win over prefix matches, which win over wildcard
+// matches. Longer prefixes and wildcards with more fixed components are more
+// specific. Requests by sessions without a known role, or on URIs that match
+// no permission, are not authorized.
+func NewPermissionAuthorizer(roles Roles) (Authorizer, error) {
+	copied := make(Roles, len(roles))
+	for role, perms := range roles {
+		perms = append([]Permission(nil), perms...)
+		copied[role] = perms
+		for i, p := range perms {
+			switch p.Match {
+			case "":
+				perms[i].Match = MatchExact
+			case MatchExact, MatchPrefix, MatchWildcard:
+			default:
+				return nil, fmt.Errorf("role %s: invalid match policy for %s: %s", role, p.URI, p.Match)
+			}
+			for _, action := range p.Allow {
+				switch action {
+				case ActionPublish, ActionSubscribe, ActionCall, ActionRegister:
+				default:
+					return nil, fmt.Errorf("role %s: invalid action for %s: %s", role, p.URI, action)
+				}
+			}
+		}
+	}
+	return &permissionAuthorizer{roles: copied}, nil
+}
+
+// LoadPermissionAuthorizer reads a permission matrix from a JSON or YAML file
+// and returns an Authorizer for it. Files with a .yaml or .yml extension are
+// parsed as YAML, anything else as JSON. The file has a single "roles" key:
+//
+//	{"roles": {"installer": [{"uri": "site.{authid}.", "match": "prefix", "allow": ["call", "subscribe"]}]}}
+func LoadPermissionAuthorizer(path string) (Authorizer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f permissionFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &f)
+	default:
+		err = json.Unmarshal(b, &f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing permissions file %s: %v", path, err)
+	}
+	return NewPermissionAuthorizer(f.Roles)
+}
+
+func (a *permissionAuthorizer) Authorize(sess *Session, msg Message) (bool, error) {
+	action, uri, ok := messageAction(msg)
+	if !ok {
+		return true, nil
+	}
+	authrole := sess.AuthRole
+	perm := a.permission(sess, uri)
+	allowed := false
+	if perm != nil {
+		for _, allow := range perm.Allow {
+			if allow == action {
+				allowed = true
+				break
+			}
+		}
+	}
+	log.WithFields(logrus.Fields{
+		"session_id": sess.Id,
+		"authrole":   authrole,
+		"action":     action,
+		"uri":        uri,
+		"allowed":    allowed,
+	}).Debug("permission check")
+	return allowed, nil
+}
+
+// permission returns the most specific permission of the session's role that
+// matches uri, or nil if there is none.
+func (a *permissionAuthorizer) permission(sess *Session, uri URI) *Permission {
+	authrole, authid := sess.AuthRole, sess.AuthID
+	var best *Permission
+	var bestClass, bestLen int
+	for i, p := range a.roles[authrole] {
+		pattern, ok := expandPattern(p.URI, authid, authrole)
+		if !ok || !matchURI(p.Match, pattern, uri) {
+			continue
+		}
+		class, length := specificity(p.Match, pattern)
+		if best == nil || class > bestClass || (class == bestClass && length > bestLen) {
+			best = &a.roles[authrole][i]
+			bestClass, bestLen = class, length
+		}
+	}
+	return best
+}
+
+// expandPattern substitutes the {authid} and {authrole} placeholders. It fails
+// if the pattern refers to an identity the session doesn't have, or to one that
+// isn't a single URI component and could widen the pattern.
+func expandPattern(pattern, authid, authrole string) (string, bool) {
+	for placeholder, value := range map[string]string{"{authid}": authid, "{authrole}": authrole} {
+		if !strings.Contains(pattern, placeholder) {
+			continue
+		}
+		if value == "" || strings.Contains(value, ".") {
+			return "", false
+		}
+		pattern = strings.Replace(pattern, placeholder, value, -1)
+	}
+	return pattern, true
+}
+
+// matchURI reports whether uri matches pattern under the given match policy.
+func matchURI(policy, pattern string, uri URI) bool {
+	switch policy {
+	case MatchExact, "":
+		return string(uri) == pattern
+	case MatchPrefix:
+		return strings.HasPrefix(string(uri), pattern)
+	case MatchWildcard:
+		patternParts := strings.Split(pattern, ".")
+		uriParts := strings.Split(string(uri), ".")
+		if len(patternParts) != len(uriParts) {
+			return false
+		}
+		for i, part := range patternParts {
+			if part != "" && part != uriParts[i] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// specificity ranks a matching pattern by its match policy and, within a
+// policy, by how much of the URI it fixes.
+func specificity(policy, pattern string) (class int, length int) {
+	switch policy {
+	case MatchPrefix:
+		return 2, len(pattern)
+	case MatchWildcard:
+		for _, part := range strings.Split(pattern, ".") {
+			if part != "" {
+				length++
+			}
+		}
+		return 1, length
+	}
+	return 3, len(pattern)
+}
@@ -0,0 +1,109 @@
+package turnpike
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testSession(authid, authrole string) *Session {
+	return newSession(nil, NewID(), map[string]interface{}{"authid": authid, "authrole": authrole})
+}
+
+func TestPermissionAuthorizer(t *testing.T) {
+	Convey("Given a permission authorizer", t, func() {
+		authorizer, err := NewPermissionAuthorizer(Roles{
+			"installer": {
+				{URI: "site.{authid}.", Match: MatchPrefix, Allow: []string{ActionCall, ActionSubscribe}},
+				{URI: "site.{authid}.config.reset", Allow: []string{}},
+				{URI: "site..status", Match: MatchWildcard, Allow: []string{ActionSubscribe}},
+			},
+			"controller": {
+				{URI: "site.", Match: MatchPrefix, Allow: []string{ActionPublish, ActionRegister}},
+			},
+		})
+		So(err, ShouldBeNil)
+		installer := testSession("alice", "installer")
+
+		Convey("Prefix permissions should substitute the authid", func() {
+			ok, err := authorizer.Authorize(installer, &Call{Procedure: "site.alice.lights.on"})
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			ok, _ = authorizer.Authorize(installer, &Call{Procedure: "site.bob.lights.on"})
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Identities that span several URI components should not be substituted", func() {
+			ok, _ := authorizer.Authorize(testSession("alice.lights", "installer"), &Call{Procedure: "site.alice.lights.on"})
+			So(ok, ShouldBeFalse)
+			ok, _ = authorizer.Authorize(testSession("", "installer"), &Call{Procedure: "site..lights.on"})
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Only the allowed actions should be authorized", func() {
+			ok, _ := authorizer.Authorize(installer, &Register{Procedure: "site.alice.lights.on"})
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("An exact permission should override a prefix permission", func() {
+			ok, _ := authorizer.Authorize(installer, &Call{Procedure: "site.alice.config.reset"})
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Wildcard permissions should match a single component", func() {
+			ok, _ := authorizer.Authorize(installer, &Subscribe{Topic: "site.bob.status"})
+			So(ok, ShouldBeTrue)
+			ok, _ = authorizer.Authorize(installer, &Subscribe{Topic: "site.bob.lights.status"})
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Sessions without a known role should not be authorized", func() {
+			ok, _ := authorizer.Authorize(testSession("mallory", ""), &Publish{Topic: "site.alice.status"})
+			So(ok, ShouldBeFalse)
+			ok, _ = authorizer.Authorize(testSession("mallory", "admin"), &Publish{Topic: "site.alice.status"})
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Messages without a URI action should always be authorized", func() {
+			ok, _ := authorizer.Authorize(testSession("mallory", ""), &Goodbye{})
+			So(ok, ShouldBeTrue)
+		})
+	})
+
+	Convey("The permissions passed in should not be modified", t, func() {
+		roles := Roles{"r": {{URI: "a", Allow: []string{ActionCall}}}}
+		_, err := NewPermissionAuthorizer(roles)
+		So(err, ShouldBeNil)
+		So(roles["r"][0].Match, ShouldBeEmpty)
+	})
+
+	Convey("Invalid permissions should be rejected", t, func() {
+		_, err := NewPermissionAuthorizer(Roles{"r": {{URI: "a", Match: "regex"}}})
+		So(err, ShouldNotBeNil)
+		_, err = NewPermissionAuthorizer(Roles{"r": {{URI: "a", Allow: []string{"delete"}}}})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestLoadPermissionAuthorizer(t *testing.T) {
+	Convey("Given a YAML permissions file", t, func() {
+		dir, err := ioutil.TempDir("", "turnpike")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "permissions.yaml")
+		yaml := "roles:\n  viewer:\n    - uri: site.\n      match: prefix\n      allow: [subscribe]\n"
+		So(ioutil.WriteFile(path, []byte(yaml), 0600), ShouldBeNil)
+
+		Convey("The authorizer should apply the loaded permissions", func() {
+			authorizer, err := LoadPermissionAuthorizer(path)
+			So(err, ShouldBeNil)
+			ok, _ := authorizer.Authorize(testSession("v", "viewer"), &Subscribe{Topic: "site.a.status"})
+			So(ok, ShouldBeTrue)
+			ok, _ = authorizer.Authorize(testSession("v", "viewer"), &Publish{Topic: "site.a.status"})
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
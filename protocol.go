@@ -0,0 +1,137 @@
+package turnpike
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// URI check modes, see Realm.URICheck.
+const (
+	// Loose URIs have non-empty components without whitespace, "." or "#".
+	URICheckLoose = "loose"
+	// Strict URIs only have lowercase letters, digits and "_" in their
+	// components.
+	URICheckStrict = "strict"
+)
+
+var (
+	looseURIPattern         = regexp.MustCompile(`^([^\s.#]+\.)*([^\s.#]+)$`)
+	strictURIPattern        = regexp.MustCompile(`^([0-9a-z_]+\.)*([0-9a-z_]+)$`)
+	looseURIPatternWildcard = regexp.MustCompile(`^(([^\s.#]+\.)|\.)*([^\s.#]+)?$`)
+	// strict patterns with empty components, for prefix and wildcard matching
+	strictURIPatternWildcard = regexp.MustCompile(`^(([0-9a-z_]+\.)|\.)*([0-9a-z_]+)?$`)
+)
+
+// checkURI returns an error if uri isn't valid in the given mode. Patterns of
+// prefix and wildcard subscriptions and registrations may have empty
+// components.
+func checkURI(mode string, uri URI, pattern bool) error {
+	var re *regexp.Regexp
+	switch {
+	case mode == URICheckStrict && pattern:
+		re = strictURIPatternWildcard
+	case mode == URICheckStrict:
+		re = strictURIPattern
+	case pattern:
+		re = looseURIPatternWildcard
+	default:
+		re = looseURIPattern
+	}
+	if uri == "" || !re.MatchString(string(uri)) {
+		return fmt.Errorf("invalid URI: %q", uri)
+	}
+	return nil
+}
+
+// checkID returns an error if id is outside of the range of WAMP IDs,
+// [1, 2^53].
+func checkID(kind string, id ID) error {
+	if id < 1 || id > MAX_REQUEST_ID {
+		return fmt.Errorf("invalid %s ID: %d", kind, id)
+	}
+	return nil
+}
+
+// isPatternMatch reports whether the options of a SUBSCRIBE or REGISTER ask
+// for prefix or wildcard matching.
+func isPatternMatch(options map[string]interface{}) bool {
+	match, _ := options["match"].(string)
+	return match == MatchPrefix || match == MatchWildcard
+}
+
+// validateMessage checks that a message received from an established session
+// is allowed by the WAMP protocol, and that its URIs and IDs are valid. YIELDs
+// and invocation ERRORs are checked against the invocations the dealer sent
+// the session, if it can tell, and CANCELs are only allowed if the dealer
+// supports them.
+func validateMessage(mode string, dealer Dealer, sess *Session, msg Message) error {
+	invocations, _ := dealer.(InvocationTracker)
+	switch msg := msg.(type) {
+	case *Hello, *Welcome, *Abort, *Challenge, *Authenticate:
+		return fmt.Errorf("%s received after the session was established", msg.MessageType())
+	case *Published, *Subscribed, *Unsubscribed, *Event, *Result, *Registered, *Unregistered, *Invocation, *Interrupt:
+		return fmt.Errorf("%s can only be sent by a router", msg.MessageType())
+
+	case *Goodbye:
+		// the session ends either way, so a missing reason is tolerated
+		if msg.Reason != "" {
+			return checkURI(mode, msg.Reason, false)
+		}
+
+	case *Publish:
+		if err := checkID("request", msg.Request); err != nil {
+			return err
+		}
+		return checkURI(mode, msg.Topic, false)
+	case *Subscribe:
+		if err := checkID("request", msg.Request); err != nil {
+			return err
+		}
+		return checkURI(mode, msg.Topic, isPatternMatch(msg.Options))
+	case *Unsubscribe:
+		if err := checkID("request", msg.Request); err != nil {
+			return err
+		}
+		return checkID("subscription", msg.Subscription)
+
+	case *Call:
+		if err := checkID("request", msg.Request); err != nil {
+			return err
+		}
+		return checkURI(mode, msg.Procedure, false)
+	case *Cancel:
+		if _, ok := dealer.(CallCanceler); !ok {
+			return fmt.Errorf("CANCEL is not supported by the dealer")
+		}
+		switch cancelMode, _ := msg.Options["mode"].(string); cancelMode {
+		case "", CancelModeSkip, CancelModeKill, CancelModeKillNoWait:
+		default:
+			return fmt.Errorf("invalid cancel mode: %q", cancelMode)
+		}
+		return checkID("request", msg.Request)
+	case *Register:
+		if err := checkID("request", msg.Request); err != nil {
+			return err
+		}
+		return checkURI(mode, msg.Procedure, isPatternMatch(msg.Options))
+	case *Unregister:
+		if err := checkID("request", msg.Request); err != nil {
+			return err
+		}
+		return checkID("registration", msg.Registration)
+
+	case *Yield:
+		if invocations != nil && !invocations.Invoked(sess, msg.Request) {
+			return fmt.Errorf("YIELD for invocation %d, which was never sent to the session", msg.Request)
+		}
+	case *Error:
+		if msg.Type != INVOCATION {
+			return fmt.Errorf("ERROR for a %s can only be sent by a router", msg.Type)
+		}
+		if invocations != nil && !invocations.Invoked(sess, msg.Request) {
+			return fmt.Errorf("ERROR for invocation %d, which was never sent to the session", msg.Request)
+		}
+		return checkURI(mode, msg.Error, false)
+	}
+	return nil
+}
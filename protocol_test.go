@@ -0,0 +1,145 @@
+package turnpike
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// joinRaw joins a realm with a raw peer, so that the test can send messages a
+// Client never would.
+func joinRaw(router Router, realm URI) *basicPeer {
+	client, msg := helloRealm(router, realm)
+	So(msg.MessageType(), ShouldEqual, WELCOME)
+	return client
+}
+
+func receiveAbort(client *basicPeer) *Abort {
+	var msg Message
+	select {
+	case msg = <-client.incoming:
+	case <-time.After(time.Second):
+	}
+	So(msg, ShouldHaveSameTypeAs, &Abort{})
+	return msg.(*Abort)
+}
+
+func TestProtocolViolations(t *testing.T) {
+	Convey("Given a router with a loose and a strict realm", t, func() {
+		router := NewDefaultRouter()
+		defer router.Close()
+		router.RegisterRealm(testRealm, &Realm{})
+		router.RegisterRealm("test.strict", &Realm{URICheck: URICheckStrict})
+
+		Convey("A HELLO after joining should be aborted", func() {
+			client := joinRaw(router, testRealm)
+			client.Send(&Hello{Realm: testRealm})
+			abort := receiveAbort(client)
+			So(abort.Reason, ShouldEqual, ErrProtocolViolation)
+			So(abort.Details["message"], ShouldContainSubstring, "HELLO")
+		})
+
+		Convey("A YIELD for an invocation that was never sent should be aborted", func() {
+			client := joinRaw(router, testRealm)
+			client.Send(&Yield{Request: 1234, Options: map[string]interface{}{}})
+			So(receiveAbort(client).Reason, ShouldEqual, ErrProtocolViolation)
+		})
+
+		Convey("A YIELD for an invocation sent to another session should be aborted", func() {
+			callee, other := joinRaw(router, testRealm), joinRaw(router, testRealm)
+			callee.Send(&Register{Request: 1, Procedure: "com.example.proc", Options: map[string]interface{}{}})
+			<-callee.incoming
+			other.Send(&Call{Request: 1, Procedure: "com.example.proc", Options: map[string]interface{}{}})
+			invocation := (<-callee.incoming).(*Invocation)
+			other.Send(&Yield{Request: invocation.Request, Options: map[string]interface{}{}})
+			So(receiveAbort(other).Reason, ShouldEqual, ErrProtocolViolation)
+		})
+
+		Convey("A late YIELD for a timed out invocation should be tolerated once", func() {
+			callee, caller := joinRaw(router, testRealm), joinRaw(router, testRealm)
+			callee.Send(&Register{Request: 1, Procedure: "com.example.proc", Options: map[string]interface{}{}})
+			<-callee.incoming
+			caller.Send(&Call{Request: 1, Procedure: "com.example.proc", Options: map[string]interface{}{"timeout": 10}})
+			invocation := (<-callee.incoming).(*Invocation)
+			So((<-callee.incoming).MessageType(), ShouldEqual, INTERRUPT)
+			So((<-caller.incoming).(*Error).Error, ShouldEqual, ErrTimeout)
+
+			callee.Send(&Yield{Request: invocation.Request, Options: map[string]interface{}{}})
+			callee.Send(&Subscribe{Request: 2, Topic: "com.example.topic", Options: map[string]interface{}{}})
+			So((<-callee.incoming).MessageType(), ShouldEqual, SUBSCRIBED)
+			callee.Send(&Yield{Request: invocation.Request, Options: map[string]interface{}{}})
+			So(receiveAbort(callee).Reason, ShouldEqual, ErrProtocolViolation)
+		})
+
+		Convey("A CANCEL with an invalid mode should be aborted", func() {
+			client := joinRaw(router, testRealm)
+			client.Send(&Cancel{Request: 1, Options: map[string]interface{}{"mode": "later"}})
+			So(receiveAbort(client).Details["message"], ShouldContainSubstring, "cancel mode")
+		})
+
+		Convey("A CANCEL should be aborted if the dealer can't cancel calls", func() {
+			// hides the optional interfaces of the default dealer
+			router.RegisterRealm("test.nocancel", &Realm{Dealer: struct{ Dealer }{NewDefaultDealer()}})
+			client := joinRaw(router, "test.nocancel")
+			client.Send(&Cancel{Request: 1, Options: map[string]interface{}{}})
+			So(receiveAbort(client).Details["message"], ShouldContainSubstring, "CANCEL")
+		})
+
+		Convey("Messages after the session's GOODBYE should not be routed", func() {
+			subscriber, client := joinRaw(router, testRealm), joinRaw(router, testRealm)
+			subscriber.Send(&Subscribe{Request: 1, Topic: "com.example.topic", Options: map[string]interface{}{}})
+			So((<-subscriber.incoming).MessageType(), ShouldEqual, SUBSCRIBED)
+			client.Send(&Goodbye{Reason: ErrCloseRealm, Details: map[string]interface{}{}})
+			client.Send(&Publish{Request: 1, Topic: "com.example.topic", Options: map[string]interface{}{}})
+			So((<-client.incoming).MessageType(), ShouldEqual, GOODBYE)
+			select {
+			case msg := <-subscriber.incoming:
+				t.Fatalf("unexpected message %v", msg)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+
+		Convey("An ERROR for a CALL should be aborted", func() {
+			client := joinRaw(router, testRealm)
+			client.Send(&Error{Type: CALL, Request: 1, Error: "com.example.error"})
+			So(receiveAbort(client).Reason, ShouldEqual, ErrProtocolViolation)
+		})
+
+		Convey("A request ID out of range should be aborted", func() {
+			client := joinRaw(router, testRealm)
+			client.Send(&Subscribe{Request: 0, Topic: "com.example.topic"})
+			So(receiveAbort(client).Details["message"], ShouldContainSubstring, "request ID")
+		})
+
+		Convey("URIs with empty components should be aborted in loose mode", func() {
+			client := joinRaw(router, testRealm)
+			client.Send(&Publish{Request: 1, Topic: "com..topic"})
+			So(receiveAbort(client).Details["message"], ShouldContainSubstring, "invalid URI")
+		})
+
+		Convey("Wildcard subscriptions should be allowed empty components", func() {
+			client := joinRaw(router, testRealm)
+			client.Send(&Subscribe{Request: 1, Topic: "com..topic", Options: map[string]interface{}{"match": MatchWildcard}})
+			So((<-client.incoming).MessageType(), ShouldEqual, SUBSCRIBED)
+		})
+
+		Convey("Uppercase URIs should only be aborted in strict mode", func() {
+			client := joinRaw(router, testRealm)
+			client.Send(&Subscribe{Request: 1, Topic: "com.example.Topic"})
+			So((<-client.incoming).MessageType(), ShouldEqual, SUBSCRIBED)
+
+			client = joinRaw(router, "test.strict")
+			client.Send(&Subscribe{Request: 1, Topic: "com.example.Topic"})
+			So(receiveAbort(client).Reason, ShouldEqual, ErrProtocolViolation)
+		})
+
+		Convey("A HELLO for an invalid realm URI should be aborted", func() {
+			c, server := localPipe()
+			client := &basicPeer{c}
+			client.Send(&Hello{Realm: "test realm"})
+			So(router.Accept(server), ShouldNotBeNil)
+			So(receiveAbort(client).Reason, ShouldEqual, ErrProtocolViolation)
+		})
+	})
+}
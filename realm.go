@@ -1,8 +1,11 @@
 package turnpike
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	logrus "github.com/sirupsen/logrus"
@@ -11,6 +14,11 @@ import (
 
 const (
 	defaultAuthTimeout = 2 * time.Minute
+	// DefaultTrustedAuthRole is the default authrole of internal sessions.
+	DefaultTrustedAuthRole = "trusted"
+	// how long to wait for the client's GOODBYE reply when a session is
+	// killed outside of a shutdown
+	goodbyeTimeout = 5 * time.Second
 )
 
 // A Realm is a WAMP routing and administrative domain.
@@ -18,64 +26,162 @@ const (
 // Clients that have connected to a WAMP router are joined to a realm and all
 // message delivery is handled by the realm.
 type Realm struct {
-	_                string
-	URI              URI
-	Broker           Broker
-	Dealer           Dealer
-	Authorizer       Authorizer
-	Interceptor      Interceptor
+	_          string
+	URI        URI
+	Broker     Broker
+	Dealer     Dealer
+	Authorizer Authorizer
+	// Interceptor is deprecated, see Middleware.
+	Interceptor Interceptor
+	// Middleware is the realm's message pipeline, see Middleware. An
+	// Interceptor runs before it.
+	Middleware []Middleware
+	// Schemas validate the payloads of calls, their results and publications.
+	// Invalid payloads are answered with wamp.error.invalid_argument, listing
+	// the validation errors, before any other middleware sees them. Results
+	// are only validated if the Dealer implements InvocationLookup.
+	Schemas          []URISchema
 	CRAuthenticators map[string]CRAuthenticator
 	Authenticators   map[string]Authenticator
-	// DefaultAuth      func(details map[string]interface{}) (map[string]interface{}, error)
-	AuthTimeout time.Duration
+	// DefaultAuthenticator, if set, authenticates clients that offer no
+	// authmethods, or none the realm supports. Its WELCOME details may set
+	// "authmethod"; it defaults to "anonymous".
+	DefaultAuthenticator Authenticator
+	// AuthLimiter, if set, locks out clients after repeated authentication
+	// failures.
+	AuthLimiter *AuthLimiter
+	// TrustedAuthRole is the authrole of internal sessions, such as those of
+	// Router.GetLocalPeer and WebsocketServer.GetLocalClient, by which
+	// authorizers can recognize them. It defaults to "trusted". Clients whose
+	// authenticator assigns them this authrole are aborted.
+	TrustedAuthRole string
+	// SessionKillRoles are the authroles allowed to call the meta procedures
+	// that kill sessions, such as wamp.session.kill. Other sessions get
+	// wamp.error.not_authorized, regardless of the Authorizer.
+	SessionKillRoles []string
+	// LockoutAdminRoles are the authroles allowed to call the meta procedures
+	// of the AuthLimiter, such as turnpike.auth.clear_lockout. Other sessions
+	// get wamp.error.not_authorized, regardless of the Authorizer.
+	LockoutAdminRoles []string
+	AuthTimeout       time.Duration
+	// DeadLetterTopic, if set, receives a meta event for every publication that
+	// matched no subscribers, every event that could not be delivered, and every
+	// call that failed with no_such_procedure or a timeout.
+	DeadLetterTopic URI
+	// URICheck is how strictly the URIs in messages from clients are checked:
+	// URICheckLoose (the default) or URICheckStrict. Sessions that send invalid
+	// URIs, or otherwise violate the protocol, are aborted with
+	// wamp.error.protocol_violation.
+	URICheck    string
 	clients     cmap.ConcurrentMap
+	testaments  testaments
 	localClient *localClient
+	// middleware is the pipeline, including the Interceptor and schemas
+	middleware []Middleware
+	schemas    *schemaValidator
+	// shutdownCtx holds the context.Context of a shutdown in progress
+	shutdownCtx atomic.Value
+	// ending is the reason of endSessions once it was called; sessions that
+	// join afterwards are ended right away
+	ending     URI
+	endingLock sync.Mutex
+	// fromTemplate is set on realms created by a RealmTemplate, which are
+	// removed again when no client managed to join them
+	fromTemplate bool
+	// joining counts the clients between looking the realm up and joining
+	// it, or is -1 once the realm is being removed
+	joining int32
 
 	lock sync.RWMutex
 }
 
 type localClient struct {
 	*Client
+	// session is the router side of the client's connection
+	session *Session
 	sync.Mutex
 }
 
-func (r *Realm) getPeer(details map[string]interface{}) (Peer, error) {
+// getLocalSession starts an internal session and returns both the client's
+// peer and the router's session. Internal sessions are authenticated with the
+// "trusted" authmethod and the realm's TrustedAuthRole; their authid can be
+// given in details and defaults to "local-<session ID>".
+func (r *Realm) getLocalSession(details map[string]interface{}) (Peer, *Session) {
 	peerA, peerB := localPipe()
-	sess := &Session{Peer: peerA, Id: NewID(), Details: details, kill: make(chan URI, 1)}
-	if details == nil {
-		details = make(map[string]interface{})
+	id := NewID()
+	sessionDetails := make(map[string]interface{}, len(details)+6)
+	for k, v := range details {
+		sessionDetails[k] = v
 	}
-	go func() {
-		r.handleSession(sess)
-		sess.Close()
-	}()
+	if authid, _ := sessionDetails["authid"].(string); authid == "" {
+		sessionDetails["authid"] = fmt.Sprintf("local-%d", id)
+	}
+	sessionDetails["authrole"] = r.TrustedAuthRole
+	sessionDetails["authmethod"] = "trusted"
+	sessionDetails["authprovider"] = "turnpike"
+	sessionDetails["session"] = id
+	sessionDetails["realm"] = r.URI
+	sess := newSession(peerA, id, sessionDetails)
+	go r.handleSession(sess)
 	log.WithField("session_id", sess.Id).Info("established internal session")
-	return peerB, nil
+	return peerB, sess
 }
 
 // Close disconnects all clients after sending a goodbye message
 func (r *Realm) Close() {
+	r.closeSessions(ErrSystemShutdown)
+}
+
+// closeSessions disconnects all clients, including the realm's own session,
+// with a goodbye message carrying reason.
+func (r *Realm) closeSessions(reason URI) {
 	iter := r.clients.Iter()
 	for client := range iter {
 		sess, isSession := client.Val.(*Session)
 		if !isSession {
 			continue
 		}
-		sess.kill <- ErrSystemShutdown
+		// a session that is already being killed keeps its first reason
+		select {
+		case sess.kill <- reason:
+		default:
+		}
 	}
 }
 
+// KillSessions disconnects the sessions authenticated as authid with a goodbye
+// message carrying reason, and returns how many there were.
+func (r *Realm) KillSessions(authid string, reason URI) int {
+	killed := r.killSessions(func(sess *Session) bool { return sess.AuthID == authid }, reason)
+	if len(killed) > 0 {
+		log.WithFields(logrus.Fields{
+			"authid": authid,
+			"reason": reason,
+			"count":  len(killed),
+		}).Info("killed sessions")
+	}
+	return len(killed)
+}
+
 func (r *Realm) init() {
 	r.lock.Lock()
-	defer r.lock.Unlock()
 
 	r.clients = cmap.New()
+	r.endingLock.Lock()
+	r.ending = ""
+	r.endingLock.Unlock()
+	atomic.StoreInt32(&r.joining, 0)
 
+	if r.TrustedAuthRole == "" {
+		r.TrustedAuthRole = DefaultTrustedAuthRole
+	}
 	if r.localClient == nil {
-		p, _ := r.getPeer(nil)
+		p, sess := r.getLocalSession(nil)
 		client := NewClient(p)
 		r.localClient = new(localClient)
 		r.localClient.Client = client
+		r.localClient.session = sess
+		go client.Receive()
 	}
 
 	if r.Broker == nil {
@@ -87,20 +193,106 @@ func (r *Realm) init() {
 	if r.Authorizer == nil {
 		r.Authorizer = NewDefaultAuthorizer()
 	}
-	if r.Interceptor == nil {
-		r.Interceptor = NewDefaultInterceptor()
+	r.middleware = nil
+	if r.schemas != nil {
+		r.schemas.invocations, _ = r.Dealer.(InvocationLookup)
+		r.middleware = append(r.middleware, r.schemas)
+	}
+	if r.Interceptor != nil {
+		r.middleware = append(r.middleware, InterceptorMiddleware(r.Interceptor))
 	}
+	r.middleware = append(r.middleware, r.Middleware...)
 	if r.AuthTimeout == 0 {
 		r.AuthTimeout = defaultAuthTimeout
 	}
+	if r.URICheck == "" {
+		r.URICheck = URICheckLoose
+	}
+	if r.DeadLetterTopic != "" {
+		if b, ok := r.Broker.(DeadLetterReporter); ok {
+			b.SetDeadLetterHandler(r.deadLetter)
+		}
+		if d, ok := r.Dealer.(DeadLetterReporter); ok {
+			d.SetDeadLetterHandler(r.deadLetter)
+		}
+	}
+	r.lock.Unlock()
+
+	r.watchRevocations()
+	// the local session can only register once the realm is unlocked
+	r.registerMetaProcedures()
+}
+
+// registerMetaProcedures registers the realm's meta procedures through its
+// local client.
+func (r *Realm) registerMetaProcedures() {
+	procedures := map[string]MethodHandler{
+		MetaSessionCount:          r.sessionCount,
+		MetaSessionList:           r.sessionList,
+		MetaSessionGet:            r.sessionGet,
+		MetaSessionKill:           r.sessionKill,
+		MetaSessionKillByAuthID:   r.sessionKillByAuthID,
+		MetaSessionKillByAuthRole: r.sessionKillByAuthRole,
+		MetaAddTestament:          r.addTestament,
+		MetaFlushTestaments:       r.flushTestaments,
+	}
+	if r.schemas != nil {
+		procedures[MetaSchemaList] = r.schemaList
+		procedures[MetaSchemaGet] = r.schemaGet
+	}
+	if r.AuthLimiter != nil {
+		procedures[MetaGetLockouts] = r.AuthLimiter.getLockouts
+		procedures[MetaClearLockout] = r.AuthLimiter.clearLockout
+	}
+	for procedure, fn := range procedures {
+		// meta procedures may need to know which session called them
+		options := map[string]interface{}{"disclose_caller": true}
+		if err := r.localClient.Register(procedure, fn, options); err != nil {
+			log.WithFields(logrus.Fields{
+				"procedure": procedure,
+				"error":     err,
+			}).Error("error registering meta procedure")
+		}
+	}
 }
 
-func (l *localClient) onJoin(details map[string]interface{}) {
-	l.Publish("wamp.session.on_join", nil, []interface{}{details}, nil)
+// watchRevocations kills the sessions of authids whose credentials are
+// revoked by any of the realm's authenticators, and unbinds their cookies.
+func (r *Realm) watchRevocations() {
+	var authenticators []interface{}
+	for _, a := range r.Authenticators {
+		authenticators = append(authenticators, a)
+	}
+	for _, a := range r.CRAuthenticators {
+		authenticators = append(authenticators, a)
+	}
+	if r.DefaultAuthenticator != nil {
+		authenticators = append(authenticators, r.DefaultAuthenticator)
+	}
+	var cookies []*CookieAuthenticator
+	for _, a := range authenticators {
+		if c, ok := a.(*CookieAuthenticator); ok {
+			cookies = append(cookies, c)
+		}
+	}
+	for _, a := range authenticators {
+		if n, ok := a.(RevocationNotifier); ok {
+			n.OnRevoke(func(authid string) {
+				for _, c := range cookies {
+					c.Revoke(authid)
+				}
+				r.KillSessions(authid, ErrAuthRevoked)
+			})
+		}
+	}
 }
 
-func (l *localClient) onLeave(session ID) {
-	l.Publish("wamp.session.on_leave", nil, []interface{}{session}, nil)
+func (l *localClient) onJoin(sess *Session) {
+	l.Publish("wamp.session.on_join", nil, []interface{}{sess.metaDetails()}, nil)
+}
+
+func (l *localClient) onLeave(sess *Session) {
+	l.Publish("wamp.session.on_leave", nil, []interface{}{sess.Id, sess.AuthID, sess.AuthRole}, nil)
 }
 
 func (r *Realm) doOne(c <-chan Message, sess *Session) bool {
@@ -118,7 +310,7 @@ func (r *Realm) doOne(c <-chan Message, sess *Session) bool {
 	case reason := <-sess.kill:
 		logErr(sess.Send(&Goodbye{Reason: reason, Details: make(map[string]interface{})}))
 		log.Printf("kill session %s: %v", sess, reason)
-		// TODO: wait for client Goodbye?
+		sess.goodbyeSent = true
 		return false
 	}
 
@@ -130,8 +322,39 @@ func (r *Realm) doOne(c <-chan Message, sess *Session) bool {
 		"message":      redactedMsg,
 	}).Debug("new message")
 
-	if isAuthz, err := r.Authorizer.Authorize(sess, msg); !isAuthz {
-		errMsg := &Error{Type: msg.MessageType()}
+	if sess != r.localClient.session {
+		if err := validateMessage(r.URICheck, r.Dealer, sess, msg); err != nil {
+			log.WithFields(logrus.Fields{
+				"session_id":   sess.Id,
+				"message_type": msg.MessageType().String(),
+				"message":      redactedMsg,
+				"err":          err,
+			}).Error("protocol violation")
+			logErr(sess.Send(&Abort{
+				Reason:  ErrProtocolViolation,
+				Details: map[string]interface{}{"message": err.Error()},
+			}))
+			return false
+		}
+	}
+
+	// the realm's own session publishes meta events and provides meta
+	// procedures, so it is always authorized
+	isAuthz, err := true, error(nil)
+	if sess != r.localClient.session {
+		isAuthz, err = r.Authorizer.Authorize(sess, msg)
+		if call, ok := msg.(*Call); ok && isAuthz && isSessionKillProcedure(call.Procedure) {
+			isAuthz = r.mayKillSessions(sess)
+		} else if ok && isAuthz && isLockoutProcedure(call.Procedure) {
+			isAuthz = r.mayManageLockouts(sess)
+		}
+	}
+	if !isAuthz {
+		errMsg := &Error{
+			Type:    msg.MessageType(),
+			Request: requestID(msg),
+			Details: make(map[string]interface{}),
+		}
 		if err != nil {
 			errMsg.Error = ErrAuthorizationFailed
 			log.WithFields(logrus.Fields{
@@ -153,7 +376,14 @@ func (r *Realm) doOne(c <-chan Message, sess *Session) bool {
 		return true
 	}
 
-	r.Interceptor.Intercept(sess, &msg)
+	if sess != r.localClient.session {
+		if msg = r.inbound(sess, msg); msg == nil {
+			return true
+		}
+	} else if r.Interceptor != nil {
+		// Interceptors have always seen the realm's own messages
+		r.Interceptor.Intercept(sess, &msg)
+	}
 
 	switch msg := msg.(type) {
 	case *Goodbye:
@@ -181,6 +411,10 @@ func (r *Realm) doOne(c <-chan Message, sess *Session) bool {
 		r.Dealer.Call(sess, msg)
 	case *Yield:
 		r.Dealer.Yield(sess, msg)
+	case *Cancel:
+		if canceler, ok := r.Dealer.(CallCanceler); ok {
+			canceler.Cancel(sess, msg)
+		}
 
 	// Error messages
 	case *Error:
@@ -197,6 +431,32 @@ func (r *Realm) doOne(c <-chan Message, sess *Session) bool {
 	return true
 }
 
+// requestID returns the request ID of a message sent by a client, or 0 if the
+// message doesn't have one.
+func requestID(msg Message) ID {
+	switch msg := msg.(type) {
+	case *Publish:
+		return msg.Request
+	case *Subscribe:
+		return msg.Request
+	case *Unsubscribe:
+		return msg.Request
+	case *Call:
+		return msg.Request
+	case *Cancel:
+		return msg.Request
+	case *Register:
+		return msg.Request
+	case *Unregister:
+		return msg.Request
+	case *Yield:
+		return msg.Request
+	case *Error:
+		return msg.Request
+	}
+	return 0
+}
+
 func redactMessage(msg Message) Message {
 	switch msg := msg.(type) {
 	case *Call:
@@ -220,28 +480,278 @@ func redactMessage(msg Message) Message {
 }
 
 func (r *Realm) handleSession(sess *Session) {
+	r.join(sess)
+	r.serve(sess)
+}
+
+// join adds a session to the realm. A session that joins after endSessions
+// was called is ended right away.
+func (r *Realm) join(sess *Session) {
 	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if sess != r.localClient.session && len(r.middleware) > 0 {
+		sess.Peer = &middlewarePeer{Peer: sess.Peer, realm: r, sess: sess}
+	}
+	r.endingLock.Lock()
 	r.clients.Set(fmt.Sprintf("%d", sess.Id), sess)
-	r.localClient.onJoin(sess.Details)
-	r.lock.RUnlock()
+	reason := r.ending
+	r.endingLock.Unlock()
+	r.localClient.onJoin(sess)
+	if reason != "" {
+		select {
+		case sess.kill <- reason:
+		default:
+		}
+	}
+}
+
+// serve routes the messages of a session that joined the realm until it ends.
+func (r *Realm) serve(sess *Session) {
+	if !sess.AuthExpires.IsZero() {
+		expiry := time.AfterFunc(time.Until(sess.AuthExpires), func() {
+			select {
+			case sess.kill <- ErrAuthExpired:
+			default:
+			}
+		})
+		defer expiry.Stop()
+	}
 
 	defer func() {
 		r.lock.RLock()
-		defer r.lock.RUnlock()
-
 		r.clients.Remove(fmt.Sprintf("%d", sess.Id))
 		r.Broker.RemoveSession(sess)
 		r.Dealer.RemoveSession(sess)
-		r.localClient.onLeave(sess.Id)
+		r.publishTestaments(sess)
+		for _, m := range r.middleware {
+			if m, ok := m.(interface{ RemoveSession(*Session) }); ok {
+				m.RemoveSession(sess)
+			}
+		}
+		r.localClient.onLeave(sess)
+		r.lock.RUnlock()
+
+		// closing the peer flushes the messages queued for it
+		sess.Close()
+		close(sess.done)
 	}()
 	c := sess.Receive()
-	// TODO: what happens if the realm is closed?
 
 	for r.doOne(c, sess) {
 	}
+	if sess.goodbyeSent {
+		sess.cleanClose = r.awaitGoodbye(c, sess)
+	}
 }
 
-func (r *Realm) handleAuth(client Peer, details map[string]interface{}) (*Welcome, error) {
+// awaitGoodbye waits for the client's GOODBYE reply after the router sent a
+// GOODBYE, and returns whether it came. Meanwhile, results of calls that were
+// in flight are still routed to their callers; other messages are dropped.
+func (r *Realm) awaitGoodbye(c <-chan Message, sess *Session) bool {
+	var timeout <-chan time.Time
+	var done <-chan struct{}
+	if ctx, ok := r.shutdownCtx.Load().(context.Context); ok {
+		done = ctx.Done()
+	} else {
+		timer := time.NewTimer(goodbyeTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case msg, open := <-c:
+			if !open {
+				return false
+			}
+			switch msg.(type) {
+			case *Goodbye:
+				return true
+			case *Yield, *Error:
+				if !r.routeResult(sess, msg) {
+					return false
+				}
+			}
+		case <-timeout:
+			return false
+		case <-done:
+			return false
+		}
+	}
+}
+
+// routeResult routes a YIELD or invocation ERROR that a session sent after the
+// router's GOODBYE, with the same checks as doOne. It returns false if the
+// message violated the protocol.
+func (r *Realm) routeResult(sess *Session, msg Message) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if err := validateMessage(r.URICheck, r.Dealer, sess, msg); err != nil {
+		log.WithFields(logrus.Fields{
+			"session_id":   sess.Id,
+			"message_type": msg.MessageType().String(),
+			"err":          err,
+		}).Error("protocol violation")
+		return false
+	}
+	if msg = r.inbound(sess, msg); msg == nil {
+		return true
+	}
+	switch msg := msg.(type) {
+	case *Yield:
+		r.Dealer.Yield(sess, msg)
+	case *Error:
+		if msg.Type == INVOCATION {
+			r.Dealer.Error(sess, msg)
+		}
+	}
+	return true
+}
+
+// shutdown ends all sessions with a GOODBYE and waits until they are closed or
+// ctx is done. It returns the number of sessions and how many of them replied
+// with a GOODBYE.
+func (r *Realm) shutdown(ctx context.Context) (sessions int, clean int) {
+	r.shutdownCtx.Store(ctx)
+	return r.endSessions(ctx, ErrSystemShutdown)
+}
+
+// endSessions ends all sessions with a GOODBYE carrying reason and waits until
+// they are closed or ctx is done. It returns the number of sessions and how
+// many of them replied with a GOODBYE. The realm's own session is closed last,
+// so that it can still publish the meta events and testaments of the others.
+func (r *Realm) endSessions(ctx context.Context, reason URI) (sessions int, clean int) {
+	r.endingLock.Lock()
+	r.ending = reason
+	r.endingLock.Unlock()
+	remote := r.sessions(nil)
+	for _, sess := range remote {
+		select {
+		case sess.kill <- reason:
+		default:
+		}
+	}
+	for _, sess := range remote {
+		select {
+		case <-sess.done:
+		case <-ctx.Done():
+		}
+	}
+	// once ctx is done, sessions that already closed still count
+	for _, sess := range remote {
+		select {
+		case <-sess.done:
+			if sess.cleanClose {
+				clean++
+			}
+		default:
+		}
+	}
+	if r.localClient != nil {
+		select {
+		case r.localClient.session.kill <- reason:
+		default:
+		}
+		select {
+		case <-r.localClient.session.done:
+		case <-ctx.Done():
+		}
+	}
+	return len(remote), clean
+}
+
+// acquire counts a client that is about to join the realm. It fails if the
+// realm is being removed.
+func (r *Realm) acquire() bool {
+	for {
+		n := atomic.LoadInt32(&r.joining)
+		if n < 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&r.joining, n, n+1) {
+			return true
+		}
+	}
+}
+
+// release uncounts a client that joined the realm or failed to.
+func (r *Realm) release() {
+	atomic.AddInt32(&r.joining, -1)
+}
+
+// retire marks the realm as being removed if no client is joining it and it
+// has no sessions, and reports whether it did.
+func (r *Realm) retire() bool {
+	if !atomic.CompareAndSwapInt32(&r.joining, 0, -1) {
+		return false
+	}
+	// sessions join before they are released
+	if len(r.sessions(nil)) > 0 {
+		atomic.StoreInt32(&r.joining, 0)
+		return false
+	}
+	return true
+}
+
+func (r *Realm) handleAuth(client Peer, sessionID ID, hello map[string]interface{}) (*Welcome, error) {
+	// authenticators see the HELLO details along with the ID the session will
+	// be assigned, which e.g. WAMP-CRA includes in its challenge
+	details := make(map[string]interface{}, len(hello)+1)
+	for k, v := range hello {
+		details[k] = v
+	}
+	details["session"] = sessionID
+	// the transport can only be set by the router, never by the client
+	delete(details, "transport")
+	if t, ok := client.(TransportPeer); ok && t.TransportInfo() != nil {
+		details["transport"] = t.TransportInfo()
+	}
+
+	var lockoutKeys []lockoutKey
+	if r.AuthLimiter != nil {
+		lockoutKeys = r.AuthLimiter.keys(details)
+		if err := r.AuthLimiter.check(lockoutKeys); err != nil {
+			return nil, err
+		}
+	}
+
+	welcome, err := r.authenticateSession(client, details)
+	if err != nil {
+		if r.AuthLimiter != nil {
+			r.AuthLimiter.fail(lockoutKeys)
+		}
+		return nil, err
+	}
+	// authorizers recognize internal sessions by their identity, which
+	// authenticators must not hand out
+	if role, _ := welcome.Details["authrole"].(string); role == r.TrustedAuthRole {
+		return nil, fmt.Errorf("authrole %s is reserved for internal sessions", role)
+	}
+	if method, _ := welcome.Details["authmethod"].(string); method == "trusted" {
+		return nil, fmt.Errorf("authmethod trusted is reserved for internal sessions")
+	}
+	if r.AuthLimiter != nil {
+		r.AuthLimiter.succeed(lockoutKeys, welcome.Details)
+	}
+	r.notifyAuthenticated(details, welcome.Details)
+	return welcome, nil
+}
+
+// notifyAuthenticated tells the realm's AuthenticationObservers about a
+// successful authentication.
+func (r *Realm) notifyAuthenticated(hello map[string]interface{}, welcome map[string]interface{}) {
+	for _, auth := range r.Authenticators {
+		if o, ok := auth.(AuthenticationObserver); ok {
+			o.Authenticated(hello, welcome)
+		}
+	}
+	for _, auth := range r.CRAuthenticators {
+		if o, ok := auth.(AuthenticationObserver); ok {
+			o.Authenticated(hello, welcome)
+		}
+	}
+}
+
+func (r *Realm) authenticateSession(client Peer, details map[string]interface{}) (*Welcome, error) {
 	msg, err := r.authenticate(details)
 	if err != nil {
 		return nil, err
@@ -272,14 +782,14 @@ func (r *Realm) handleAuth(client Peer, details map[string]interface{}) (*Welcom
 // challenge/response authentication is to be used.
 func (r *Realm) authenticate(details map[string]interface{}) (Message, error) {
 	log.Println("details:", details)
-	if len(r.Authenticators) == 0 && len(r.CRAuthenticators) == 0 {
+	if len(r.Authenticators) == 0 && len(r.CRAuthenticators) == 0 && r.DefaultAuthenticator == nil {
 		return &Welcome{}, nil
 	}
 	// TODO: this might not always be a []interface{}. Using the JSON unmarshaller it will be,
 	// but we may have serializations that preserve more of the original type.
 	// For now, the tests just explicitly send a []interface{}
 	_authmethods, ok := details["authmethods"].([]interface{})
-	if !ok {
+	if !ok && r.DefaultAuthenticator == nil {
 		return nil, fmt.Errorf("No authentication supplied")
 	}
 	authmethods := []string{}
@@ -292,21 +802,40 @@ func (r *Realm) authenticate(details map[string]interface{}) (Message, error) {
 	}
 	for _, method := range authmethods {
 		if auth, ok := r.CRAuthenticators[method]; ok {
-			if challenge, err := auth.Challenge(details); err != nil {
+			if challenge, err := auth.Challenge(details); errors.Is(err, ErrNoCredentials) {
+				continue
+			} else if err != nil {
 				return nil, err
 			} else {
 				return &Challenge{AuthMethod: method, Extra: challenge}, nil
 			}
 		}
 		if auth, ok := r.Authenticators[method]; ok {
-			if authDetails, err := auth.Authenticate(details); err != nil {
+			// tell authenticators that serve several methods which one is used
+			details["authmethod"] = method
+			if authDetails, err := auth.Authenticate(details); errors.Is(err, ErrNoCredentials) {
+				continue
+			} else if err != nil {
 				return nil, err
 			} else {
 				return &Welcome{Details: addAuthMethod(authDetails, method)}, nil
 			}
 		}
 	}
-	// TODO: check default auth (special '*' auth?)
+	if r.DefaultAuthenticator != nil {
+		delete(details, "authmethod")
+		authDetails, err := r.DefaultAuthenticator.Authenticate(details)
+		if err != nil {
+			return nil, err
+		}
+		if authDetails == nil {
+			authDetails = make(map[string]interface{})
+		}
+		if _, ok := authDetails["authmethod"]; !ok {
+			authDetails["authmethod"] = "anonymous"
+		}
+		return &Welcome{Details: authDetails}, nil
+	}
 	return nil, fmt.Errorf("could not authenticate with any method")
 }
 
@@ -316,11 +845,17 @@ func (r *Realm) checkResponse(chal *Challenge, auth *Authenticate) (*Welcome, er
 	if !ok {
 		return nil, fmt.Errorf("authentication method has been removed")
 	}
-	if details, err := authenticator.Authenticate(chal.Extra, auth.Signature); err != nil {
-		return nil, err
+	var details map[string]interface{}
+	var err error
+	if extraAuthenticator, ok := authenticator.(CRAuthenticatorExtra); ok {
+		details, err = extraAuthenticator.AuthenticateExtra(chal.Extra, auth.Signature, auth.Extra)
 	} else {
-		return &Welcome{Details: addAuthMethod(details, chal.AuthMethod)}, nil
+		details, err = authenticator.Authenticate(chal.Extra, auth.Signature)
+	}
+	if err != nil {
+		return nil, err
 	}
+	return &Welcome{Details: addAuthMethod(details, chal.AuthMethod)}, nil
 }
 
 func addAuthMethod(details map[string]interface{}, method string) map[string]interface{} {
@@ -0,0 +1,90 @@
+package turnpike
+
+import (
+	"fmt"
+	"time"
+)
+
+// RealmTemplate lets a router create realms on demand: a HELLO for a realm
+// that isn't registered creates it from the first template whose pattern
+// matches the realm's URI, instead of being aborted with no_such_realm.
+//
+// Authenticators and the AuthLimiter are shared by all realms created from a
+// template; brokers, dealers and authorizers are created per realm by the
+// factories, or are the defaults if a factory is nil.
+type RealmTemplate struct {
+	// Pattern selects the realm URIs the template applies to, under the match
+	// policy Match (MatchExact, MatchPrefix or MatchWildcard), e.g. the prefix
+	// "com.example.site.".
+	Pattern string
+	Match   string
+
+	CRAuthenticators     map[string]CRAuthenticator
+	Authenticators       map[string]Authenticator
+	DefaultAuthenticator Authenticator
+	AuthLimiter          *AuthLimiter
+	AuthTimeout          time.Duration
+	SessionKillRoles     []string
+	LockoutAdminRoles    []string
+	Schemas              []URISchema
+	// DeadLetterTopic is used as is in every realm.
+	DeadLetterTopic URI
+
+	NewAuthorizer  func(realm URI) (Authorizer, error)
+	NewInterceptor func(realm URI) Interceptor
+	NewMiddleware  func(realm URI) []Middleware
+	NewBroker      func(realm URI) Broker
+	NewDealer      func(realm URI) Dealer
+}
+
+func (t *RealmTemplate) validate() error {
+	switch t.Match {
+	case MatchExact, MatchPrefix, MatchWildcard, "":
+	default:
+		return fmt.Errorf("invalid match policy for realm template %s: %s", t.Pattern, t.Match)
+	}
+	if t.Pattern == "" && t.Match != MatchPrefix {
+		return fmt.Errorf("realm template has no pattern")
+	}
+	return nil
+}
+
+func (t *RealmTemplate) matches(uri URI) bool {
+	return matchURI(t.Match, t.Pattern, uri)
+}
+
+// newRealm builds a realm for uri from the template.
+func (t *RealmTemplate) newRealm(uri URI) (*Realm, error) {
+	realm := &Realm{
+		URI:                  uri,
+		CRAuthenticators:     t.CRAuthenticators,
+		Authenticators:       t.Authenticators,
+		DefaultAuthenticator: t.DefaultAuthenticator,
+		AuthLimiter:          t.AuthLimiter,
+		AuthTimeout:          t.AuthTimeout,
+		SessionKillRoles:     t.SessionKillRoles,
+		LockoutAdminRoles:    t.LockoutAdminRoles,
+		Schemas:              t.Schemas,
+		DeadLetterTopic:      t.DeadLetterTopic,
+	}
+	if t.NewAuthorizer != nil {
+		authorizer, err := t.NewAuthorizer(uri)
+		if err != nil {
+			return nil, fmt.Errorf("error creating authorizer for realm %s: %v", uri, err)
+		}
+		realm.Authorizer = authorizer
+	}
+	if t.NewInterceptor != nil {
+		realm.Interceptor = t.NewInterceptor(uri)
+	}
+	if t.NewMiddleware != nil {
+		realm.Middleware = t.NewMiddleware(uri)
+	}
+	if t.NewBroker != nil {
+		realm.Broker = t.NewBroker(uri)
+	}
+	if t.NewDealer != nil {
+		realm.Dealer = t.NewDealer(uri)
+	}
+	return realm, nil
+}
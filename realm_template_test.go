@@ -0,0 +1,132 @@
+package turnpike
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func helloRealm(r Router, realm URI) (*basicPeer, Message) {
+	c, server := localPipe()
+	client := &basicPeer{c}
+	client.Send(&Hello{Realm: realm})
+	r.Accept(server)
+	return client, <-client.incoming
+}
+
+func TestRealmTemplate(t *testing.T) {
+	Convey("Given a router with a template for site realms", t, func() {
+		r := NewDefaultRouter()
+		defer r.Close()
+		brokers := 0
+		So(r.(RealmManager).AddRealmTemplate(RealmTemplate{
+			Pattern: "com.example.site.",
+			Match:   MatchPrefix,
+			NewBroker: func(realm URI) Broker {
+				brokers++
+				return NewDefaultBroker()
+			},
+		}), ShouldBeNil)
+
+		Convey("A HELLO for a matching realm should create it", func() {
+			_, msg := helloRealm(r, "com.example.site.1")
+			So(msg.MessageType(), ShouldEqual, WELCOME)
+			_, msg = helloRealm(r, "com.example.site.1")
+			So(msg.MessageType(), ShouldEqual, WELCOME)
+			_, msg = helloRealm(r, "com.example.site.2")
+			So(msg.MessageType(), ShouldEqual, WELCOME)
+			So(brokers, ShouldEqual, 2)
+			So(r.RegisterRealm("com.example.site.1", &Realm{}), ShouldHaveSameTypeAs, RealmExistsError(""))
+		})
+
+		Convey("A HELLO that fails to authenticate should not leave its realm behind", func() {
+			So(r.(RealmManager).AddRealmTemplate(RealmTemplate{
+				Pattern:          "com.example.secure.",
+				Match:            MatchPrefix,
+				CRAuthenticators: map[string]CRAuthenticator{"ticket": NewBasicTicketAuthenticator("ticket1")},
+			}), ShouldBeNil)
+			hello := func(ticket string) Message {
+				c, server := localPipe()
+				client := &basicPeer{c}
+				client.Send(&Hello{Realm: "com.example.secure.1", Details: map[string]interface{}{"authmethods": []interface{}{"ticket"}}})
+				client.Send(&Authenticate{Signature: ticket})
+				r.Accept(server)
+				var msg Message
+				for len(client.incoming) > 0 {
+					msg = <-client.incoming
+				}
+				return msg
+			}
+			So(hello("wrong").MessageType(), ShouldEqual, ABORT)
+			_, ok := r.(*defaultRouter).realms.Get("com.example.secure.1")
+			So(ok, ShouldBeFalse)
+
+			So(hello("ticket1").MessageType(), ShouldEqual, WELCOME)
+			So(hello("wrong").MessageType(), ShouldEqual, ABORT)
+			_, ok = r.(*defaultRouter).realms.Get("com.example.secure.1")
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("A HELLO for another realm should still be aborted", func() {
+			_, msg := helloRealm(r, "com.example.other")
+			So(msg.MessageType(), ShouldEqual, ABORT)
+			So(msg.(*Abort).Reason, ShouldEqual, ErrNoSuchRealm)
+		})
+
+		Convey("Templates with an invalid match policy should be rejected", func() {
+			So(r.(RealmManager).AddRealmTemplate(RealmTemplate{Pattern: "com.example.", Match: "regex"}), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestUnregisterRealm(t *testing.T) {
+	Convey("Given a realm with a session", t, func() {
+		r := NewDefaultRouter()
+		defer r.Close()
+		realm := &Realm{}
+		So(r.RegisterRealm(testRealm, realm), ShouldBeNil)
+		client, msg := helloRealm(r, testRealm)
+		So(msg.MessageType(), ShouldEqual, WELCOME)
+
+		Convey("Unregistering the realm should end the session with a GOODBYE", func() {
+			So(r.(RealmManager).UnregisterRealm(testRealm), ShouldBeNil)
+			select {
+			case msg := <-client.incoming:
+				goodbye, ok := msg.(*Goodbye)
+				So(ok, ShouldBeTrue)
+				So(goodbye.Reason, ShouldEqual, ErrCloseRealm)
+			case <-time.After(time.Second):
+				t.Fatal("session was not closed")
+			}
+
+			_, msg := helloRealm(r, testRealm)
+			So(msg.MessageType(), ShouldEqual, ABORT)
+			So(r.(RealmManager).UnregisterRealm(testRealm), ShouldHaveSameTypeAs, NoSuchRealmError(""))
+		})
+
+		Convey("The realm's own session should be closed after the others", func() {
+			sess := realm.sessions(nil)[0]
+			So(r.(RealmManager).UnregisterRealm(testRealm), ShouldBeNil)
+			<-client.incoming
+			client.Send(&Goodbye{Reason: ErrGoodbyeAndOut, Details: map[string]interface{}{}})
+			select {
+			case <-realm.localClient.session.done:
+			case <-time.After(time.Second):
+				t.Fatal("the realm's own session was not closed")
+			}
+			select {
+			case <-sess.done:
+			default:
+				t.Fatal("the realm's own session was closed first")
+			}
+		})
+
+		Convey("The realm should be able to be registered again", func() {
+			So(r.(RealmManager).UnregisterRealm(testRealm), ShouldBeNil)
+			So(r.RegisterRealm(testRealm, &Realm{}), ShouldBeNil)
+			_, msg := helloRealm(r, testRealm)
+			So(msg.MessageType(), ShouldEqual, WELCOME)
+		})
+	})
+}
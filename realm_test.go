@@ -3,6 +3,7 @@ package turnpike
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -72,6 +73,36 @@ func TestBasicAuthenticator(t *testing.T) {
 	})
 }
 
+func TestDefaultAuthenticator(t *testing.T) {
+	Convey("Given a Realm with a ticket authenticator and an anonymous default", t, func() {
+		realm := Realm{
+			CRAuthenticators:     map[string]CRAuthenticator{"ticket": NewBasicTicketAuthenticator("ticket1")},
+			DefaultAuthenticator: NewAnonymousAuthenticator("kiosk"),
+		}
+		Convey("A client without authmethods should be welcomed anonymously", func() {
+			msg, err := realm.authenticate(map[string]interface{}{})
+			So(err, ShouldBeNil)
+			welcome := msg.(*Welcome)
+			So(welcome.Details["authmethod"], ShouldEqual, "anonymous")
+			So(welcome.Details["authrole"], ShouldEqual, "kiosk")
+			So(welcome.Details["authid"], ShouldStartWith, "anonymous-")
+
+			msg, _ = realm.authenticate(map[string]interface{}{})
+			So(msg.(*Welcome).Details["authid"], ShouldNotEqual, welcome.Details["authid"])
+		})
+		Convey("A client with unsupported authmethods should be welcomed anonymously", func() {
+			msg, err := realm.authenticate(map[string]interface{}{"authmethods": []interface{}{"wampcra"}})
+			So(err, ShouldBeNil)
+			So(msg.(*Welcome).Details["authrole"], ShouldEqual, "kiosk")
+		})
+		Convey("A client with a supported authmethod should still be challenged", func() {
+			msg, err := realm.authenticate(map[string]interface{}{"authmethods": []interface{}{"ticket"}})
+			So(err, ShouldBeNil)
+			So(msg.MessageType(), ShouldEqual, CHALLENGE)
+		})
+	})
+}
+
 type testCRAuthenticator struct{}
 
 func (t *testCRAuthenticator) Challenge(details map[string]interface{}) (map[string]interface{}, error) {
@@ -137,3 +168,70 @@ func TestCRAuthenticator(t *testing.T) {
 		})
 	})
 }
+
+type testExpiringAuthenticator struct {
+	expires time.Time
+}
+
+func (t *testExpiringAuthenticator) Authenticate(details map[string]interface{}) (map[string]interface{}, error) {
+	return map[string]interface{}{"authid": "alice", AuthExpiresDetail: t.expires}, nil
+}
+
+func TestAuthExpiry(t *testing.T) {
+	Convey("Given a realm whose authenticator returns an expiry", t, func() {
+		r := NewDefaultRouter()
+		defer r.Close()
+		r.RegisterRealm(testRealm, &Realm{
+			Authenticators: map[string]Authenticator{
+				"test": &testExpiringAuthenticator{expires: time.Now().Add(50 * time.Millisecond)},
+			},
+		})
+		c, server := localPipe()
+		client := &basicPeer{c}
+		client.Send(&Hello{Realm: testRealm, Details: map[string]interface{}{"authmethods": []interface{}{"test"}}})
+		So(r.Accept(server), ShouldBeNil)
+
+		Convey("The expiry should not be sent to the client", func() {
+			welcome, ok := (<-client.incoming).(*Welcome)
+			So(ok, ShouldBeTrue)
+			So(welcome.Details, ShouldNotContainKey, AuthExpiresDetail)
+		})
+
+		Convey("The session should be killed when the credentials expire", func() {
+			<-client.incoming
+			select {
+			case msg := <-client.incoming:
+				goodbye, ok := msg.(*Goodbye)
+				So(ok, ShouldBeTrue)
+				So(goodbye.Reason, ShouldEqual, ErrAuthExpired)
+			case <-time.After(time.Second):
+				t.Fatal("session was not killed")
+			}
+		})
+	})
+}
+
+func TestTrustedIdentityReserved(t *testing.T) {
+	Convey("Given a realm whose authenticator grants any requested authrole", t, func() {
+		r := NewDefaultRouter()
+		defer r.Close()
+		r.RegisterRealm(testRealm, &Realm{
+			Authenticators: map[string]Authenticator{"test": &testRoleAuthenticator{}},
+		})
+		join := func(authrole string) Message {
+			c, server := localPipe()
+			client := &basicPeer{c}
+			client.Send(&Hello{Realm: testRealm, Details: map[string]interface{}{
+				"authmethods": []interface{}{"test"},
+				"authrole":    authrole,
+			}})
+			r.Accept(server)
+			return <-client.incoming
+		}
+
+		Convey("Clients should not be welcomed with the trusted authrole", func() {
+			So(join(DefaultTrustedAuthRole).MessageType(), ShouldEqual, ABORT)
+			So(join("user").MessageType(), ShouldEqual, WELCOME)
+		})
+	})
+}
@@ -1,6 +1,8 @@
 package turnpike
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -10,13 +12,6 @@ import (
 	cmap "github.com/streamrail/concurrent-map"
 )
 
-var defaultWelcomeDetails = map[string]interface{}{
-	"roles": map[string]struct{}{
-		"broker": {},
-		"dealer": {},
-	},
-}
-
 type RealmExistsError string
 
 func (e RealmExistsError) Error() string {
@@ -46,13 +41,36 @@ type Router interface {
 	AddSessionCloseCallback(func(uint, string))
 }
 
+// RealmManager is implemented by Routers whose realms can be removed, or
+// created from templates, while they run. The default router implements it.
+type RealmManager interface {
+	// UnregisterRealm removes a realm, ending its sessions with a GOODBYE.
+	UnregisterRealm(URI) error
+	// AddRealmTemplate makes HELLOs for unregistered realms that match the
+	// template create the realm, instead of being aborted.
+	AddRealmTemplate(RealmTemplate) error
+}
+
+// Shutdowner is implemented by Routers that can end their sessions gracefully.
+// The default router implements it.
+type Shutdowner interface {
+	// Shutdown stops accepting sessions and ends all sessions with a GOODBYE,
+	// waiting for the clients' replies until ctx is done.
+	Shutdown(context.Context) (ShutdownStats, error)
+}
+
 // DefaultRouter is the default WAMP router implementation.
 type defaultRouter struct {
-	realms                cmap.ConcurrentMap
+	realms cmap.ConcurrentMap
+	// realmLock serializes adding and removing realms
+	realmLock             sync.Mutex
+	templates             []RealmTemplate
 	closing               bool
 	closeLock             sync.Mutex
 	sessionOpenCallbacks  []func(uint, string)
 	sessionCloseCallbacks []func(uint, string)
+	// accepting counts the sessions that are being added to their realm
+	accepting sync.WaitGroup
 }
 
 // NewDefaultRouter creates a very basic WAMP router.
@@ -90,18 +108,174 @@ func (r *defaultRouter) Close() error {
 	return nil
 }
 
+// ShutdownStats reports how a router shutdown went.
+type ShutdownStats struct {
+	// Sessions is the number of sessions that were ended.
+	Sessions int
+	// Clean is the number of sessions whose client replied with a GOODBYE
+	// before the deadline.
+	Clean int
+}
+
+// Shutdown stops accepting sessions and sends all sessions a GOODBYE. It waits
+// until every client has replied with a GOODBYE, or has disconnected, and its
+// transport has been flushed and closed, or until ctx is done, in which case
+// it returns ctx.Err(). Calls that are in flight when the GOODBYE is sent can
+// still be answered by their callees while the router waits.
+func (r *defaultRouter) Shutdown(ctx context.Context) (ShutdownStats, error) {
+	r.closeLock.Lock()
+	if r.closing {
+		r.closeLock.Unlock()
+		return ShutdownStats{}, fmt.Errorf("already closed")
+	}
+	r.closing = true
+	r.closeLock.Unlock()
+	// sessions that authenticated before the router started closing join
+	// their realm before its sessions are ended
+	r.accepting.Wait()
+
+	var stats ShutdownStats
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for val := range r.realms.Iter() {
+		realm, ok := val.Val.(*Realm)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sessions, clean := realm.shutdown(ctx)
+			lock.Lock()
+			defer lock.Unlock()
+			stats.Sessions += sessions
+			stats.Clean += clean
+		}()
+	}
+	wg.Wait()
+	log.WithFields(logrus.Fields{
+		"sessions": stats.Sessions,
+		"clean":    stats.Clean,
+	}).Info("router shut down")
+	return stats, ctx.Err()
+}
+
 func (r *defaultRouter) RegisterRealm(uri URI, realm *Realm) error {
+	r.realmLock.Lock()
+	defer r.realmLock.Unlock()
+	return r.registerRealm(uri, realm)
+}
+
+func (r *defaultRouter) registerRealm(uri URI, realm *Realm) error {
 	if _, ok := r.realms.Get(string(uri)); ok {
 		return RealmExistsError(uri)
 	}
+	if realm.URI == "" {
+		realm.URI = uri
+	}
+	if len(realm.Schemas) > 0 {
+		schemas, err := newSchemaValidator(realm.Schemas)
+		if err != nil {
+			return fmt.Errorf("realm %s: %v", uri, err)
+		}
+		realm.schemas = schemas
+	}
 	realm.init()
 	r.realms.Set(string(uri), realm)
 	log.Println("registered realm:", uri)
 	return nil
 }
 
+func (r *defaultRouter) UnregisterRealm(uri URI) error {
+	r.realmLock.Lock()
+	val, ok := r.realms.Get(string(uri))
+	r.realms.Remove(string(uri))
+	r.realmLock.Unlock()
+	realm, isRealm := val.(*Realm)
+	if !ok || !isRealm {
+		return NoSuchRealmError(uri)
+	}
+	// the realm's own session outlives the others to publish their meta events
+	go realm.endSessions(context.Background(), ErrCloseRealm)
+	log.Println("unregistered realm:", uri)
+	return nil
+}
+
+// removeIdleRealm removes a realm created from a template if no client joined
+// it, so that HELLOs that fail to authenticate don't leave realms behind.
+func (r *defaultRouter) removeIdleRealm(uri URI, realm *Realm) {
+	r.realmLock.Lock()
+	defer r.realmLock.Unlock()
+	if val, ok := r.realms.Get(string(uri)); !ok || val != realm || !realm.retire() {
+		return
+	}
+	r.realms.Remove(string(uri))
+	go realm.endSessions(context.Background(), ErrCloseRealm)
+	log.Println("removed idle realm:", uri)
+}
+
+func (r *defaultRouter) AddRealmTemplate(template RealmTemplate) error {
+	if err := template.validate(); err != nil {
+		return err
+	}
+	r.realmLock.Lock()
+	defer r.realmLock.Unlock()
+	r.templates = append(r.templates, template)
+	return nil
+}
+
+// getRealm returns a registered realm, or creates it from the first matching
+// template, for a client that is about to join it. The realm must be released
+// once the client joined it or failed to.
+func (r *defaultRouter) getRealm(uri URI) (*Realm, error) {
+	if val, ok := r.realms.Get(string(uri)); ok {
+		if realm, ok := val.(*Realm); !ok {
+			return nil, NoSuchRealmError(uri)
+		} else if realm.acquire() {
+			return realm, nil
+		}
+		// the realm is being removed; a template may create it again
+	}
+	r.realmLock.Lock()
+	defer r.realmLock.Unlock()
+	// the realm may have been created while waiting for the lock; realms are
+	// only removed while holding it
+	if val, ok := r.realms.Get(string(uri)); ok {
+		if realm, ok := val.(*Realm); ok && realm.acquire() {
+			return realm, nil
+		}
+		return nil, NoSuchRealmError(uri)
+	}
+	for i := range r.templates {
+		if !r.templates[i].matches(uri) {
+			continue
+		}
+		realm, err := r.templates[i].newRealm(uri)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"realm": uri,
+				"error": err,
+			}).Error("error creating realm from template")
+			return nil, NoSuchRealmError(uri)
+		}
+		realm.fromTemplate = true
+		if err := r.registerRealm(uri, realm); err != nil {
+			return nil, err
+		}
+		realm.acquire()
+		return realm, nil
+	}
+	return nil, NoSuchRealmError(uri)
+}
+
+func (r *defaultRouter) isClosing() bool {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	return r.closing
+}
+
 func (r *defaultRouter) Accept(client Peer) error {
-	if r.closing {
+	if r.isClosing() {
 		logErr(client.Send(&Abort{Reason: ErrSystemShutdown}))
 		logErr(client.Close())
 		return fmt.Errorf("Router is closing, no new connections are allowed")
@@ -133,30 +307,49 @@ func (r *defaultRouter) Accept(client Peer) error {
 
 	hello, ok := msg.(*Hello)
 	if !ok {
-		logErr(client.Send(&Abort{Reason: URI("wamp.error.protocol_violation")}))
+		logErr(client.Send(&Abort{
+			Reason:  ErrProtocolViolation,
+			Details: map[string]interface{}{"message": fmt.Sprintf("expected HELLO, received %s", msg.MessageType())},
+		}))
 		logErr(client.Close())
 		return fmt.Errorf("protocol violation: expected HELLO, received %s", msg.MessageType())
 	}
+	// the realm's URI check mode isn't known before the realm is looked up
+	if err := checkURI(URICheckLoose, hello.Realm, false); err != nil {
+		logErr(client.Send(&Abort{
+			Reason:  ErrProtocolViolation,
+			Details: map[string]interface{}{"message": fmt.Sprintf("invalid realm: %v", err)},
+		}))
+		logErr(client.Close())
+		return fmt.Errorf("protocol violation: %v", err)
+	}
 
-	var realm *Realm
-	if val, ok := r.realms.Get(string(hello.Realm)); ok {
-		if realm, ok = val.(*Realm); !ok {
-			logErr(client.Send(&Abort{Reason: ErrNoSuchRealm}))
-			logErr(client.Close())
-			return NoSuchRealmError(hello.Realm)
-		}
-	} else {
+	realm, err := r.getRealm(hello.Realm)
+	if err != nil {
 		logErr(client.Send(&Abort{Reason: ErrNoSuchRealm}))
 		logErr(client.Close())
-		return NoSuchRealmError(hello.Realm)
+		return err
 	}
 
-	welcome, err := realm.handleAuth(client, hello.Details)
+	welcome, err := realm.handleAuth(client, sessionID, hello.Details)
 	if err != nil {
+		realm.release()
+		if realm.fromTemplate {
+			r.removeIdleRealm(hello.Realm, realm)
+		}
 		abort := &Abort{
 			Reason:  ErrAuthorizationFailed, // TODO: should this be AuthenticationFailed?
 			Details: map[string]interface{}{"error": err.Error()},
 		}
+		var failure *AuthFailure
+		if errors.As(err, &failure) {
+			if failure.Reason != "" {
+				abort.Reason = failure.Reason
+			}
+			for k, v := range failure.Details {
+				abort.Details[k] = v
+			}
+		}
 		logErr(client.Send(abort))
 		logErr(client.Close())
 
@@ -168,16 +361,34 @@ func (r *defaultRouter) Accept(client Peer) error {
 		return AuthenticationError(err.Error())
 	}
 
+	// the session joins the realm before it is released
+	defer realm.release()
+
+	r.closeLock.Lock()
+	if r.closing {
+		r.closeLock.Unlock()
+		logErr(client.Send(&Abort{Reason: ErrSystemShutdown}))
+		logErr(client.Close())
+		return fmt.Errorf("Router is closing, no new connections are allowed")
+	}
+	r.accepting.Add(1)
+	r.closeLock.Unlock()
+	defer r.accepting.Done()
+
 	welcome.Id = sessionID
 
 	if welcome.Details == nil {
 		welcome.Details = make(map[string]interface{})
 	}
-	// add default details to welcome message
-	for k, v := range defaultWelcomeDetails {
-		if _, ok := welcome.Details[k]; !ok {
-			welcome.Details[k] = v
-		}
+	// the expiry of the session's credentials is for the router only
+	expires, _ := welcome.Details[AuthExpiresDetail].(time.Time)
+	delete(welcome.Details, AuthExpiresDetail)
+	// announce the router's roles and features, unless the authenticator did
+	if _, ok := welcome.Details["roles"]; !ok {
+		welcome.Details["roles"] = realm.welcomeRoles()
+	}
+	if _, ok := welcome.Details["agent"]; !ok {
+		welcome.Details["agent"] = RouterAgent
 	}
 	if err := client.Send(welcome); err != nil {
 		return err
@@ -194,18 +405,17 @@ func (r *defaultRouter) Accept(client Peer) error {
 	}
 	sessionDetails["session"] = welcome.Id
 	sessionDetails["realm"] = hello.Realm
-	sess := &Session{
-		Peer:    client,
-		Id:      welcome.Id,
-		Details: sessionDetails,
-		kill:    make(chan URI, 1),
+	sess := newSession(client, welcome.Id, sessionDetails)
+	sess.AuthExpires = expires
+	if t, ok := client.(TransportPeer); ok {
+		sess.Transport = t.TransportInfo()
 	}
 	for _, callback := range r.sessionOpenCallbacks {
 		go callback(uint(sess.Id), string(hello.Realm))
 	}
+	realm.join(sess)
 	go func() {
-		realm.handleSession(sess)
-		sess.Close()
+		realm.serve(sess)
 		for _, callback := range r.sessionCloseCallbacks {
 			go callback(uint(sess.Id), string(hello.Realm))
 		}
@@ -213,15 +423,26 @@ func (r *defaultRouter) Accept(client Peer) error {
 	return nil
 }
 
-// GetLocalPeer returns an internal peer connected to the specified realm.
+// GetLocalPeer returns an internal peer connected to the specified realm. Its
+// session has the realm's TrustedAuthRole, and the authid given in details, if
+// any.
 func (r *defaultRouter) GetLocalPeer(realmURI URI, details map[string]interface{}) (Peer, error) {
 	if val, ok := r.realms.Get(string(realmURI)); !ok {
 		return nil, NoSuchRealmError(realmURI)
 	} else if realm, ok := val.(*Realm); !ok {
 		return nil, NoSuchRealmError(realmURI)
 	} else {
-		// TODO: session open/close callbacks?
-		return realm.getPeer(details)
+		peer, sess := realm.getLocalSession(details)
+		for _, callback := range r.sessionOpenCallbacks {
+			go callback(uint(sess.Id), string(realmURI))
+		}
+		go func() {
+			<-sess.done
+			for _, callback := range r.sessionCloseCallbacks {
+				go callback(uint(sess.Id), string(realmURI))
+			}
+		}()
+		return peer, nil
 	}
 }
 
@@ -1,6 +1,7 @@
 package turnpike
 
 import (
+	"context"
 	"testing"
 	"time"
 )
@@ -254,3 +255,210 @@ func TestRouterCall(t *testing.T) {
 		}
 	}
 }
+
+func TestShutdown(t *testing.T) {
+	r := NewDefaultRouter().(*defaultRouter)
+	r.RegisterRealm(URI("turnpike.test"), &Realm{})
+
+	// a client that replies to the router's GOODBYE
+	polite := NewClient(r.getTestPeer())
+	if _, err := polite.JoinRealm("turnpike.test", nil); err != nil {
+		t.Fatal(err)
+	}
+	// and one that doesn't
+	rude, server := localPipe()
+	rude.Send(&Hello{Realm: "turnpike.test"})
+	if err := r.Accept(server); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	stats, err := r.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+	if stats.Sessions != 2 || stats.Clean != 1 {
+		t.Errorf("expected 1 of 2 sessions to close cleanly, got %+v", stats)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %s", elapsed)
+	}
+
+	if msg := <-rude.incoming; msg.MessageType() != WELCOME {
+		t.Fatalf("expected WELCOME, received %s", msg.MessageType())
+	}
+	if msg, ok := (<-rude.incoming).(*Goodbye); !ok || msg.Reason != ErrSystemShutdown {
+		t.Errorf("expected GOODBYE with system_shutdown, received %v", msg)
+	}
+
+	c, server := localPipe()
+	c.Send(&Hello{Realm: "turnpike.test"})
+	if err := r.Accept(server); err == nil {
+		t.Error("expected sessions to be refused after shutdown")
+	}
+}
+
+type blockingAuthenticator struct {
+	entered, release chan struct{}
+}
+
+func (a *blockingAuthenticator) Authenticate(details map[string]interface{}) (map[string]interface{}, error) {
+	close(a.entered)
+	<-a.release
+	return nil, nil
+}
+
+func TestShutdownDuringAuthentication(t *testing.T) {
+	r := NewDefaultRouter().(*defaultRouter)
+	auth := &blockingAuthenticator{entered: make(chan struct{}), release: make(chan struct{})}
+	r.RegisterRealm(URI("turnpike.test"), &Realm{DefaultAuthenticator: auth})
+
+	client, server := localPipe()
+	client.Send(&Hello{Realm: "turnpike.test"})
+	accepted := make(chan error, 1)
+	go func() { accepted <- r.Accept(server) }()
+	<-auth.entered
+
+	shutdown := make(chan ShutdownStats, 1)
+	go func() {
+		stats, _ := r.Shutdown(context.Background())
+		shutdown <- stats
+	}()
+	for !r.isClosing() {
+		time.Sleep(time.Millisecond)
+	}
+	close(auth.release)
+
+	if err := <-accepted; err == nil {
+		t.Error("expected a session that authenticated during the shutdown to be refused")
+	}
+	if msg, ok := (<-client.incoming).(*Abort); !ok || msg.Reason != ErrSystemShutdown {
+		t.Errorf("expected ABORT with system_shutdown, received %v", msg)
+	}
+	if stats := <-shutdown; stats.Sessions != 0 {
+		t.Errorf("expected no sessions, got %+v", stats)
+	}
+}
+
+func TestShutdownInFlightCallMiddleware(t *testing.T) {
+	r := NewDefaultRouter().(*defaultRouter)
+	rejected := URI("com.example.rejected")
+	r.RegisterRealm(URI("turnpike.test"), &Realm{Middleware: []Middleware{
+		InboundFunc(func(sess *Session, msg Message) (Message, error) {
+			if _, ok := msg.(*Yield); ok {
+				return nil, &RejectError{Reason: rejected}
+			}
+			return msg, nil
+		}),
+	}})
+	join := func() *localPeer {
+		client, server := localPipe()
+		client.Send(&Hello{Realm: "turnpike.test"})
+		if err := r.Accept(server); err != nil {
+			t.Fatal(err)
+		}
+		<-client.incoming
+		return client
+	}
+	callee, caller := join(), join()
+	callee.Send(&Register{Request: 1, Procedure: "com.example.slow", Options: map[string]interface{}{}})
+	<-callee.incoming
+	caller.Send(&Call{Request: 1, Procedure: "com.example.slow", Options: map[string]interface{}{}})
+	invocation, ok := (<-callee.incoming).(*Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go r.Shutdown(ctx)
+	<-callee.incoming
+	<-caller.incoming
+	callee.Send(&Yield{Request: invocation.Request, Options: map[string]interface{}{}})
+	select {
+	case msg := <-caller.incoming:
+		if msg, ok := msg.(*Error); !ok || msg.Error != rejected {
+			t.Errorf("expected the rejected YIELD to fail the call, received %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("no answer to the call")
+	}
+}
+
+func TestShutdownClean(t *testing.T) {
+	r := NewDefaultRouter().(*defaultRouter)
+	r.RegisterRealm(URI("turnpike.test"), &Realm{})
+	for i := 0; i < 3; i++ {
+		client := NewClient(r.getTestPeer())
+		if _, err := client.JoinRealm("turnpike.test", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stats, err := r.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Sessions != 3 || stats.Clean != 3 {
+		t.Errorf("expected all 3 sessions to close cleanly, got %+v", stats)
+	}
+}
+
+func TestLocalPeer(t *testing.T) {
+	r := NewDefaultRouter().(*defaultRouter)
+	defer r.Close()
+	r.RegisterRealm(URI("turnpike.test"), &Realm{TrustedAuthRole: "system"})
+	opened := make(chan uint, 1)
+	closed := make(chan uint, 1)
+	r.AddSessionOpenCallback(func(id uint, realm string) { opened <- id })
+	r.AddSessionCloseCallback(func(id uint, realm string) { closed <- id })
+
+	observer := NewClient(r.getTestPeer())
+	if _, err := observer.JoinRealm("turnpike.test", nil); err != nil {
+		t.Fatal(err)
+	}
+	<-opened
+	joins := make(chan map[string]interface{}, 1)
+	observer.Subscribe("wamp.session.on_join", nil, func(args []interface{}, kwargs map[string]interface{}) {
+		// the observer may still see the event of its own join
+		if details := args[0].(map[string]interface{}); details["authid"] != "" {
+			joins <- details
+		}
+	})
+
+	peer, err := r.GetLocalPeer("turnpike.test", map[string]interface{}{"authid": "scheduler"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id uint
+	select {
+	case id = <-opened:
+	case <-time.After(time.Second):
+		t.Fatal("open callback was not called")
+	}
+	select {
+	case details := <-joins:
+		if details["authid"] != "scheduler" || details["authrole"] != "system" || details["authmethod"] != "trusted" {
+			t.Errorf("unexpected on_join details: %v", details)
+		}
+		if details["session"] != ID(id) {
+			t.Errorf("on_join session %v doesn't match the callback's %d", details["session"], id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no on_join event for the local session")
+	}
+
+	peer.Close()
+	select {
+	case closedID := <-closed:
+		if closedID != id {
+			t.Errorf("close callback for session %d, expected %d", closedID, id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close callback was not called")
+	}
+}
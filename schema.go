@@ -0,0 +1,443 @@
+package turnpike
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+)
+
+// Schema meta procedures, registered on realms with Schemas.
+const (
+	// Returns the schema documents of the realm.
+	MetaSchemaList = "turnpike.schema.list"
+	// Returns the schema documents that apply to the URI given as argument, as
+	// a dict with the keys "procedure" and "topic"; either may be null.
+	MetaSchemaGet = "turnpike.schema.get"
+)
+
+// Schema is a JSON Schema. Only a subset of the keywords is supported: type,
+// enum, properties, required, additionalProperties (as boolean), items,
+// minItems, maxItems, minimum, maximum, minLength, maxLength and pattern.
+// Other keywords are ignored.
+type Schema struct {
+	Type                 SchemaType         `json:"type,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+}
+
+// SchemaType lists the JSON types a value may have: "null", "boolean",
+// "object", "array", "number", "integer" or "string". In JSON it is either a
+// single type or a list of types.
+type SchemaType []string
+
+func (t *SchemaType) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*t = SchemaType{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings")
+	}
+	*t = list
+	return nil
+}
+
+func (t SchemaType) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+// URISchema attaches payload schemas to the procedures or the topics that match
+// a URI pattern. When several patterns match a URI, the most specific one
+// applies, as with permissions.
+type URISchema struct {
+	// Procedure or Topic is the pattern; exactly one of them must be set.
+	Procedure string `json:"procedure,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	// Match is the match policy of the pattern; it defaults to MatchExact.
+	Match string `json:"match,omitempty"`
+	// Args validates the positional arguments, as an array, and Kwargs the
+	// keyword arguments, as an object, of CALLs to the procedures or of
+	// PUBLISHes to the topics.
+	Args   *Schema `json:"args,omitempty"`
+	Kwargs *Schema `json:"kwargs,omitempty"`
+	// ResultArgs and ResultKwargs validate the payload the procedures' callees
+	// YIELD. Invalid results fail the call, and the callee is sent an ERROR
+	// for its YIELD.
+	ResultArgs   *Schema `json:"result_args,omitempty"`
+	ResultKwargs *Schema `json:"result_kwargs,omitempty"`
+}
+
+func (s *URISchema) pattern() string {
+	if s.Procedure != "" {
+		return s.Procedure
+	}
+	return s.Topic
+}
+
+func (s *URISchema) hasResult() bool {
+	return s.ResultArgs != nil || s.ResultKwargs != nil
+}
+
+// document returns the schema as a dict, as returned by the meta procedures.
+func (s *URISchema) document() map[string]interface{} {
+	var doc map[string]interface{}
+	b, _ := json.Marshal(s)
+	json.Unmarshal(b, &doc)
+	return doc
+}
+
+// LoadSchemas reads the schema documents in the .json files of a directory.
+// Each file holds one URISchema:
+//
+//	{"procedure": "com.example.lights.set", "kwargs": {"type": "object",
+//	 "properties": {"level": {"type": "integer", "minimum": 0, "maximum": 100}},
+//	 "required": ["level"]}}
+func LoadSchemas(dir string) ([]URISchema, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	schemas := make([]URISchema, 0, len(paths))
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var s URISchema
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, fmt.Errorf("error parsing schema file %s: %v", path, err)
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas, nil
+}
+
+// schemaValidator is the Middleware that validates payloads against a realm's
+// schemas.
+type schemaValidator struct {
+	schemas  []URISchema
+	patterns map[string]*regexp.Regexp
+	// invocations tells the procedures of YIELDs, if the realm's dealer can
+	invocations InvocationLookup
+}
+
+func newSchemaValidator(schemas []URISchema) (*schemaValidator, error) {
+	v := &schemaValidator{
+		schemas:  schemas,
+		patterns: make(map[string]*regexp.Regexp),
+	}
+	for _, s := range schemas {
+		if (s.Procedure == "") == (s.Topic == "") {
+			return nil, fmt.Errorf("schema must have either a procedure or a topic: %+v", s)
+		}
+		switch s.Match {
+		case "", MatchExact, MatchPrefix, MatchWildcard:
+		default:
+			return nil, fmt.Errorf("invalid match policy for schema %s: %s", s.pattern(), s.Match)
+		}
+		for _, schema := range []*Schema{s.Args, s.Kwargs, s.ResultArgs, s.ResultKwargs} {
+			if err := v.compile(schema); err != nil {
+				return nil, fmt.Errorf("invalid schema for %s: %v", s.pattern(), err)
+			}
+		}
+	}
+	return v, nil
+}
+
+// compile checks a schema and compiles its patterns.
+func (v *schemaValidator) compile(s *Schema) error {
+	if s == nil {
+		return nil
+	}
+	for _, t := range s.Type {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return fmt.Errorf("unknown type: %s", t)
+		}
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+		v.patterns[s.Pattern] = re
+	}
+	for _, p := range s.Properties {
+		if err := v.compile(p); err != nil {
+			return err
+		}
+	}
+	return v.compile(s.Items)
+}
+
+// lookup returns the most specific schema for a procedure or a topic, or nil
+// if there is none.
+func (v *schemaValidator) lookup(uri URI, procedure bool) *URISchema {
+	var best *URISchema
+	var bestClass, bestLen int
+	for i, s := range v.schemas {
+		if (s.Procedure != "") != procedure || !matchURI(s.Match, s.pattern(), uri) {
+			continue
+		}
+		class, length := specificity(s.Match, s.pattern())
+		if best == nil || class > bestClass || (class == bestClass && length > bestLen) {
+			best = &v.schemas[i]
+			bestClass, bestLen = class, length
+		}
+	}
+	return best
+}
+
+// validatePayload returns the validation errors of a message payload.
+func (v *schemaValidator) validatePayload(argsSchema, kwargsSchema *Schema, args []interface{}, kwargs map[string]interface{}) []interface{} {
+	var errs []string
+	if argsSchema != nil {
+		if args == nil {
+			args = []interface{}{}
+		}
+		v.validate(argsSchema, "args", args, &errs)
+	}
+	if kwargsSchema != nil {
+		if kwargs == nil {
+			kwargs = map[string]interface{}{}
+		}
+		v.validate(kwargsSchema, "kwargs", kwargs, &errs)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	list := make([]interface{}, len(errs))
+	for i, err := range errs {
+		list[i] = err
+	}
+	return list
+}
+
+func (v *schemaValidator) Inbound(sess *Session, msg Message) (Message, error) {
+	switch msg := msg.(type) {
+	case *Call:
+		s := v.lookup(msg.Procedure, true)
+		if s == nil {
+			break
+		}
+		if errs := v.validatePayload(s.Args, s.Kwargs, msg.Arguments, msg.ArgumentsKw); errs != nil {
+			return nil, &RejectError{Reason: ErrInvalidArgument, Arguments: errs}
+		}
+	case *Yield:
+		if v.invocations == nil {
+			break
+		}
+		procedure, ok := v.invocations.InvokedProcedure(sess, msg.Request)
+		if !ok {
+			break
+		}
+		if s := v.lookup(procedure, true); s != nil && s.hasResult() {
+			if errs := v.validatePayload(s.ResultArgs, s.ResultKwargs, msg.Arguments, msg.ArgumentsKw); errs != nil {
+				return nil, &RejectError{Reason: ErrInvalidArgument, Arguments: errs}
+			}
+		}
+	case *Publish:
+		if s := v.lookup(msg.Topic, false); s != nil {
+			if errs := v.validatePayload(s.Args, s.Kwargs, msg.Arguments, msg.ArgumentsKw); errs != nil {
+				return nil, &RejectError{Reason: ErrInvalidArgument, Arguments: errs}
+			}
+		}
+	}
+	return msg, nil
+}
+
+func (v *schemaValidator) Outbound(sess *Session, msg Message) (Message, error) {
+	return msg, nil
+}
+
+// validate appends the errors of a value that doesn't conform to a schema,
+// prefixed with the value's path.
+func (v *schemaValidator) validate(s *Schema, path string, value interface{}, errs *[]string) {
+	if s == nil {
+		return
+	}
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, path+": "+fmt.Sprintf(format, args...))
+	}
+	if len(s.Type) > 0 && !hasSchemaType(s.Type, value) {
+		fail("must be of type %s", joinTypes(s.Type))
+		return
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if equalJSON(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %v", s.Enum)
+		}
+	}
+	if n, ok := toFloat64(value); ok {
+		if s.Minimum != nil && n < *s.Minimum {
+			fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			fail("must be at most %v", *s.Maximum)
+		}
+	}
+	if str, ok := value.(string); ok {
+		length := len([]rune(str))
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("must be at most %d characters long", *s.MaxLength)
+		}
+		if re := v.patterns[s.Pattern]; re != nil && !re.MatchString(str) {
+			fail("must match %s", s.Pattern)
+		}
+	}
+	if list, ok := value.([]interface{}); ok {
+		if s.MinItems != nil && len(list) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(list) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range list {
+				v.validate(s.Items, fmt.Sprintf("%s[%d]", path, i), item, errs)
+			}
+		}
+	}
+	if obj, ok := toStringMap(value); ok {
+		for _, key := range s.Required {
+			if _, ok := obj[key]; !ok {
+				fail("missing required property %s", key)
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if p, ok := s.Properties[key]; ok {
+				v.validate(p, path+"."+key, obj[key], errs)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				fail("unexpected property %s", key)
+			}
+		}
+	}
+}
+
+func hasSchemaType(types SchemaType, value interface{}) bool {
+	for _, t := range types {
+		switch t {
+		case "null":
+			if value == nil {
+				return true
+			}
+		case "boolean":
+			if _, ok := value.(bool); ok {
+				return true
+			}
+		case "object":
+			if _, ok := toStringMap(value); ok {
+				return true
+			}
+		case "array":
+			if _, ok := value.([]interface{}); ok {
+				return true
+			}
+		case "number":
+			if _, ok := toFloat64(value); ok {
+				return true
+			}
+		case "integer":
+			if n, ok := toFloat64(value); ok && n == math.Trunc(n) {
+				return true
+			}
+		case "string":
+			if _, ok := value.(string); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func joinTypes(types SchemaType) string {
+	if len(types) == 1 {
+		return types[0]
+	}
+	return fmt.Sprintf("%v", []string(types))
+}
+
+// toFloat64 converts a number as decoded by one of the serializers to a
+// float64.
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	}
+	if n, ok := toInt64(v); ok {
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// equalJSON compares two values as decoded by the serializers, regardless of
+// their numeric types.
+func equalJSON(a, b interface{}) bool {
+	if x, ok := toFloat64(a); ok {
+		y, ok := toFloat64(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func (r *Realm) schemaList(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	docs := make([]interface{}, len(r.schemas.schemas))
+	for i := range r.schemas.schemas {
+		docs[i] = r.schemas.schemas[i].document()
+	}
+	return &CallResult{Args: []interface{}{docs}}
+}
+
+func (r *Realm) schemaGet(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	uri, _ := argString(args)
+	if uri == "" {
+		return invalidArgument(fmt.Errorf("expected [uri]"))
+	}
+	result := map[string]interface{}{"procedure": nil, "topic": nil}
+	if s := r.schemas.lookup(URI(uri), true); s != nil {
+		result["procedure"] = s.document()
+	}
+	if s := r.schemas.lookup(URI(uri), false); s != nil {
+		result["topic"] = s.document()
+	}
+	return &CallResult{Args: []interface{}{result}}
+}
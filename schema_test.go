@@ -0,0 +1,139 @@
+package turnpike
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const lightSchema = `{
+	"procedure": "com.example.lights.set",
+	"kwargs": {
+		"type": "object",
+		"properties": {
+			"level": {"type": "integer", "minimum": 0, "maximum": 100},
+			"room": {"type": "string", "pattern": "^[a-z]+$"}
+		},
+		"required": ["level"],
+		"additionalProperties": false
+	},
+	"result_args": {"type": "array", "items": {"type": "string", "enum": ["on", "off"]}}
+}`
+
+const statusSchema = `{
+	"topic": "com.example.lights.",
+	"match": "prefix",
+	"args": {"type": "array", "minItems": 1, "items": {"type": ["string", "null"]}}
+}`
+
+func TestSchemaValidation(t *testing.T) {
+	Convey("Given a realm with schemas loaded from a directory", t, func() {
+		dir, err := ioutil.TempDir("", "schemas")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		So(ioutil.WriteFile(filepath.Join(dir, "light.json"), []byte(lightSchema), 0600), ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(dir, "status.json"), []byte(statusSchema), 0600), ShouldBeNil)
+		schemas, err := LoadSchemas(dir)
+		So(err, ShouldBeNil)
+		So(schemas, ShouldHaveLength, 2)
+
+		router := NewDefaultRouter().(*defaultRouter)
+		defer router.Close()
+		So(router.RegisterRealm(testRealm, &Realm{Schemas: schemas}), ShouldBeNil)
+		join := func() *Client {
+			client := NewClient(router.getTestPeer())
+			client.ReceiveTimeout = time.Second
+			_, err := client.JoinRealm(string(testRealm), nil)
+			So(err, ShouldBeNil)
+			return client
+		}
+		caller, callee := join(), join()
+		state := "on"
+		So(callee.BasicRegister("com.example.lights.set", func(args []interface{}, kwargs map[string]interface{}) *CallResult {
+			return &CallResult{Args: []interface{}{state}}
+		}), ShouldBeNil)
+
+		Convey("Valid calls should reach the callee", func() {
+			res, err := caller.Call("com.example.lights.set", nil, nil, map[string]interface{}{"level": 50, "room": "hall"})
+			So(err, ShouldBeNil)
+			So(res.Arguments, ShouldResemble, []interface{}{"on"})
+		})
+
+		Convey("Invalid calls should fail with the validation errors", func() {
+			_, err := caller.Call("com.example.lights.set", nil, nil, map[string]interface{}{"level": 150, "room": "Hall", "color": "red"})
+			So(err, ShouldNotBeNil)
+			msg := err.(RPCError).ErrorMessage
+			So(msg.Error, ShouldEqual, ErrInvalidArgument)
+			So(msg.Arguments, ShouldResemble, []interface{}{
+				"kwargs: unexpected property color",
+				"kwargs.level: must be at most 100",
+				"kwargs.room: must match ^[a-z]+$",
+			})
+
+			_, err = caller.Call("com.example.lights.set", nil, nil, nil)
+			So(err.(RPCError).ErrorMessage.Arguments, ShouldResemble, []interface{}{"kwargs: missing required property level"})
+		})
+
+		Convey("Invalid results should not reach the caller", func() {
+			state = "dimmed"
+			_, err := caller.Call("com.example.lights.set", nil, nil, map[string]interface{}{"level": 50})
+			So(err, ShouldNotBeNil)
+			So(err.(RPCError).ErrorMessage.Arguments, ShouldResemble, []interface{}{"args[0]: must be one of [on off]"})
+		})
+
+		Convey("The callee of an invalid result should be sent an ERROR for its YIELD", func() {
+			// the realm's procedure is already registered by a Client
+			So(router.RegisterRealm("test.schemas", &Realm{Schemas: schemas}), ShouldBeNil)
+			rawCallee, rawCaller := joinRaw(router, "test.schemas"), joinRaw(router, "test.schemas")
+			rawCallee.Send(&Register{Request: 1, Procedure: "com.example.lights.set", Options: map[string]interface{}{}})
+			So((<-rawCallee.incoming).MessageType(), ShouldEqual, REGISTERED)
+			rawCaller.Send(&Call{Request: 1, Procedure: "com.example.lights.set", Options: map[string]interface{}{},
+				ArgumentsKw: map[string]interface{}{"level": 50}})
+			invocation := (<-rawCallee.incoming).(*Invocation)
+			rawCallee.Send(&Yield{Request: invocation.Request, Options: map[string]interface{}{}, Arguments: []interface{}{"dimmed"}})
+
+			rejected := (<-rawCallee.incoming).(*Error)
+			So(rejected.Type, ShouldEqual, YIELD)
+			So(rejected.Request, ShouldEqual, invocation.Request)
+			So(rejected.Error, ShouldEqual, ErrInvalidArgument)
+			failed := (<-rawCaller.incoming).(*Error)
+			So(failed.Type, ShouldEqual, CALL)
+			So(failed.Error, ShouldEqual, ErrInvalidArgument)
+		})
+
+		Convey("Invalid publications should not be delivered", func() {
+			events := make(chan []interface{}, 2)
+			So(callee.Subscribe("com.example.lights.status", nil, func(args []interface{}, kwargs map[string]interface{}) {
+				events <- args
+			}), ShouldBeNil)
+			So(caller.Publish("com.example.lights.status", nil, []interface{}{1}, nil), ShouldBeNil)
+			So(caller.Publish("com.example.lights.status", nil, []interface{}{"ok"}, nil), ShouldBeNil)
+			So(<-events, ShouldResemble, []interface{}{"ok"})
+		})
+
+		Convey("Schemas should be queryable through the meta procedures", func() {
+			res, err := caller.Call(MetaSchemaGet, nil, []interface{}{"com.example.lights.set"}, nil)
+			So(err, ShouldBeNil)
+			docs := res.Arguments[0].(map[string]interface{})
+			So(docs["procedure"].(map[string]interface{})["procedure"], ShouldEqual, "com.example.lights.set")
+			So(docs["topic"].(map[string]interface{})["topic"], ShouldEqual, "com.example.lights.")
+
+			res, err = caller.Call(MetaSchemaList, nil, nil, nil)
+			So(err, ShouldBeNil)
+			So(res.Arguments[0], ShouldHaveLength, 2)
+		})
+	})
+
+	Convey("Realms with invalid schemas should not be registered", t, func() {
+		router := NewDefaultRouter()
+		defer router.Close()
+		err := router.RegisterRealm(testRealm, &Realm{Schemas: []URISchema{
+			{Procedure: "com.example.proc", Args: &Schema{Type: SchemaType{"list"}}},
+		}})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -2,6 +2,7 @@ package turnpike
 
 import (
 	"fmt"
+	"time"
 )
 
 const (
@@ -13,9 +14,65 @@ type Session struct {
 	Peer
 	Id      ID
 	Details map[string]interface{}
+	// AuthID, AuthRole, AuthMethod and AuthProvider are the identity the
+	// session authenticated with, as sent in its WELCOME details.
+	AuthID       string
+	AuthRole     string
+	AuthMethod   string
+	AuthProvider string
+	// JoinedAt is when the session joined its realm.
+	JoinedAt time.Time
+	// Transport describes the transport the session is connected over, if the
+	// peer knows it.
+	Transport *TransportInfo
+	// AuthExpires is when the credentials the session authenticated with
+	// expire, if they do. The session is killed at that time.
+	AuthExpires time.Time
 
 	lastRequestId ID
 	kill          chan URI
+	// goodbyeSent is set when the router ends the session, and cleanClose if
+	// the client then replied with a GOODBYE.
+	goodbyeSent bool
+	cleanClose  bool
+	// done is closed once the session has ended and its peer is closed.
+	done chan struct{}
+}
+
+// newSession returns a session that joined a realm with the given details,
+// taking its identity from them.
+func newSession(peer Peer, id ID, details map[string]interface{}) *Session {
+	sess := &Session{
+		Peer:     peer,
+		Id:       id,
+		Details:  details,
+		JoinedAt: time.Now(),
+		kill:     make(chan URI, 1),
+		done:     make(chan struct{}),
+	}
+	sess.AuthID, _ = details["authid"].(string)
+	sess.AuthRole, _ = details["authrole"].(string)
+	sess.AuthMethod, _ = details["authmethod"].(string)
+	sess.AuthProvider, _ = details["authprovider"].(string)
+	return sess
+}
+
+// metaDetails returns the session details published in wamp.session.on_join
+// events and returned by wamp.session.get. Of the transport, only the remote
+// address is disclosed, since headers and cookies may hold credentials.
+func (s *Session) metaDetails() map[string]interface{} {
+	details := map[string]interface{}{
+		"session":      s.Id,
+		"authid":       s.AuthID,
+		"authrole":     s.AuthRole,
+		"authmethod":   s.AuthMethod,
+		"authprovider": s.AuthProvider,
+		"joined_at":    s.JoinedAt.UTC().Format(time.RFC3339),
+	}
+	if s.Transport != nil {
+		details["transport"] = map[string]interface{}{"remote_addr": s.Transport.RemoteAddr}
+	}
+	return details
 }
 
 func (s Session) String() string {
@@ -0,0 +1,207 @@
+package turnpike
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Session meta procedures registered on every realm.
+const (
+	// Returns the number of sessions joined to the realm, optionally only
+	// those with one of the authroles given as list argument.
+	MetaSessionCount = "wamp.session.count"
+	// Returns the IDs of the sessions joined to the realm, optionally only
+	// those with one of the authroles given as list argument.
+	MetaSessionList = "wamp.session.list"
+	// Returns the details of the session with the given ID.
+	MetaSessionGet = "wamp.session.get"
+	// Kills the session with the given ID. The GOODBYE reason can be given as
+	// "reason" keyword argument; it defaults to wamp.close.killed.
+	MetaSessionKill = "wamp.session.kill"
+	// Kills the sessions with the given authid and returns their IDs.
+	MetaSessionKillByAuthID = "wamp.session.kill_by_authid"
+	// Kills the sessions with the given authrole and returns their number.
+	MetaSessionKillByAuthRole = "wamp.session.kill_by_authrole"
+)
+
+// isSessionKillProcedure reports whether procedure is one of the meta
+// procedures that kill sessions.
+func isSessionKillProcedure(procedure URI) bool {
+	switch procedure {
+	case MetaSessionKill, MetaSessionKillByAuthID, MetaSessionKillByAuthRole:
+		return true
+	}
+	return false
+}
+
+// mayKillSessions reports whether a session is allowed to call the meta
+// procedures that kill sessions.
+func (r *Realm) mayKillSessions(sess *Session) bool {
+	return sess.AuthRole != "" && hasAuthRole(r.SessionKillRoles)(sess)
+}
+
+// notCaller wraps a matcher of a kill procedure so that it never matches the
+// session that called the procedure.
+func notCaller(match func(*Session) bool, details map[string]interface{}) func(*Session) bool {
+	caller, _ := toInt64(details["caller"])
+	return func(sess *Session) bool {
+		return sess.Id != ID(caller) && match(sess)
+	}
+}
+
+// sessions returns the sessions joined to the realm that match, ordered by ID.
+// The realm's own internal session is left out.
+func (r *Realm) sessions(match func(*Session) bool) []*Session {
+	var sessions []*Session
+	for client := range r.clients.Iter() {
+		sess, isSession := client.Val.(*Session)
+		if !isSession || (r.localClient != nil && sess == r.localClient.session) {
+			continue
+		}
+		if match == nil || match(sess) {
+			sessions = append(sessions, sess)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Id < sessions[j].Id })
+	return sessions
+}
+
+// killSessions disconnects the sessions that match with a goodbye message
+// carrying reason, and returns their IDs.
+func (r *Realm) killSessions(match func(*Session) bool, reason URI) []ID {
+	ids := []ID{}
+	for _, sess := range r.sessions(match) {
+		// a session that is already being killed keeps its first reason
+		select {
+		case sess.kill <- reason:
+		default:
+		}
+		ids = append(ids, sess.Id)
+	}
+	return ids
+}
+
+func hasAuthRole(authroles []string) func(*Session) bool {
+	return func(sess *Session) bool {
+		for _, role := range authroles {
+			if role == sess.AuthRole {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// authroleFilter returns a matcher for the optional filter_authroles argument
+// of wamp.session.count and wamp.session.list.
+func authroleFilter(args []interface{}) (func(*Session) bool, error) {
+	if len(args) == 0 || args[0] == nil {
+		return nil, nil
+	}
+	list, ok := args[0].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("filter_authroles must be a list of authroles")
+	}
+	authroles := make([]string, 0, len(list))
+	for _, v := range list {
+		role, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("filter_authroles must be a list of authroles")
+		}
+		authroles = append(authroles, role)
+	}
+	return hasAuthRole(authroles), nil
+}
+
+// killReason returns the GOODBYE reason passed to a kill procedure.
+func killReason(kwargs map[string]interface{}) URI {
+	if reason, ok := kwargs["reason"].(string); ok && reason != "" {
+		return URI(reason)
+	}
+	return ErrSessionKilled
+}
+
+func invalidArgument(err error) *CallResult {
+	return &CallResult{Err: ErrInvalidArgument, Args: []interface{}{err.Error()}}
+}
+
+func (r *Realm) sessionCount(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	match, err := authroleFilter(args)
+	if err != nil {
+		return invalidArgument(err)
+	}
+	return &CallResult{Args: []interface{}{len(r.sessions(match))}}
+}
+
+func (r *Realm) sessionList(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	match, err := authroleFilter(args)
+	if err != nil {
+		return invalidArgument(err)
+	}
+	ids := []interface{}{}
+	for _, sess := range r.sessions(match) {
+		ids = append(ids, sess.Id)
+	}
+	return &CallResult{Args: []interface{}{ids}}
+}
+
+func (r *Realm) sessionGet(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	if len(args) != 1 {
+		return invalidArgument(fmt.Errorf("expected [session]"))
+	}
+	id, ok := toInt64(args[0])
+	if !ok {
+		return invalidArgument(fmt.Errorf("session must be an ID"))
+	}
+	sessions := r.sessions(func(sess *Session) bool { return sess.Id == ID(id) })
+	if len(sessions) == 0 {
+		return &CallResult{Err: ErrNoSuchSession}
+	}
+	return &CallResult{Args: []interface{}{sessions[0].metaDetails()}}
+}
+
+func (r *Realm) sessionKill(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	if len(args) != 1 {
+		return invalidArgument(fmt.Errorf("expected [session]"))
+	}
+	id, ok := toInt64(args[0])
+	if !ok {
+		return invalidArgument(fmt.Errorf("session must be an ID"))
+	}
+	killed := r.killSessions(func(sess *Session) bool { return sess.Id == ID(id) }, killReason(kwargs))
+	if len(killed) == 0 {
+		return &CallResult{Err: ErrNoSuchSession}
+	}
+	return &CallResult{}
+}
+
+func (r *Realm) sessionKillByAuthID(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	authid, _ := argString(args)
+	if authid == "" {
+		return invalidArgument(fmt.Errorf("expected [authid]"))
+	}
+	match := func(sess *Session) bool { return sess.AuthID == authid }
+	killed := r.killSessions(notCaller(match, details), killReason(kwargs))
+	ids := make([]interface{}, len(killed))
+	for i, id := range killed {
+		ids[i] = id
+	}
+	return &CallResult{Args: []interface{}{ids}}
+}
+
+func (r *Realm) sessionKillByAuthRole(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	authrole, _ := argString(args)
+	if authrole == "" {
+		return invalidArgument(fmt.Errorf("expected [authrole]"))
+	}
+	killed := r.killSessions(notCaller(hasAuthRole([]string{authrole}), details), killReason(kwargs))
+	return &CallResult{Args: []interface{}{len(killed)}}
+}
+
+func argString(args []interface{}) (string, bool) {
+	if len(args) != 1 {
+		return "", false
+	}
+	s, ok := args[0].(string)
+	return s, ok
+}
@@ -0,0 +1,94 @@
+package turnpike
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testRoleAuthenticator struct{}
+
+func (t *testRoleAuthenticator) Authenticate(details map[string]interface{}) (map[string]interface{}, error) {
+	return map[string]interface{}{"authid": details["authid"], "authrole": details["authrole"]}, nil
+}
+
+func joinWithRole(router *defaultRouter, authid, authrole string) *Client {
+	client := NewClient(router.getTestPeer())
+	client.ReceiveTimeout = time.Second
+	client.AuthMethods = []string{"test"}
+	client.AuthID = authid
+	_, err := client.JoinRealm(string(testRealm), map[string]interface{}{"authrole": authrole})
+	So(err, ShouldBeNil)
+	return client
+}
+
+func TestSessionMetaProcedures(t *testing.T) {
+	Convey("Given a realm with a support session and two tablets", t, func() {
+		router := NewDefaultRouter().(*defaultRouter)
+		defer router.Close()
+		router.RegisterRealm(testRealm, &Realm{
+			Authenticators:   map[string]Authenticator{"test": &testRoleAuthenticator{}},
+			SessionKillRoles: []string{"support"},
+		})
+		support := joinWithRole(router, "staff-1", "support")
+		tablet := joinWithRole(router, "tablet-1", "tablet")
+		joinWithRole(router, "tablet-2", "tablet")
+
+		Convey("Sessions should be counted and listed, optionally by authrole", func() {
+			res, err := support.Call(MetaSessionCount, nil, nil, nil)
+			So(err, ShouldBeNil)
+			So(res.Arguments[0], ShouldEqual, 3)
+
+			res, err = support.Call(MetaSessionCount, nil, []interface{}{[]interface{}{"tablet"}}, nil)
+			So(err, ShouldBeNil)
+			So(res.Arguments[0], ShouldEqual, 2)
+
+			res, err = support.Call(MetaSessionList, nil, []interface{}{[]interface{}{"support"}}, nil)
+			So(err, ShouldBeNil)
+			So(res.Arguments[0], ShouldHaveLength, 1)
+
+			res, err = support.Call(MetaSessionGet, nil, []interface{}{res.Arguments[0].([]interface{})[0]}, nil)
+			So(err, ShouldBeNil)
+			So(res.Arguments[0].(map[string]interface{})["authid"], ShouldEqual, "staff-1")
+		})
+
+		Convey("Getting an unknown session should fail with no_such_session", func() {
+			_, err := support.Call(MetaSessionGet, nil, []interface{}{ID(1)}, nil)
+			So(err, ShouldNotBeNil)
+			So(err.(RPCError).ErrorMessage.Error, ShouldEqual, ErrNoSuchSession)
+		})
+
+		Convey("Sessions without a kill role should not be able to kill sessions", func() {
+			_, err := tablet.Call(MetaSessionKillByAuthRole, nil, []interface{}{"support"}, nil)
+			So(err, ShouldNotBeNil)
+			So(err.(RPCError).ErrorMessage.Error, ShouldEqual, ErrNotAuthorized)
+		})
+
+		Convey("Support should be able to kill a tablet by authid", func() {
+			res, err := support.Call(MetaSessionKillByAuthID, nil, []interface{}{"tablet-1"}, nil)
+			So(err, ShouldBeNil)
+			So(res.Arguments[0], ShouldHaveLength, 1)
+
+			count := -1
+			for i := 0; i < 50 && count != 1; i++ {
+				time.Sleep(10 * time.Millisecond)
+				res, err = support.Call(MetaSessionCount, nil, []interface{}{[]interface{}{"tablet"}}, nil)
+				So(err, ShouldBeNil)
+				count = res.Arguments[0].(int)
+			}
+			So(count, ShouldEqual, 1)
+		})
+
+		Convey("Killing by the caller's own authid or authrole should spare the caller", func() {
+			res, err := support.Call(MetaSessionKillByAuthRole, nil, []interface{}{"support"}, nil)
+			So(err, ShouldBeNil)
+			So(res.Arguments[0], ShouldEqual, 0)
+
+			joinWithRole(router, "staff-1", "support")
+			res, err = support.Call(MetaSessionKillByAuthID, nil, []interface{}{"staff-1"}, nil)
+			So(err, ShouldBeNil)
+			So(res.Arguments[0], ShouldHaveLength, 1)
+		})
+	})
+}
@@ -2,6 +2,7 @@ package turnpike
 
 import (
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -19,3 +20,51 @@ func TestNextRequestId(t *testing.T) {
 		})
 	})
 }
+
+func TestSessionMetaEvents(t *testing.T) {
+	Convey("Given a client subscribed to session meta events", t, func() {
+		router := NewDefaultRouter().(*defaultRouter)
+		defer router.Close()
+		router.RegisterRealm(testRealm, &Realm{
+			Authenticators: map[string]Authenticator{"test": &testRoleAuthenticator{}},
+		})
+		observer := joinWithRole(router, "staff-1", "support")
+		joins := make(chan []interface{}, 10)
+		leaves := make(chan []interface{}, 10)
+		So(observer.Subscribe("wamp.session.on_join", nil, func(args []interface{}, kwargs map[string]interface{}) {
+			joins <- args
+		}), ShouldBeNil)
+		So(observer.Subscribe("wamp.session.on_leave", nil, func(args []interface{}, kwargs map[string]interface{}) {
+			leaves <- args
+		}), ShouldBeNil)
+
+		// the observer may still see the event of its own join
+		next := func(events chan []interface{}, authid string) []interface{} {
+			for {
+				select {
+				case args := <-events:
+					if details, ok := args[0].(map[string]interface{}); ok && details["authid"] == authid {
+						return args
+					} else if len(args) > 1 && args[1] == authid {
+						return args
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("no event for %s", authid)
+					return nil
+				}
+			}
+		}
+
+		Convey("Joins and leaves should carry the session's identity", func() {
+			tablet := joinWithRole(router, "tablet-1", "tablet")
+			joined := next(joins, "tablet-1")[0].(map[string]interface{})
+			So(joined["authid"], ShouldEqual, "tablet-1")
+			So(joined["authrole"], ShouldEqual, "tablet")
+			So(joined["authmethod"], ShouldEqual, "test")
+			So(joined, ShouldContainKey, "joined_at")
+
+			tablet.Peer.Close()
+			So(next(leaves, "tablet-1"), ShouldResemble, []interface{}{joined["session"], "tablet-1", "tablet"})
+		})
+	})
+}
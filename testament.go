@@ -0,0 +1,179 @@
+package turnpike
+
+import (
+	"fmt"
+	"sync"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// Session meta procedures for testaments: events the router publishes on
+// behalf of a session when it goes away, e.g. to tell subscribers that a
+// gateway is offline.
+const (
+	// Adds a testament for the calling session. The arguments are the topic
+	// and optionally the args and kwargs of the event; the keyword arguments
+	// "publish_options" (a dict) and "scope" ("destroyed" or "detached",
+	// defaulting to "destroyed") are accepted too.
+	MetaAddTestament = "wamp.session.add_testament"
+	// Removes the testaments of the calling session for the scope given as
+	// "scope" keyword argument, and returns how many there were.
+	MetaFlushTestaments = "wamp.session.flush_testaments"
+)
+
+// Testament scopes. Sessions can't be resumed, so both are published when a
+// session leaves the realm, detached testaments first.
+const (
+	TestamentDestroyed = "destroyed"
+	TestamentDetached  = "detached"
+)
+
+type testament struct {
+	scope   string
+	topic   URI
+	args    []interface{}
+	kwargs  map[string]interface{}
+	options map[string]interface{}
+}
+
+// testaments holds the testaments of a realm's sessions.
+type testaments struct {
+	sessions map[ID][]testament
+	lock     sync.Mutex
+}
+
+func (t *testaments) add(session ID, ts testament) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.sessions == nil {
+		t.sessions = make(map[ID][]testament)
+	}
+	t.sessions[session] = append(t.sessions[session], ts)
+}
+
+// flush removes the testaments of a session for a scope and returns how many
+// there were.
+func (t *testaments) flush(session ID, scope string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var kept []testament
+	for _, ts := range t.sessions[session] {
+		if ts.scope != scope {
+			kept = append(kept, ts)
+		}
+	}
+	flushed := len(t.sessions[session]) - len(kept)
+	if len(kept) == 0 {
+		delete(t.sessions, session)
+	} else {
+		t.sessions[session] = kept
+	}
+	return flushed
+}
+
+// take removes and returns all testaments of a session, detached ones first.
+func (t *testaments) take(session ID) []testament {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var taken []testament
+	for _, scope := range []string{TestamentDetached, TestamentDestroyed} {
+		for _, ts := range t.sessions[session] {
+			if ts.scope == scope {
+				taken = append(taken, ts)
+			}
+		}
+	}
+	delete(t.sessions, session)
+	return taken
+}
+
+// publishTestaments publishes the testaments of a session that left the realm.
+func (r *Realm) publishTestaments(sess *Session) {
+	for _, ts := range r.testaments.take(sess.Id) {
+		if err := r.localClient.Publish(string(ts.topic), ts.options, ts.args, ts.kwargs); err != nil {
+			log.WithFields(logrus.Fields{
+				"session_id": sess.Id,
+				"topic":      ts.topic,
+				"error":      err,
+			}).Error("error publishing testament")
+		}
+	}
+}
+
+// callerSession returns the session that made a call to a procedure that was
+// registered with the "disclose_caller" option.
+func (r *Realm) callerSession(details map[string]interface{}) (*Session, bool) {
+	id, ok := toInt64(details["caller"])
+	if !ok {
+		return nil, false
+	}
+	val, ok := r.clients.Get(fmt.Sprintf("%d", id))
+	if !ok {
+		return nil, false
+	}
+	sess, ok := val.(*Session)
+	return sess, ok
+}
+
+func testamentScope(kwargs map[string]interface{}) (string, error) {
+	scope, _ := kwargs["scope"].(string)
+	switch scope {
+	case "":
+		return TestamentDestroyed, nil
+	case TestamentDestroyed, TestamentDetached:
+		return scope, nil
+	}
+	return "", fmt.Errorf("invalid testament scope: %s", scope)
+}
+
+func (r *Realm) addTestament(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	sess, ok := r.callerSession(details)
+	if !ok {
+		return &CallResult{Err: ErrNoSuchSession}
+	}
+	if len(args) == 0 || len(args) > 3 {
+		return invalidArgument(fmt.Errorf("expected [topic, args, kwargs]"))
+	}
+	topic, _ := args[0].(string)
+	if topic == "" {
+		return invalidArgument(fmt.Errorf("topic must be a URI"))
+	}
+	ts := testament{topic: URI(topic), options: map[string]interface{}{}}
+	if len(args) > 1 && args[1] != nil {
+		if ts.args, ok = args[1].([]interface{}); !ok {
+			return invalidArgument(fmt.Errorf("args must be a list"))
+		}
+	}
+	if len(args) > 2 && args[2] != nil {
+		if ts.kwargs, ok = toStringMap(args[2]); !ok {
+			return invalidArgument(fmt.Errorf("kwargs must be a dict"))
+		}
+	}
+	if options, ok := toStringMap(kwargs["publish_options"]); ok {
+		ts.options = options
+	}
+	var err error
+	if ts.scope, err = testamentScope(kwargs); err != nil {
+		return invalidArgument(err)
+	}
+	// the session must be allowed to publish the testament itself
+	if authorized, err := r.Authorizer.Authorize(sess, &Publish{Topic: ts.topic, Options: ts.options}); err != nil {
+		return &CallResult{Err: ErrAuthorizationFailed}
+	} else if !authorized {
+		return &CallResult{Err: ErrNotAuthorized}
+	}
+	r.testaments.add(sess.Id, ts)
+	return &CallResult{}
+}
+
+func (r *Realm) flushTestaments(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	sess, ok := r.callerSession(details)
+	if !ok {
+		return &CallResult{Err: ErrNoSuchSession}
+	}
+	scope, err := testamentScope(kwargs)
+	if err != nil {
+		return invalidArgument(err)
+	}
+	return &CallResult{Args: []interface{}{r.testaments.flush(sess.Id, scope)}}
+}
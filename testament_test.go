@@ -0,0 +1,53 @@
+package turnpike
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTestaments(t *testing.T) {
+	Convey("Given a dashboard subscribed to gateway status and a gateway", t, func() {
+		router := newTestRouter()
+		defer router.Close()
+		dashboard := newTestClient(router.getTestPeer())
+		gateway := newTestClient(router.getTestPeer())
+		events := make(chan []interface{}, 10)
+		So(dashboard.Subscribe("com.example.gateway.offline", nil, func(args []interface{}, kwargs map[string]interface{}) {
+			events <- args
+		}), ShouldBeNil)
+
+		Convey("A testament should be published when the gateway's connection drops", func() {
+			_, err := gateway.Call(MetaAddTestament, nil, []interface{}{"com.example.gateway.offline", []interface{}{"gw-1"}}, nil)
+			So(err, ShouldBeNil)
+			gateway.Peer.Close()
+			select {
+			case args := <-events:
+				So(args, ShouldResemble, []interface{}{"gw-1"})
+			case <-time.After(time.Second):
+				t.Fatal("testament was not published")
+			}
+		})
+
+		Convey("Flushed testaments should not be published", func() {
+			_, err := gateway.Call(MetaAddTestament, nil, []interface{}{"com.example.gateway.offline", []interface{}{"gw-1"}}, nil)
+			So(err, ShouldBeNil)
+			res, err := gateway.Call(MetaFlushTestaments, nil, nil, nil)
+			So(err, ShouldBeNil)
+			So(res.Arguments[0], ShouldEqual, 1)
+			gateway.Peer.Close()
+			select {
+			case args := <-events:
+				t.Fatalf("unexpected testament %v", args)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+
+		Convey("Testaments with an invalid scope should be rejected", func() {
+			_, err := gateway.Call(MetaAddTestament, nil, []interface{}{"com.example.gateway.offline"}, map[string]interface{}{"scope": "forever"})
+			So(err, ShouldNotBeNil)
+			So(err.(RPCError).ErrorMessage.Error, ShouldEqual, ErrInvalidArgument)
+		})
+	})
+}
@@ -0,0 +1,314 @@
+package turnpike
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuthCookieName   = "turnpike_auth"
+	defaultAuthCookieMaxAge = 7 * 24 * time.Hour
+	authCookieIDSize        = 24
+)
+
+// TransportInfo describes the transport a session connected over. Routers pass
+// it to authenticators as the "transport" HELLO detail, and keep it in
+// Session.Transport.
+type TransportInfo struct {
+	// RemoteAddr is the network address of the client.
+	RemoteAddr string
+	// Headers holds the HTTP headers of the websocket upgrade request that the
+	// server was configured to forward (see WebsocketServer.TransportHeaders).
+	Headers http.Header
+	// Cookies holds the cookies of the upgrade request.
+	Cookies []*http.Cookie
+	// PeerCertificates is the verified TLS certificate chain of the client,
+	// leaf first. It is nil if the client didn't present a certificate or the
+	// server didn't verify it.
+	PeerCertificates []*x509.Certificate
+	// AuthCookie is the value of the authentication cookie of the connection,
+	// sent by the client or set on the upgrade response by the server's
+	// CookieAuthenticator.
+	AuthCookie string
+	// authCookieIssued is set if AuthCookie was set on the upgrade response of
+	// this connection; only such cookies are bound to the identity the
+	// connection authenticates as.
+	authCookieIssued bool
+}
+
+// TransportPeer is implemented by peers that know the transport they are
+// connected over.
+type TransportPeer interface {
+	TransportInfo() *TransportInfo
+}
+
+// newTransportInfo collects the transport information of a websocket upgrade
+// request.
+func newTransportInfo(r *http.Request, headers []string) *TransportInfo {
+	t := &TransportInfo{
+		RemoteAddr: r.RemoteAddr,
+		Headers:    make(http.Header),
+		Cookies:    r.Cookies(),
+	}
+	for _, h := range headers {
+		if v, ok := r.Header[http.CanonicalHeaderKey(h)]; ok {
+			t.Headers[http.CanonicalHeaderKey(h)] = v
+		}
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		t.PeerCertificates = r.TLS.VerifiedChains[0]
+	}
+	return t
+}
+
+// transportFromDetails returns the transport information the router added to
+// the HELLO details.
+func transportFromDetails(details map[string]interface{}) (*TransportInfo, bool) {
+	t, ok := details["transport"].(*TransportInfo)
+	return t, ok && t != nil
+}
+
+// AuthenticationObserver may be implemented by an Authenticator or
+// CRAuthenticator that needs to know about sessions that authenticated with
+// other methods. Realms call Authenticated with the HELLO details (including
+// the transport) and the WELCOME details of every successful authentication.
+type AuthenticationObserver interface {
+	Authenticated(hello map[string]interface{}, welcome map[string]interface{})
+}
+
+// TLSCertificateMapper maps the verified certificate chain of a client to its
+// authid and authrole, or returns an error if it may not authenticate.
+type TLSCertificateMapper func(chain []*x509.Certificate) (authid string, authrole string, err error)
+
+// TLSCommonNames returns a TLSCertificateMapper that uses the common name of
+// the client certificate as authid, and assigns the role it maps to in roles.
+// Certificates with other common names are rejected.
+func TLSCommonNames(roles map[string]string) TLSCertificateMapper {
+	return func(chain []*x509.Certificate) (string, string, error) {
+		cn := chain[0].Subject.CommonName
+		authrole, ok := roles[cn]
+		if !ok {
+			return "", "", fmt.Errorf("no principal for certificate: %s", cn)
+		}
+		return cn, authrole, nil
+	}
+}
+
+type tlsAuthenticator struct {
+	mapper TLSCertificateMapper
+}
+
+// NewTLSAuthenticator returns an Authenticator for the "tls" authmethod, which
+// authenticates clients by their TLS client certificate.
+//
+// The certificate must have been verified by the TLS server, e.g. with
+// tls.Config.ClientAuth set to tls.VerifyClientCertIfGiven; unverified
+// certificates aren't seen by the authenticator. If the client sent an authid
+// in the HELLO details it must match the one the certificate maps to.
+func NewTLSAuthenticator(mapper TLSCertificateMapper) Authenticator {
+	return &tlsAuthenticator{mapper: mapper}
+}
+
+func (a *tlsAuthenticator) Authenticate(details map[string]interface{}) (map[string]interface{}, error) {
+	transport, ok := transportFromDetails(details)
+	if !ok || len(transport.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("no verified client certificate: %w", ErrNoCredentials)
+	}
+	authid, authrole, err := a.mapper(transport.PeerCertificates)
+	if err != nil {
+		return nil, err
+	}
+	if requested, _ := details["authid"].(string); requested != "" && requested != authid {
+		return nil, fmt.Errorf("authid %s does not match client certificate", requested)
+	}
+	return map[string]interface{}{
+		"authid":       authid,
+		"authrole":     authrole,
+		"authprovider": "turnpike",
+	}, nil
+}
+
+type cookieIdentity struct {
+	authid   string
+	authrole string
+	expires  time.Time
+	// authExpires is when the credentials the cookie was bound with expire,
+	// if they do
+	authExpires time.Time
+}
+
+// CookieAuthenticator implements the "cookie" authmethod: the websocket server
+// sets a signed cookie on the upgrade response, and once the connection
+// authenticates with another method, the cookie is bound to the identity it
+// authenticated as. Later connections that send the cookie are authenticated
+// as that identity without credentials, until the cookie expires.
+//
+// Use the same CookieAuthenticator as WebsocketServer.CookieAuth and as the
+// "cookie" Authenticator of the realm. Clients should list "cookie" before
+// their other authmethods.
+type CookieAuthenticator struct {
+	// Name is the name of the cookie; it defaults to "turnpike_auth".
+	Name string
+	// MaxAge is how long a cookie stays valid after it is bound to an
+	// identity; it defaults to 7 days.
+	MaxAge time.Duration
+	// Secure and Path set the attributes of the cookie.
+	Secure bool
+	Path   string
+
+	key        []byte
+	identities map[string]cookieIdentity
+	lock       sync.Mutex
+}
+
+// NewCookieAuthenticator returns a CookieAuthenticator that signs its cookies
+// with key.
+func NewCookieAuthenticator(key []byte) *CookieAuthenticator {
+	return &CookieAuthenticator{
+		Name:       defaultAuthCookieName,
+		MaxAge:     defaultAuthCookieMaxAge,
+		key:        key,
+		identities: make(map[string]cookieIdentity),
+	}
+}
+
+func (a *CookieAuthenticator) sign(id string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signature of a cookie value and returns its ID.
+func (a *CookieAuthenticator) verify(value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", false
+	}
+	id := value[:i]
+	return id, hmac.Equal([]byte(value), []byte(a.sign(id)))
+}
+
+// cookie returns the value of the authentication cookie sent with the request
+// if it is bound to a principal, or issues a new one that must be set on the
+// upgrade response. Cookies that aren't bound yet are replaced, so that a
+// cookie planted in the client by someone else can't be bound.
+func (a *CookieAuthenticator) cookie(r *http.Request) (string, *http.Cookie, error) {
+	if c, err := r.Cookie(a.Name); err == nil {
+		if id, ok := a.verify(c.Value); ok && a.bound(id) {
+			return c.Value, nil, nil
+		}
+	}
+	b := make([]byte, authCookieIDSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	value := a.sign(base64.RawURLEncoding.EncodeToString(b))
+	return value, &http.Cookie{
+		Name:     a.Name,
+		Value:    value,
+		Path:     a.Path,
+		MaxAge:   int(a.MaxAge / time.Second),
+		Secure:   a.Secure,
+		HttpOnly: true,
+	}, nil
+}
+
+// bound reports whether the cookie ID is bound to a principal.
+func (a *CookieAuthenticator) bound(id string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	identity, ok := a.identities[id]
+	return ok && !time.Now().After(identity.expires)
+}
+
+func (a *CookieAuthenticator) Authenticate(details map[string]interface{}) (map[string]interface{}, error) {
+	transport, ok := transportFromDetails(details)
+	if !ok || transport.AuthCookie == "" {
+		return nil, fmt.Errorf("no authentication cookie: %w", ErrNoCredentials)
+	}
+	id, ok := a.verify(transport.AuthCookie)
+	if !ok {
+		return nil, fmt.Errorf("invalid authentication cookie")
+	}
+	a.lock.Lock()
+	identity, ok := a.identities[id]
+	if ok && time.Now().After(identity.expires) {
+		delete(a.identities, id)
+		ok = false
+	}
+	a.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("authentication cookie is not bound to a principal: %w", ErrNoCredentials)
+	}
+	if requested, _ := details["authid"].(string); requested != "" && requested != identity.authid {
+		return nil, fmt.Errorf("authid %s does not match authentication cookie", requested)
+	}
+	welcome := map[string]interface{}{
+		"authid":       identity.authid,
+		"authrole":     identity.authrole,
+		"authprovider": "turnpike",
+	}
+	if !identity.authExpires.IsZero() {
+		welcome[AuthExpiresDetail] = identity.authExpires
+	}
+	return welcome, nil
+}
+
+// Authenticated binds the authentication cookie of a connection to the
+// identity it authenticated as, until MaxAge passes or the credentials it
+// authenticated with expire. Only a cookie issued on the upgrade response of
+// the connection itself is bound; cookies the client already had are not.
+func (a *CookieAuthenticator) Authenticated(hello map[string]interface{}, welcome map[string]interface{}) {
+	if method, _ := welcome["authmethod"].(string); method == "cookie" {
+		return
+	}
+	transport, ok := transportFromDetails(hello)
+	if !ok || transport.AuthCookie == "" || !transport.authCookieIssued {
+		return
+	}
+	id, ok := a.verify(transport.AuthCookie)
+	if !ok {
+		return
+	}
+	authid, _ := welcome["authid"].(string)
+	authrole, _ := welcome["authrole"].(string)
+	if authid == "" {
+		return
+	}
+	now := time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for k, identity := range a.identities {
+		if now.After(identity.expires) {
+			delete(a.identities, k)
+		}
+	}
+	identity := cookieIdentity{authid: authid, authrole: authrole, expires: now.Add(a.MaxAge)}
+	if expires, ok := welcome[AuthExpiresDetail].(time.Time); ok {
+		identity.authExpires = expires
+		if expires.Before(identity.expires) {
+			identity.expires = expires
+		}
+	}
+	a.identities[id] = identity
+}
+
+// Revoke unbinds all cookies bound to authid. Realms call it when the
+// credentials of authid are revoked by one of their authenticators.
+func (a *CookieAuthenticator) Revoke(authid string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for k, identity := range a.identities {
+		if identity.authid == authid {
+			delete(a.identities, k)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package turnpike
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testTransportPeer struct {
+	*localPeer
+	transport *TransportInfo
+}
+
+func (p *testTransportPeer) TransportInfo() *TransportInfo {
+	return p.transport
+}
+
+// acceptWithTransport runs a handshake over a peer with the given transport and
+// returns the message the router answered the HELLO with.
+func acceptWithTransport(r Router, transport *TransportInfo, details map[string]interface{}, msgs ...Message) Message {
+	c, server := localPipe()
+	client := &basicPeer{c}
+	client.Send(&Hello{Realm: testRealm, Details: details})
+	for _, msg := range msgs {
+		client.Send(msg)
+	}
+	r.Accept(&testTransportPeer{localPeer: server, transport: transport})
+	return <-client.incoming
+}
+
+func TestTLSAuthenticator(t *testing.T) {
+	Convey("Given a realm with a TLS authenticator", t, func() {
+		r := NewDefaultRouter()
+		defer r.Close()
+		r.RegisterRealm(testRealm, &Realm{
+			Authenticators: map[string]Authenticator{
+				"tls": NewTLSAuthenticator(TLSCommonNames(map[string]string{"device-7": "device"})),
+			},
+		})
+		hello := map[string]interface{}{"authmethods": []interface{}{"tls"}}
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "device-7"}}
+
+		Convey("A client with a known certificate should be welcomed with its identity", func() {
+			msg := acceptWithTransport(r, &TransportInfo{PeerCertificates: []*x509.Certificate{cert}}, hello)
+			welcome, ok := msg.(*Welcome)
+			So(ok, ShouldBeTrue)
+			So(welcome.Details["authid"], ShouldEqual, "device-7")
+			So(welcome.Details["authrole"], ShouldEqual, "device")
+		})
+
+		Convey("A client with an unknown certificate should be rejected", func() {
+			other := &x509.Certificate{Subject: pkix.Name{CommonName: "device-8"}}
+			msg := acceptWithTransport(r, &TransportInfo{PeerCertificates: []*x509.Certificate{other}}, hello)
+			So(msg.MessageType(), ShouldEqual, ABORT)
+		})
+
+		Convey("A client should not be able to supply its own transport", func() {
+			spoofed := map[string]interface{}{
+				"authmethods": []interface{}{"tls"},
+				"transport":   &TransportInfo{PeerCertificates: []*x509.Certificate{cert}},
+			}
+			msg := acceptWithTransport(r, nil, spoofed)
+			So(msg.MessageType(), ShouldEqual, ABORT)
+		})
+	})
+}
+
+func TestCookieAuthenticator(t *testing.T) {
+	Convey("Given a realm with cookie and ticket authenticators", t, func() {
+		cookies := NewCookieAuthenticator([]byte("cookie key"))
+		hash, _ := HashTicket("ticket1")
+		store := NewMemoryCredentialStore(map[string]Credential{"alice": {AuthRole: "viewer", Ticket: hash}})
+		r := NewDefaultRouter()
+		defer r.Close()
+		r.RegisterRealm(testRealm, &Realm{
+			Authenticators:   map[string]Authenticator{"cookie": cookies},
+			CRAuthenticators: map[string]CRAuthenticator{"ticket": NewTicketAuthenticator(store)},
+		})
+		value, cookie, err := cookies.cookie(httptest.NewRequest("GET", "/", nil))
+		So(err, ShouldBeNil)
+		So(cookie, ShouldNotBeNil)
+		hello := map[string]interface{}{"authmethods": []interface{}{"cookie", "ticket"}, "authid": "alice"}
+		issued := &TransportInfo{AuthCookie: value, authCookieIssued: true}
+
+		Convey("A cookie should not authenticate before it is bound", func() {
+			msg := acceptWithTransport(r, &TransportInfo{AuthCookie: value}, map[string]interface{}{"authmethods": []interface{}{"cookie"}})
+			So(msg.MessageType(), ShouldEqual, ABORT)
+		})
+
+		Convey("A connection that authenticated with a ticket should bind its cookie", func() {
+			msg := acceptWithTransport(r, issued, hello, &Authenticate{Signature: "ticket1"})
+			So(msg.MessageType(), ShouldEqual, CHALLENGE)
+
+			Convey("And a later connection with the cookie should be welcomed without credentials", func() {
+				msg := acceptWithTransport(r, &TransportInfo{AuthCookie: value}, hello)
+				welcome, ok := msg.(*Welcome)
+				So(ok, ShouldBeTrue)
+				So(welcome.Details["authmethod"], ShouldEqual, "cookie")
+				So(welcome.Details["authid"], ShouldEqual, "alice")
+				So(welcome.Details["authrole"], ShouldEqual, "viewer")
+			})
+
+			Convey("And a revoked cookie should not authenticate", func() {
+				cookies.Revoke("alice")
+				msg := acceptWithTransport(r, &TransportInfo{AuthCookie: value}, hello, &Authenticate{Signature: "ticket2"})
+				So(msg.MessageType(), ShouldEqual, CHALLENGE)
+			})
+
+			Convey("And revoking the credentials should unbind the cookie", func() {
+				store.Remove("alice")
+				msg := acceptWithTransport(r, &TransportInfo{AuthCookie: value}, map[string]interface{}{"authmethods": []interface{}{"cookie"}})
+				So(msg.MessageType(), ShouldEqual, ABORT)
+			})
+		})
+
+		Convey("A cookie the connection didn't issue should not be bound", func() {
+			// e.g. a cookie the attacker obtained and planted in the victim's browser
+			msg := acceptWithTransport(r, &TransportInfo{AuthCookie: value}, hello, &Authenticate{Signature: "ticket1"})
+			So(msg.MessageType(), ShouldEqual, CHALLENGE)
+			msg = acceptWithTransport(r, &TransportInfo{AuthCookie: value}, map[string]interface{}{"authmethods": []interface{}{"cookie"}})
+			So(msg.MessageType(), ShouldEqual, ABORT)
+		})
+
+		Convey("A cookie should not outlive the credentials it was bound with", func() {
+			cookies.Authenticated(map[string]interface{}{"transport": issued},
+				map[string]interface{}{"authid": "alice", "authrole": "viewer", AuthExpiresDetail: time.Now().Add(-time.Second)})
+			msg := acceptWithTransport(r, &TransportInfo{AuthCookie: value}, map[string]interface{}{"authmethods": []interface{}{"cookie"}})
+			So(msg.MessageType(), ShouldEqual, ABORT)
+
+			expires := time.Now().Add(time.Hour)
+			cookies.Authenticated(map[string]interface{}{"transport": issued},
+				map[string]interface{}{"authid": "alice", "authrole": "viewer", AuthExpiresDetail: expires})
+			details, err := cookies.Authenticate(map[string]interface{}{"transport": &TransportInfo{AuthCookie: value}})
+			So(err, ShouldBeNil)
+			So(details[AuthExpiresDetail], ShouldEqual, expires)
+		})
+
+		Convey("A tampered cookie should not authenticate", func() {
+			cookies.Authenticated(map[string]interface{}{"transport": issued},
+				map[string]interface{}{"authid": "alice", "authrole": "viewer"})
+			msg := acceptWithTransport(r, &TransportInfo{AuthCookie: value + "x"}, map[string]interface{}{"authmethods": []interface{}{"cookie"}})
+			So(msg.MessageType(), ShouldEqual, ABORT)
+		})
+	})
+}
+
+func TestWebsocketServerTransport(t *testing.T) {
+	Convey("Given a websocket server with cookie authentication", t, func() {
+		r := NewDefaultRouter()
+		defer r.Close()
+		r.RegisterRealm(testRealm, &Realm{})
+		s := newWebsocketServer(r)
+		s.CookieAuth = NewCookieAuthenticator([]byte("cookie key"))
+		s.TransportHeaders = []string{"user-agent"}
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{})
+		So(err, ShouldBeNil)
+		defer l.Close()
+		go (&http.Server{Handler: s}).Serve(l)
+		url := fmt.Sprintf("ws://localhost:%d/", l.Addr().(*net.TCPAddr).Port)
+		dialer := websocket.Dialer{Subprotocols: []string{jsonWebsocketProtocol}}
+
+		Convey("The upgrade response should set an authentication cookie", func() {
+			conn, resp, err := dialer.Dial(url, http.Header{"User-Agent": {"test"}})
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			So(resp.Cookies(), ShouldHaveLength, 1)
+			So(resp.Cookies()[0].Name, ShouldEqual, "turnpike_auth")
+
+			Convey("And replace one the client sends that isn't bound", func() {
+				header := http.Header{"Cookie": {resp.Cookies()[0].String()}}
+				conn, next, err := dialer.Dial(url, header)
+				So(err, ShouldBeNil)
+				defer conn.Close()
+				So(next.Cookies(), ShouldHaveLength, 1)
+				So(next.Cookies()[0].Value, ShouldNotEqual, resp.Cookies()[0].Value)
+			})
+
+			Convey("But not one that is bound to a principal", func() {
+				transport := &TransportInfo{AuthCookie: resp.Cookies()[0].Value, authCookieIssued: true}
+				s.CookieAuth.Authenticated(map[string]interface{}{"transport": transport},
+					map[string]interface{}{"authid": "alice", "authrole": "viewer"})
+				header := http.Header{"Cookie": {resp.Cookies()[0].String()}}
+				conn, resp, err := dialer.Dial(url, header)
+				So(err, ShouldBeNil)
+				defer conn.Close()
+				So(resp.Cookies(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("The transport should carry the forwarded headers and the cookie", func() {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("User-Agent", "test")
+			req.Header.Set("Authorization", "secret")
+			transport := newTransportInfo(req, s.TransportHeaders)
+			So(transport.Headers.Get("User-Agent"), ShouldEqual, "test")
+			So(transport.Headers.Get("Authorization"), ShouldBeEmpty)
+			So(transport.RemoteAddr, ShouldEqual, req.RemoteAddr)
+		})
+	})
+}
@@ -35,6 +35,22 @@ const (
 	// conform - in which case the Router may throw this error.
 	ErrInvalidArgument = URI("wamp.error.invalid_argument")
 
+	// A call was not answered by the callee within the timeout requested by the
+	// caller.
+	ErrTimeout = URI("wamp.error.timeout")
+
+	// A call was canceled, e.g. because its callee left the realm.
+	ErrCanceled = URI("wamp.error.canceled")
+
+	// A session meta procedure was called with the ID of a session that isn't
+	// joined to the realm.
+	ErrNoSuchSession = URI("wamp.error.no_such_session")
+
+	// A Peer sent a message that violates the WAMP protocol, e.g. a message
+	// that isn't allowed in the session's state or an invalid URI or ID - used
+	// as an ABORT reason.
+	ErrProtocolViolation = URI("wamp.error.protocol_violation")
+
 	// --- Session Close ---
 
 	// The Peer is shutting down completely - used as a GOODBYE (or ABORT) reason.
@@ -46,6 +62,18 @@ const (
 	// A Peer acknowledges ending of a session - used as a GOOBYE reply reason.
 	ErrGoodbyeAndOut = URI("wamp.error.goodbye_and_out")
 
+	// The credentials the session authenticated with have expired - used as a
+	// GOODBYE reason.
+	ErrAuthExpired = URI("wamp.close.auth_expired")
+
+	// The credentials the session authenticated with have been revoked - used
+	// as a GOODBYE reason.
+	ErrAuthRevoked = URI("wamp.close.auth_revoked")
+
+	// The session was killed by another session through the session meta API -
+	// used as a GOODBYE reason.
+	ErrSessionKilled = URI("wamp.close.killed")
+
 	// --- Authorization ---
 
 	// A join, call, register, publish or subscribe failed, since the Peer is not
@@ -57,6 +85,10 @@ const (
 	// operation itself failed. E.g. a custom authorizer ran into an error.
 	ErrAuthorizationFailed = URI("wamp.error.authorization_failed")
 
+	// A Peer could not be authenticated, e.g. because its credentials are
+	// invalid or have expired.
+	ErrAuthenticationFailed = URI("wamp.error.authentication_failed")
+
 	// Peer wanted to join a non-existing realm (and the Router did not allow to
 	// auto-create the realm)
 	ErrNoSuchRealm = URI("wamp.error.no_such_realm")
@@ -76,7 +108,49 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-// NewID generates a random WAMP ID.
+// NewID generates a random WAMP ID, which is never 0.
 func NewID() ID {
-	return ID(rand.Int63n(maxID))
+	return ID(rand.Int63n(maxID) + 1)
+}
+
+// toInt64 converts a numeric value as decoded by one of the serializers to an
+// int64. IDs passed by internal clients are converted too.
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case ID:
+		return int64(n), true
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint64:
+		return int64(n), true
+	case float64:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// toStringMap converts a dict as decoded by one of the serializers to a
+// map[string]interface{}.
+func toStringMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			key, ok := k.(string)
+			if !ok {
+				return nil, false
+			}
+			res[key] = v
+		}
+		return res, true
+	}
+	return nil, false
 }
@@ -29,7 +29,14 @@ type websocketPeer struct {
 	inSending   chan struct{}
 	closing     chan struct{}
 	*ConnectionConfig
-	debugURL string
+	debugURL  string
+	transport *TransportInfo
+}
+
+// TransportInfo returns the transport information of a peer accepted by a
+// WebsocketServer, and nil for client peers.
+func (ep *websocketPeer) TransportInfo() *TransportInfo {
+	return ep.transport
 }
 
 func NewWebsocketPeer(serialization Serialization, url string, tlscfg *tls.Config, dial DialFunc) (Peer, error) {
@@ -54,6 +54,13 @@ type WebsocketServer struct {
 	BinarySerializer Serializer
 	ConnectionConfig
 
+	// TransportHeaders lists the headers of the upgrade request that are
+	// passed to authenticators in the session's TransportInfo.
+	TransportHeaders []string
+	// CookieAuth, if set, sets an authentication cookie on every upgrade
+	// response that doesn't have one bound to a principal yet.
+	CookieAuth *CookieAuthenticator
+
 	lock sync.RWMutex
 }
 
@@ -112,7 +119,8 @@ func (s *WebsocketServer) RegisterProtocol(proto string, payloadType int, serial
 	return nil
 }
 
-// GetLocalClient returns a client connected to the specified realm
+// GetLocalClient returns a client connected to the specified realm. See
+// Router.GetLocalPeer for the identity of its session.
 func (s *WebsocketServer) GetLocalClient(realm string, details map[string]interface{}) (*Client, error) {
 	peer, err := s.Router.GetLocalPeer(URI(realm), details)
 	if err != nil {
@@ -131,17 +139,32 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"method":      r.Method,
 		"path":        r.URL.Path,
 	}).Info("WebsocketServer.ServeHTTP")
+	transport := newTransportInfo(r, s.TransportHeaders)
+	var header http.Header
+	if s.CookieAuth != nil {
+		value, cookie, err := s.CookieAuth.cookie(r)
+		if err != nil {
+			log.Error("Error issuing authentication cookie:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if cookie != nil {
+			header = http.Header{"Set-Cookie": {cookie.String()}}
+		}
+		transport.AuthCookie = value
+		transport.authCookieIssued = cookie != nil
+	}
 	// TODO: subprotocol?
-	conn, err := s.Upgrader.Upgrade(w, r, nil)
+	conn, err := s.Upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Error("Error upgrading to websocket connection:", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	s.handleWebsocket(conn)
+	s.handleWebsocket(conn, transport)
 }
 
-func (s *WebsocketServer) handleWebsocket(conn *websocket.Conn) {
+func (s *WebsocketServer) handleWebsocket(conn *websocket.Conn, transport *TransportInfo) {
 	var serializer Serializer
 	var payloadType int
 	s.lock.RLock()
@@ -176,6 +199,7 @@ func (s *WebsocketServer) handleWebsocket(conn *websocket.Conn) {
 		payloadType:      payloadType,
 		closing:          make(chan struct{}),
 		ConnectionConfig: &s.ConnectionConfig,
+		transport:        transport,
 	}
 	go peer.run()
 